@@ -1,17 +1,49 @@
 package admin
 
-type personalAllowanceRequest struct {
-	Amount float64 `json:"amount"`
+import (
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+type allowanceLimitRequest struct {
+	TaxYear       int          `json:"taxYear"`
+	Amount        money.Money  `json:"amount"`
+	Multiplier    *money.Rate  `json:"multiplier,omitempty"`
+	IncomeRate    *money.Rate  `json:"incomeRate,omitempty"`
+	MinAmount     *money.Money `json:"minAmount,omitempty"`
+	MaxAmount     *money.Money `json:"maxAmount,omitempty"`
+	EffectiveFrom *time.Time   `json:"effectiveFrom,omitempty"`
 }
 
-type personalAllowanceResponse struct {
-	PersonalDeduction float64 `json:"personalDeduction"`
+type deductionResponse struct {
+	TaxYear       int         `json:"taxYear"`
+	AllowanceType string      `json:"allowanceType"`
+	Amount        money.Money `json:"amount"`
+	Multiplier    money.Rate  `json:"multiplier"`
+	IncomeRate    *money.Rate `json:"incomeRate,omitempty"`
+	MinAmount     money.Money `json:"minAmount"`
+	MaxAmount     money.Money `json:"maxAmount"`
+	Configured    bool        `json:"configured"`
+	Version       int         `json:"version,omitempty"`
+	EffectiveFrom *time.Time  `json:"effectiveFrom,omitempty"`
+	ETag          string      `json:"etag"`
 }
 
-type kReceiptAllowanceRequest struct {
-	Amount float64 `json:"amount"`
+type deductionVersionResponse struct {
+	Version       int          `json:"version"`
+	Amount        money.Money  `json:"amount"`
+	Multiplier    *money.Rate  `json:"multiplier,omitempty"`
+	IncomeRate    *money.Rate  `json:"incomeRate,omitempty"`
+	MinAmount     *money.Money `json:"minAmount,omitempty"`
+	MaxAmount     *money.Money `json:"maxAmount,omitempty"`
+	Deleted       bool         `json:"deleted,omitempty"`
+	EffectiveFrom time.Time    `json:"effectiveFrom"`
+	CreatedAt     time.Time    `json:"createdAt"`
 }
 
-type kReceiptAllowanceResponse struct {
-	KReceiptDeduction float64 `json:"kReceipt"`
+type rollbackRequest struct {
+	TaxYear       int        `json:"taxYear"`
+	Version       int        `json:"version"`
+	EffectiveFrom *time.Time `json:"effectiveFrom,omitempty"`
 }
@@ -0,0 +1,637 @@
+package admin
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/auth"
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+	"github.com/Ter4798/post-test-kbtg/money"
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func personalType(t *testing.T) tax.AllowanceType {
+	t.Helper()
+	allowanceType, ok := tax.LookupAllowanceType("personal")
+	if !ok {
+		t.Fatal("personal allowance type is not registered")
+	}
+	return allowanceType
+}
+
+// newContext builds a request context for user with the given path
+// parameters, given as name and value pairs.
+func newContext(method, body, user string, params ...string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+	c.Set(auth.UserKey, user)
+	return c, rec
+}
+
+// statusOf returns the status a handler answered with, either through an
+// HTTPError or by writing the response.
+func statusOf(err error, rec *httptest.ResponseRecorder) int {
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return rec.Code
+}
+
+func deductionValues(row deductionRow) []driver.Value {
+	value := func(v driver.Valuer) driver.Value {
+		s, _ := v.Value()
+		return s
+	}
+	values := []driver.Value{int64(row.Version), value(row.Amount), nil, nil, nil, nil, row.Deleted, row.EffectiveFrom, row.CreatedAt}
+	if row.Multiplier != nil {
+		values[2] = value(*row.Multiplier)
+	}
+	if row.IncomeRate != nil {
+		values[3] = value(*row.IncomeRate)
+	}
+	if row.MinAmount != nil {
+		values[4] = value(*row.MinAmount)
+	}
+	if row.MaxAmount != nil {
+		values[5] = value(*row.MaxAmount)
+	}
+	return values
+}
+
+func proposalValues(p proposal) []driver.Value {
+	values := []driver.Value{p.ID, p.Kind, p.AllowanceType, int64(p.TaxYear), []byte(p.Payload), p.Status, p.ProposedBy, p.ProposedAt, p.ExpiresAt,
+		nil, nil, nil, nil, nil}
+	if p.DecidedBy != nil {
+		values[9] = *p.DecidedBy
+	}
+	if p.DecidedAt != nil {
+		values[10] = *p.DecidedAt
+	}
+	if p.Reason != nil {
+		values[11] = *p.Reason
+	}
+	if p.BaseVersion != nil {
+		values[12] = int64(*p.BaseVersion)
+	}
+	if p.AppliedVersion != nil {
+		values[13] = int64(*p.AppliedVersion)
+	}
+	return values
+}
+
+func TestDeductionRowBounds(t *testing.T) {
+	personal := personalType(t)
+	testCases := []struct {
+		name        string
+		row         *deductionRow
+		expectedMin money.Money
+		expectedMax money.Money
+	}{
+		{
+			name:        "Not configured uses the registry",
+			expectedMin: money.New(10000),
+			expectedMax: money.New(100000),
+		},
+		{
+			name:        "Stored row without bounds uses the registry",
+			row:         &deductionRow{Amount: money.New(60000)},
+			expectedMin: money.New(10000),
+			expectedMax: money.New(100000),
+		},
+		{
+			name:        "Stored minimum only",
+			row:         &deductionRow{MinAmount: ptr(money.New(50000))},
+			expectedMin: money.New(50000),
+			expectedMax: money.New(100000),
+		},
+		{
+			name:        "Stored minimum and maximum",
+			row:         &deductionRow{MinAmount: ptr(money.New(50000)), MaxAmount: ptr(money.New(70000))},
+			expectedMin: money.New(50000),
+			expectedMax: money.New(70000),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			min, max := tc.row.bounds(personal)
+			if min != tc.expectedMin || max != tc.expectedMax {
+				t.Errorf("Expected %v to %v, got %v to %v", tc.expectedMin, tc.expectedMax, min, max)
+			}
+		})
+	}
+}
+
+func TestValidateAllowanceLimit(t *testing.T) {
+	personal := personalType(t)
+	stored := &deductionRow{Amount: money.New(60000), MinAmount: ptr(money.New(50000)), MaxAmount: ptr(money.New(70000))}
+	testCases := []struct {
+		name        string
+		req         allowanceLimitRequest
+		stored      *deductionRow
+		expectedErr string
+	}{
+		{
+			name: "Amount within the registry bounds",
+			req:  allowanceLimitRequest{Amount: money.New(60000)},
+		},
+		{
+			name:        "Amount above the registry bounds",
+			req:         allowanceLimitRequest{Amount: money.New(100001)},
+			expectedErr: "amount must be between 10000 and 100000",
+		},
+		{
+			name:   "Amount within the stored bounds",
+			req:    allowanceLimitRequest{Amount: money.New(65000)},
+			stored: stored,
+		},
+		{
+			name:        "Amount outside the stored bounds",
+			req:         allowanceLimitRequest{Amount: money.New(90000)},
+			stored:      stored,
+			expectedErr: "amount must be between 50000 and 70000",
+		},
+		{
+			name:        "Widening the bounds does not admit the amount",
+			req:         allowanceLimitRequest{Amount: money.New(90000), MinAmount: ptr(money.New(10000)), MaxAmount: ptr(money.New(100000))},
+			stored:      stored,
+			expectedErr: "amount must be between 50000 and 70000",
+		},
+		{
+			name:   "Widening the bounds with an amount inside the stored ones",
+			req:    allowanceLimitRequest{Amount: money.New(60000), MinAmount: ptr(money.New(10000)), MaxAmount: ptr(money.New(100000))},
+			stored: stored,
+		},
+		{
+			name:        "Narrowing the bounds below the amount",
+			req:         allowanceLimitRequest{Amount: money.New(65000), MaxAmount: ptr(money.New(60000))},
+			stored:      stored,
+			expectedErr: "amount must be between 50000 and 60000",
+		},
+		{
+			name:        "Minimum below the registry",
+			req:         allowanceLimitRequest{Amount: money.New(60000), MinAmount: ptr(money.New(0))},
+			expectedErr: "minAmount must be between 10000 and 100000",
+		},
+		{
+			name:        "Maximum above the registry",
+			req:         allowanceLimitRequest{Amount: money.New(60000), MaxAmount: ptr(money.New(1000000))},
+			expectedErr: "maxAmount must be between 10000 and 100000",
+		},
+		{
+			name:        "Minimum above maximum",
+			req:         allowanceLimitRequest{Amount: money.New(60000), MinAmount: ptr(money.New(80000)), MaxAmount: ptr(money.New(40000))},
+			expectedErr: "minAmount must not be greater than maxAmount",
+		},
+		{
+			name:        "New minimum above the stored maximum",
+			req:         allowanceLimitRequest{Amount: money.New(60000), MinAmount: ptr(money.New(80000))},
+			stored:      stored,
+			expectedErr: "minAmount must not be greater than maxAmount",
+		},
+		{
+			name:        "Multiplier is not configurable",
+			req:         allowanceLimitRequest{Amount: money.New(60000), Multiplier: ptr(2 * 100 * money.Percent)},
+			expectedErr: "multiplier is not configurable for personal",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateAllowanceLimit(&tc.req, personal, tc.stored)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("Expected error %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestUpdateDeduction(t *testing.T) {
+	now := time.Now()
+	stored := deductionRow{Version: 1, Amount: money.New(60000), MinAmount: ptr(money.New(50000)), MaxAmount: ptr(money.New(70000)),
+		EffectiveFrom: now.Add(-time.Hour), CreatedAt: now.Add(-time.Hour)}
+	pending := proposal{ID: 1, Kind: ProposalUpdate, AllowanceType: "personal", TaxYear: 2567, Payload: []byte("{}"),
+		Status: ProposalPending, ProposedBy: "alice", ProposedAt: now, ExpiresAt: now.Add(time.Hour), BaseVersion: ptr(1)}
+
+	testCases := []struct {
+		name           string
+		allowanceType  string
+		body           string
+		ifMatch        string
+		expectedStatus int
+	}{
+		{
+			name:           "Unknown allowance type",
+			allowanceType:  "unknown",
+			body:           `{"taxYear": 2567, "amount": 60000.0}`,
+			ifMatch:        `"1"`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Amount outside the stored bounds",
+			allowanceType:  "personal",
+			body:           `{"taxYear": 2567, "amount": 90000.0, "minAmount": 10000.0, "maxAmount": 100000.0}`,
+			ifMatch:        `"1"`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Bounds outside the registry",
+			allowanceType:  "personal",
+			body:           `{"taxYear": 2567, "amount": 60000.0, "maxAmount": 1000000.0}`,
+			ifMatch:        `"1"`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Valid change is proposed",
+			allowanceType:  "personal",
+			body:           `{"taxYear": 2567, "amount": 65000.0}`,
+			ifMatch:        `"1"`,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "Change starting in the future",
+			allowanceType:  "personal",
+			body:           `{"taxYear": 2567, "amount": 65000.0, "effectiveFrom": "2999-01-01T00:00:00Z"}`,
+			ifMatch:        `"1"`,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "Change starting in the past",
+			allowanceType:  "personal",
+			body:           `{"taxYear": 2567, "amount": 65000.0, "effectiveFrom": "2020-01-01T00:00:00Z"}`,
+			ifMatch:        `"1"`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, _ := fakedb.Open(
+				fakedb.Rule{Match: "effective_from <= $3", Rows: [][]driver.Value{deductionValues(stored)}},
+				fakedb.Rule{Match: "COALESCE(MAX(version), 0)", Rows: [][]driver.Value{{int64(1)}}},
+				fakedb.Rule{Match: "INSERT INTO deduction_proposal", Rows: [][]driver.Value{proposalValues(pending)}},
+			)
+			c, rec := newContext(http.MethodPut, tc.body, "alice", "type", tc.allowanceType)
+			c.Request().Header.Set("If-Match", tc.ifMatch)
+
+			err := UpdateDeduction(db, time.Hour)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+		})
+	}
+}
+
+func TestGetDeductionHistory(t *testing.T) {
+	created := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name             string
+		allowanceType    string
+		history          []deductionRow
+		expectedStatus   int
+		expectedVersions string
+		expectedETag     string
+	}{
+		{
+			name:             "No versions",
+			allowanceType:    "personal",
+			expectedStatus:   http.StatusOK,
+			expectedVersions: "",
+			expectedETag:     `"0"`,
+		},
+		{
+			name:          "Every version newest first",
+			allowanceType: "personal",
+			history: []deductionRow{
+				{Version: 3, Deleted: true, EffectiveFrom: created.AddDate(0, 2, 0), CreatedAt: created.AddDate(0, 0, 2)},
+				{Version: 2, Amount: money.New(70000), EffectiveFrom: created.AddDate(0, 1, 0), CreatedAt: created.AddDate(0, 0, 1)},
+				{Version: 1, Amount: money.New(60000), EffectiveFrom: created, CreatedAt: created},
+			},
+			expectedStatus:   http.StatusOK,
+			expectedVersions: "3 deleted,2 70000.00,1 60000.00",
+			expectedETag:     `"3"`,
+		},
+		{
+			name:           "Unknown allowance type",
+			allowanceType:  "unknown",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rows [][]driver.Value
+			for _, row := range tc.history {
+				rows = append(rows, deductionValues(row))
+			}
+			db, _ := fakedb.Open(
+				fakedb.Rule{Match: "ORDER BY version DESC", Columns: strings.Split(deductionColumns, ", "), Rows: rows},
+			)
+			c, rec := newContext(http.MethodGet, "", "alice", "type", tc.allowanceType)
+			c.QueryParams().Set("taxYear", "2567")
+
+			err := GetDeductionHistory(db)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var resp struct {
+				History []deductionVersionResponse `json:"history"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.History == nil {
+				t.Error("Expected an empty list rather than null")
+			}
+			var versions []string
+			for _, v := range resp.History {
+				if v.Deleted {
+					versions = append(versions, fmt.Sprintf("%d deleted", v.Version))
+				} else {
+					versions = append(versions, fmt.Sprintf("%d %v", v.Version, v.Amount))
+				}
+			}
+			if got := strings.Join(versions, ","); got != tc.expectedVersions {
+				t.Errorf("Expected versions %q, got %q", tc.expectedVersions, got)
+			}
+			if got := rec.Header().Get("ETag"); got != tc.expectedETag {
+				t.Errorf("Expected ETag %s, got %s", tc.expectedETag, got)
+			}
+		})
+	}
+}
+
+func TestRollbackDeduction(t *testing.T) {
+	now := time.Now()
+	target := deductionRow{Version: 1, Amount: money.New(60000), EffectiveFrom: now.Add(-time.Hour), CreatedAt: now.Add(-time.Hour)}
+	pending := proposal{ID: 1, Kind: ProposalRollback, AllowanceType: "personal", TaxYear: 2567, Payload: []byte("{}"),
+		Status: ProposalPending, ProposedBy: "alice", ProposedAt: now, ExpiresAt: now.Add(time.Hour), BaseVersion: ptr(3)}
+
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "Rollback is proposed",
+			body:           `{"taxYear": 2567, "version": 1}`,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "Rollback starting in the future",
+			body:           `{"taxYear": 2567, "version": 1, "effectiveFrom": "2999-01-01T00:00:00Z"}`,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "Rollback starting in the past",
+			body:           `{"taxYear": 2567, "version": 1, "effectiveFrom": "2020-01-01T00:00:00Z"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown version",
+			body:           `{"taxYear": 2567, "version": 9}`,
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "version = $3", Columns: strings.Split(deductionColumns, ", "),
+					Func: func(args []driver.Value) ([][]driver.Value, error) {
+						if args[2] != int64(target.Version) {
+							return nil, nil
+						}
+						return [][]driver.Value{deductionValues(target)}, nil
+					}},
+				fakedb.Rule{Match: "COALESCE(MAX(version), 0)", Rows: [][]driver.Value{{int64(3)}}},
+				fakedb.Rule{Match: "INSERT INTO deduction_proposal", Rows: [][]driver.Value{proposalValues(pending)}},
+			)
+			c, rec := newContext(http.MethodPost, tc.body, "alice", "type", "personal")
+			c.Request().Header.Set("If-Match", `"3"`)
+
+			err := RollbackDeduction(db, time.Hour)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			if inserts := f.Calls("INSERT INTO taxdeduction"); len(inserts) != 0 {
+				t.Errorf("Expected no version before approval, got %d", len(inserts))
+			}
+		})
+	}
+}
+
+func TestApproveRollback(t *testing.T) {
+	now := time.Now()
+	target := deductionRow{Version: 1, Amount: money.New(60000), MaxAmount: ptr(money.New(80000)),
+		EffectiveFrom: now.Add(-48 * time.Hour), CreatedAt: now.Add(-48 * time.Hour)}
+	current := deductionRow{Version: 3, Amount: money.New(75000), EffectiveFrom: now.Add(-time.Hour), CreatedAt: now.Add(-time.Hour)}
+	future := time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name                  string
+		payload               string
+		expectedStatus        int
+		expectedEffectiveFrom *time.Time
+	}{
+		{
+			name:           "Rollback adds a new version",
+			payload:        `{"taxYear": 2567, "version": 1}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:                  "Rollback starting in the future",
+			payload:               `{"taxYear": 2567, "version": 1, "effectiveFrom": "2999-01-01T00:00:00Z"}`,
+			expectedStatus:        http.StatusOK,
+			expectedEffectiveFrom: &future,
+		},
+		{
+			name:           "Start passed before approval",
+			payload:        fmt.Sprintf(`{"taxYear": 2567, "version": 1, "effectiveFrom": %q}`, now.Add(-time.Minute).Format(time.RFC3339Nano)),
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Version removed before approval",
+			payload:        `{"taxYear": 2567, "version": 9}`,
+			expectedStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pending := proposal{ID: 7, Kind: ProposalRollback, AllowanceType: "personal", TaxYear: 2567, Payload: json.RawMessage(tc.payload),
+				Status: ProposalPending, ProposedBy: "alice", ProposedAt: now, ExpiresAt: now.Add(time.Hour), BaseVersion: ptr(3)}
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "decided_at = expires_at", Columns: proposalColumnNames},
+				fakedb.Rule{Match: "SELECT created_by, password_reset_by", Rows: [][]driver.Value{{"bootstrap", nil}}},
+				fakedb.Rule{Match: "FOR UPDATE", Rows: [][]driver.Value{proposalValues(pending)}},
+				fakedb.Rule{Match: "INSERT INTO taxdeduction", Rows: [][]driver.Value{{int64(4), now}}},
+				fakedb.Rule{Match: "COALESCE(MAX(version), 0)", Rows: [][]driver.Value{{int64(3)}}},
+				fakedb.Rule{Match: "version = $3", Columns: strings.Split(deductionColumns, ", "),
+					Func: func(args []driver.Value) ([][]driver.Value, error) {
+						if args[2] != int64(target.Version) {
+							return nil, nil
+						}
+						return [][]driver.Value{deductionValues(target)}, nil
+					}},
+				fakedb.Rule{Match: "effective_from <= $3", Rows: [][]driver.Value{deductionValues(current)}},
+				fakedb.Rule{Match: "RETURNING decided_at", Rows: [][]driver.Value{{now}}},
+			)
+			c, rec := newContext(http.MethodPost, "", "bob", "id", "7")
+
+			err := ApproveProposal(db)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			inserts := f.Calls("INSERT INTO taxdeduction")
+			if tc.expectedStatus != http.StatusOK {
+				if len(inserts) != 0 {
+					t.Errorf("Expected no new version, got %d", len(inserts))
+				}
+				return
+			}
+
+			if len(inserts) != 1 {
+				t.Fatalf("Expected one new version, got %d", len(inserts))
+			}
+			args := inserts[0].Args
+			if args[2] != "60000.00" || args[6] != "80000.00" || args[7] != false {
+				t.Errorf("Expected the values of version 1 to be copied, got %v", args)
+			}
+			effectiveFrom := args[8].(time.Time)
+			if tc.expectedEffectiveFrom != nil && !effectiveFrom.Equal(*tc.expectedEffectiveFrom) {
+				t.Errorf("Expected the new version to start at %v, got %v", *tc.expectedEffectiveFrom, effectiveFrom)
+			}
+			if tc.expectedEffectiveFrom == nil && effectiveFrom.Before(now) {
+				t.Errorf("Expected the new version to start on approval, got %v", effectiveFrom)
+			}
+			if actions := auditActions(f); strings.Join(actions, ",") != "deduction.rollback,proposal.approve" {
+				t.Errorf("Expected the rollback to be audited, got %v", actions)
+			}
+			audit := f.Calls("INSERT INTO audit_log")[0]
+			if !strings.Contains(string(audit.Args[4].([]byte)), `"version":3`) || !strings.Contains(string(audit.Args[5].([]byte)), `"version":4`) {
+				t.Errorf("Expected version 4 to replace version 3 in the audit entry, got %s -> %s", audit.Args[4], audit.Args[5])
+			}
+		})
+	}
+}
+
+func TestGetDeductionEffectiveDate(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	versions := []deductionRow{
+		{Version: 1, Amount: money.New(60000), EffectiveFrom: start},
+		{Version: 2, Amount: money.New(70000), EffectiveFrom: start.AddDate(0, 2, 0)},
+		// Added after version 2 but in force before it.
+		{Version: 3, Amount: money.New(65000), EffectiveFrom: start.AddDate(0, 1, 0)},
+		// Starts with version 2 and replaces it.
+		{Version: 4, Amount: money.New(80000), EffectiveFrom: start.AddDate(0, 2, 0)},
+		{Version: 5, Deleted: true, EffectiveFrom: start.AddDate(0, 4, 0)},
+	}
+	// inForce picks the version the queries select: the latest
+	// effective_from at or before asOf, then the highest version.
+	inForce := func(asOf time.Time) *deductionRow {
+		var found *deductionRow
+		for i, v := range versions {
+			if v.EffectiveFrom.After(asOf) {
+				continue
+			}
+			if found == nil || v.EffectiveFrom.After(found.EffectiveFrom) ||
+				v.EffectiveFrom.Equal(found.EffectiveFrom) && v.Version > found.Version {
+				found = &versions[i]
+			}
+		}
+		return found
+	}
+
+	testCases := []struct {
+		name            string
+		asOf            time.Time
+		expectedVersion int
+		expectedAmount  money.Money
+	}{
+		{name: "Before the first version", asOf: start.Add(-time.Second), expectedAmount: money.New(60000)},
+		{name: "First version", asOf: start.AddDate(0, 0, 10), expectedVersion: 1, expectedAmount: money.New(60000)},
+		{name: "Later version with an earlier start", asOf: start.AddDate(0, 1, 10), expectedVersion: 3, expectedAmount: money.New(65000)},
+		{name: "Same start picks the higher version", asOf: start.AddDate(0, 2, 0), expectedVersion: 4, expectedAmount: money.New(80000)},
+		{name: "Deleted falls back to the default", asOf: start.AddDate(0, 5, 0), expectedAmount: money.New(60000)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setting := personalType(t).SettingName
+			db, _ := fakedb.Open(
+				fakedb.Rule{Match: "FROM taxbracket", Columns: []string{"lower_bound", "upper_bound", "rate", "label"}},
+				fakedb.Rule{Match: "FROM taxrounding", Columns: []string{"step", "mode"}},
+				fakedb.Rule{Match: "SELECT name, amount, multiplier, income_rate FROM", Columns: []string{"name", "amount", "multiplier", "income_rate"},
+					Func: func(args []driver.Value) ([][]driver.Value, error) {
+						v := inForce(args[1].(time.Time))
+						if v == nil || v.Deleted {
+							return nil, nil
+						}
+						return [][]driver.Value{{setting, deductionValues(*v)[1], nil, nil}}, nil
+					}},
+				fakedb.Rule{Match: "effective_from <= $3", Columns: strings.Split(deductionColumns, ", "),
+					Func: func(args []driver.Value) ([][]driver.Value, error) {
+						if v := inForce(args[2].(time.Time)); v != nil {
+							return [][]driver.Value{deductionValues(*v)}, nil
+						}
+						return nil, nil
+					}},
+				fakedb.Rule{Match: "COALESCE(MAX(version), 0)", Rows: [][]driver.Value{{int64(len(versions))}}},
+			)
+			c, rec := newContext(http.MethodGet, "", "alice", "type", "personal")
+			c.QueryParams().Set("taxYear", "2567")
+			c.QueryParams().Set("asOf", tc.asOf.Format(time.RFC3339))
+
+			err := GetDeduction(db)(c)
+			if status := statusOf(err, rec); status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d (%v)", status, err)
+			}
+			var resp deductionResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Version != tc.expectedVersion || resp.Configured != (tc.expectedVersion != 0) {
+				t.Errorf("Expected version %d, got %d (configured %v)", tc.expectedVersion, resp.Version, resp.Configured)
+			}
+			if resp.Amount != tc.expectedAmount {
+				t.Errorf("Expected amount %v, got %v", tc.expectedAmount, resp.Amount)
+			}
+			if resp.ETag != etag(len(versions)) {
+				t.Errorf("Expected ETag of the latest version, got %s", resp.ETag)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/audit"
+	"github.com/Ter4798/post-test-kbtg/money"
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+)
+
+// deductionRow is one stored version of the override for an allowance type
+// and tax year. Versions are never updated; a change, a rollback or a delete
+// adds a new version that takes effect from EffectiveFrom. MinAmount and
+// MaxAmount replace the registry bounds when set.
+type deductionRow struct {
+	Version       int
+	Amount        money.Money
+	Multiplier    *money.Rate
+	IncomeRate    *money.Rate
+	MinAmount     *money.Money
+	MaxAmount     *money.Money
+	Deleted       bool
+	EffectiveFrom time.Time
+	CreatedAt     time.Time
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+const deductionColumns = "version, amount, multiplier, income_rate, min_amount, max_amount, deleted, effective_from, created_at"
+
+func (r *deductionRow) scan(s interface{ Scan(...any) error }, extra ...any) error {
+	return s.Scan(append(extra, &r.Version, &r.Amount, &r.Multiplier, &r.IncomeRate, &r.MinAmount, &r.MaxAmount, &r.Deleted, &r.EffectiveFrom, &r.CreatedAt)...)
+}
+
+func (r *deductionRow) bounds(t tax.AllowanceType) (money.Money, money.Money) {
+	min, max := t.MinLimit, t.MaxLimit
+	if r != nil && r.MinAmount != nil {
+		min = *r.MinAmount
+	}
+	if r != nil && r.MaxAmount != nil {
+		max = *r.MaxAmount
+	}
+	return min, max
+}
+
+func lookupAllowanceType(typeName string) (tax.AllowanceType, error) {
+	t, ok := tax.LookupAllowanceType(typeName)
+	if !ok {
+		return t, echo.NewHTTPError(http.StatusNotFound, "allowance type not found")
+	}
+	return t, nil
+}
+
+// bindAllowanceLimit validates the request against the version in force
+// when it takes effect. The same check is repeated on approval in case the
+// stored bounds changed in between.
+func bindAllowanceLimit(c echo.Context, db *sql.DB, typeName string) (allowanceLimitRequest, tax.AllowanceType, error) {
+	t, err := lookupAllowanceType(typeName)
+	if err != nil {
+		return allowanceLimitRequest{}, t, err
+	}
+
+	var req allowanceLimitRequest
+	if err := c.Bind(&req); err != nil {
+		return req, t, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	return req, t, checkAllowanceLimit(db, &req, t)
+}
+
+func checkAllowanceLimit(db *sql.DB, req *allowanceLimitRequest, t tax.AllowanceType) error {
+	if err := validateTaxYear(&req.TaxYear); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	now := time.Now()
+	if err := checkEffectiveFrom(req.EffectiveFrom, now); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	stored, err := getDeduction(db, t, req.TaxYear, req.effectiveFrom(now))
+	if err != nil {
+		return err
+	}
+	if err := validateAllowanceLimit(req, t, stored); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	return nil
+}
+
+func (req allowanceLimitRequest) effectiveFrom(now time.Time) time.Time {
+	if req.EffectiveFrom == nil {
+		return now
+	}
+	return *req.EffectiveFrom
+}
+
+// checkEffectiveFrom rejects a version that would take effect in the past,
+// which would change what the history says was in force.
+func checkEffectiveFrom(effectiveFrom *time.Time, now time.Time) error {
+	if effectiveFrom != nil && effectiveFrom.Before(now) {
+		return errors.New("effectiveFrom must not be in the past")
+	}
+	return nil
+}
+
+// getDeduction returns the version in force at asOf, or nil when the type
+// uses its default.
+func getDeduction(db queryRower, t tax.AllowanceType, taxYear int, asOf time.Time) (*deductionRow, error) {
+	var row deductionRow
+	err := row.scan(db.QueryRow(`SELECT `+deductionColumns+` FROM taxdeduction
+        WHERE name = $1 AND tax_year = $2 AND effective_from <= $3
+        ORDER BY effective_from DESC, version DESC LIMIT 1`, t.SettingName, taxYear, asOf))
+	if errors.Is(err, sql.ErrNoRows) || err == nil && row.Deleted {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+func getDeductionVersion(db queryRower, t tax.AllowanceType, taxYear, version int) (*deductionRow, error) {
+	var row deductionRow
+	err := row.scan(db.QueryRow(`SELECT `+deductionColumns+` FROM taxdeduction
+        WHERE name = $1 AND tax_year = $2 AND version = $3`, t.SettingName, taxYear, version))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &row, nil
+}
+
+func listDeductions(db querier, taxYear int, asOf time.Time) (map[string]deductionRow, error) {
+	rows, err := db.Query(`SELECT DISTINCT ON (name) name, `+deductionColumns+` FROM taxdeduction
+        WHERE tax_year = $1 AND effective_from <= $2
+        ORDER BY name, effective_from DESC, version DESC`, taxYear, asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deductions := make(map[string]deductionRow)
+	for rows.Next() {
+		var name string
+		var row deductionRow
+		if err := row.scan(rows, &name); err != nil {
+			return nil, err
+		}
+		if !row.Deleted {
+			deductions[name] = row
+		}
+	}
+	return deductions, rows.Err()
+}
+
+// listScheduledDeductions returns, by setting name, the versions that take
+// effect after asOf in order. Of versions starting at the same time only the
+// latest counts.
+func listScheduledDeductions(db querier, taxYear int, asOf time.Time) (map[string][]deductionRow, error) {
+	rows, err := db.Query(`SELECT DISTINCT ON (name, effective_from) name, `+deductionColumns+` FROM taxdeduction
+        WHERE tax_year = $1 AND effective_from > $2
+        ORDER BY name, effective_from, version DESC`, taxYear, asOf)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scheduled := make(map[string][]deductionRow)
+	for rows.Next() {
+		var name string
+		var row deductionRow
+		if err := row.scan(rows, &name); err != nil {
+			return nil, err
+		}
+		scheduled[name] = append(scheduled[name], row)
+	}
+	return scheduled, rows.Err()
+}
+
+func listDeductionHistory(db *sql.DB, t tax.AllowanceType, taxYear int) ([]deductionRow, error) {
+	rows, err := db.Query(`SELECT `+deductionColumns+` FROM taxdeduction
+        WHERE name = $1 AND tax_year = $2 ORDER BY version DESC`, t.SettingName, taxYear)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []deductionRow
+	for rows.Next() {
+		var row deductionRow
+		if err := row.scan(rows); err != nil {
+			return nil, err
+		}
+		history = append(history, row)
+	}
+	return history, rows.Err()
+}
+
+// insertDeductionVersion stores row as the next version for the type and
+// year and fills in the version number and creation time it was given.
+func insertDeductionVersion(db queryRower, t tax.AllowanceType, taxYear int, row *deductionRow) error {
+	return db.QueryRow(`INSERT INTO taxdeduction
+        (name, tax_year, version, amount, multiplier, income_rate, min_amount, max_amount, deleted, effective_from)
+        SELECT $1::text, $2::int, COALESCE(MAX(version), 0) + 1, $3::numeric, $4::numeric, $5::numeric, $6::numeric, $7::numeric, $8::boolean, $9::timestamptz
+        FROM taxdeduction WHERE name = $1 AND tax_year = $2
+        RETURNING version, created_at`,
+		t.SettingName, taxYear, row.Amount, row.Multiplier, row.IncomeRate, row.MinAmount, row.MaxAmount, row.Deleted, row.EffectiveFrom).Scan(&row.Version, &row.CreatedAt)
+}
+
+// applyDeductionVersion stores a new version and its audit entry inside tx.
+// The old value is the version it replaces at EffectiveFrom.
+func applyDeductionVersion(c echo.Context, tx *sql.Tx, action string, t tax.AllowanceType, taxYear int, row deductionRow) (deductionRow, error) {
+	var oldValue any
+	old, err := getDeduction(tx, t, taxYear, row.EffectiveFrom)
+	if err != nil {
+		return row, err
+	}
+	if old != nil {
+		oldValue = newDeductionVersionResponse(*old)
+	}
+
+	if err := insertDeductionVersion(tx, t, taxYear, &row); err != nil {
+		if isUniqueViolation(err) {
+			return row, echo.NewHTTPError(http.StatusPreconditionFailed, "deduction was changed by another admin")
+		}
+		return row, err
+	}
+	resourceID := fmt.Sprintf("%s/%d", t.Name, taxYear)
+	if err := audit.Record(tx, c, action, "deduction", resourceID, oldValue, newDeductionVersionResponse(row)); err != nil {
+		return row, err
+	}
+	return row, nil
+}
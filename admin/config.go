@@ -0,0 +1,632 @@
+package admin
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/audit"
+	"github.com/Ter4798/post-test-kbtg/money"
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+)
+
+// configDocument is the stored configuration of every tax year. A year
+// without brackets uses the built-in table, a step missing from Rounding
+// uses the built-in policy and a type missing from Deductions uses its
+// default, so importing a document also removes settings it does not list.
+// Deductions are the versions in force at ExportedAt and Scheduled the ones
+// that take effect after it.
+type configDocument struct {
+	ExportedAt time.Time    `json:"exportedAt"`
+	TaxYears   []configYear `json:"taxYears"`
+}
+
+// RulesVersion identifies the rules the calculator applied when the year was
+// exported. It is informational and ignored on import.
+type configYear struct {
+	TaxYear      int               `json:"taxYear"`
+	RulesVersion string            `json:"rulesVersion,omitempty"`
+	Brackets     []configBracket   `json:"brackets"`
+	Rounding     map[string]string `json:"rounding"`
+	Deductions   []configDeduction `json:"deductions"`
+	Scheduled    []configScheduled `json:"scheduled"`
+}
+
+type configBracket struct {
+	LowerBound money.Money  `json:"lowerBound"`
+	UpperBound *money.Money `json:"upperBound,omitempty"`
+	Rate       money.Rate   `json:"rate"`
+	Label      string       `json:"label"`
+}
+
+type configDeduction struct {
+	AllowanceType string       `json:"allowanceType"`
+	Amount        money.Money  `json:"amount"`
+	Multiplier    *money.Rate  `json:"multiplier,omitempty"`
+	IncomeRate    *money.Rate  `json:"incomeRate,omitempty"`
+	MinAmount     *money.Money `json:"minAmount,omitempty"`
+	MaxAmount     *money.Money `json:"maxAmount,omitempty"`
+}
+
+// configScheduled is a version that takes effect at EffectiveFrom. A deleted
+// one returns the type to its default from then on.
+type configScheduled struct {
+	configDeduction
+	Deleted       bool      `json:"deleted,omitempty"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+}
+
+// signedConfig carries the document with an HMAC-SHA256 of its compact JSON,
+// so reformatting the file does not break the signature but editing it does.
+type signedConfig struct {
+	Config    json.RawMessage `json:"config"`
+	Signature string          `json:"signature"`
+}
+
+// configChange is one difference an import applies. EffectiveFrom is set
+// for deduction versions that take effect later rather than on approval.
+type configChange struct {
+	TaxYear       int        `json:"taxYear"`
+	Setting       string     `json:"setting"`
+	Action        string     `json:"action"`
+	EffectiveFrom *time.Time `json:"effectiveFrom,omitempty"`
+	Old           any        `json:"old,omitempty"`
+	New           any        `json:"new,omitempty"`
+}
+
+const (
+	configSet     = "set"
+	configDelete  = "delete"
+	configReplace = "replace"
+
+	settingBrackets = "brackets"
+	settingRounding = "rounding"
+)
+
+// ExportConfig signs the configuration in force now with the versions
+// scheduled after it. It answers YAML when the Accept header asks for it and
+// JSON otherwise.
+func ExportConfig(db *sql.DB, key []byte) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if len(key) == 0 {
+			return errNoSigningKey
+		}
+
+		tx, err := db.BeginTx(c.Request().Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		years, err := configTaxYears(tx)
+		if err != nil {
+			return err
+		}
+		doc := configDocument{ExportedAt: time.Now().UTC(), TaxYears: []configYear{}}
+		for _, year := range years {
+			y, err := readConfigYear(tx, year, doc.ExportedAt)
+			if err != nil {
+				return err
+			}
+			doc.TaxYears = append(doc.TaxYears, y)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		for i := range doc.TaxYears {
+			rules, err := tax.LoadTaxRules(db, doc.TaxYears[i].TaxYear, doc.ExportedAt)
+			if errors.Is(err, tax.ErrUnsupportedTaxYear) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			doc.TaxYears[i].RulesVersion = rules.Version
+		}
+
+		body, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		signed := signedConfig{Config: body, Signature: signConfig(key, body)}
+		if isYAML(c.Request().Header.Get(echo.HeaderAccept)) {
+			out, err := marshalConfigYAML(signed)
+			if err != nil {
+				return err
+			}
+			return c.Blob(http.StatusOK, mimeYAML, out)
+		}
+		return c.JSON(http.StatusOK, signed)
+	}
+}
+
+// ImportConfig verifies and validates a signed document, JSON or YAML by
+// Content-Type, and lists what it would change. With dryRun=true nothing else happens; otherwise the import
+// is proposed and, once approved, applied in a single transaction.
+func ImportConfig(db *sql.DB, key []byte, expiry time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if len(key) == 0 {
+			return errNoSigningKey
+		}
+
+		signed, err := bindSignedConfig(c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		doc, err := verifyConfig(key, signed)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err := validateConfig(&doc); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		changes, err := diffConfig(db, doc, time.Now())
+		if err != nil {
+			return err
+		}
+		dryRun := c.QueryParam("dryRun") == "true"
+		if dryRun || len(changes) == 0 {
+			return c.JSON(http.StatusOK, struct {
+				DryRun  bool           `json:"dryRun"`
+				Changes []configChange `json:"changes"`
+			}{
+				DryRun:  dryRun,
+				Changes: changes,
+			})
+		}
+
+		return propose(c, db, expiry, ProposalImport, tax.AllowanceType{}, 0, nil, doc)
+	}
+}
+
+// bindSignedConfig reads a JSON document, or a YAML one when the
+// Content-Type says so.
+func bindSignedConfig(c echo.Context) (signedConfig, error) {
+	if isYAML(c.Request().Header.Get(echo.HeaderContentType)) {
+		return unmarshalConfigYAML(c.Request().Body)
+	}
+	var signed signedConfig
+	err := c.Bind(&signed)
+	return signed, err
+}
+
+var errNoSigningKey = echo.NewHTTPError(http.StatusInternalServerError, "CONFIG_SIGNING_KEY is not set")
+
+func signConfig(key, body []byte) string {
+	return hex.EncodeToString(configMAC(key, body))
+}
+
+func configMAC(key, body []byte) []byte {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, body); err != nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(compact.Bytes())
+	return mac.Sum(nil)
+}
+
+func verifyConfig(key []byte, signed signedConfig) (configDocument, error) {
+	var doc configDocument
+	if len(signed.Config) == 0 {
+		return doc, errors.New("config is required")
+	}
+	given, err := hex.DecodeString(signed.Signature)
+	expected := configMAC(key, signed.Config)
+	if err != nil || expected == nil || !hmac.Equal(given, expected) {
+		return doc, errors.New("invalid signature")
+	}
+	if err := json.Unmarshal(signed.Config, &doc); err != nil {
+		return doc, err
+	}
+	return doc, nil
+}
+
+func validateConfig(doc *configDocument) error {
+	years := make(map[int]bool)
+	for i := range doc.TaxYears {
+		y := &doc.TaxYears[i]
+		if y.TaxYear <= 0 {
+			return errors.New("taxYear must be greater than zero")
+		}
+		if years[y.TaxYear] {
+			return fmt.Errorf("taxYear %d is listed more than once", y.TaxYear)
+		}
+		years[y.TaxYear] = true
+
+		if y.Brackets == nil {
+			y.Brackets = []configBracket{}
+		}
+		if y.Rounding == nil {
+			y.Rounding = map[string]string{}
+		}
+		if y.Deductions == nil {
+			y.Deductions = []configDeduction{}
+		}
+		if y.Scheduled == nil {
+			y.Scheduled = []configScheduled{}
+		}
+		for j := range y.Brackets {
+			if b := y.Brackets[j].UpperBound; b != nil && *b == 0 {
+				y.Brackets[j].UpperBound = nil
+			}
+		}
+		if len(y.Brackets) > 0 {
+			if err := tax.ValidateBrackets(taxBrackets(y.Brackets)); err != nil {
+				return fmt.Errorf("taxYear %d: %w", y.TaxYear, err)
+			}
+		}
+		if err := tax.ValidateRounding(y.Rounding); err != nil {
+			return fmt.Errorf("taxYear %d: rounding: %w", y.TaxYear, err)
+		}
+
+		types := make(map[string]bool)
+		for _, d := range y.Deductions {
+			t, ok := tax.LookupAllowanceType(d.AllowanceType)
+			if !ok {
+				return fmt.Errorf("taxYear %d: unknown allowance type %s", y.TaxYear, d.AllowanceType)
+			}
+			if types[t.Name] {
+				return fmt.Errorf("taxYear %d: %s is listed more than once", y.TaxYear, t.Name)
+			}
+			types[t.Name] = true
+
+			if err := validateConfigDeduction(y.TaxYear, t, d); err != nil {
+				return err
+			}
+		}
+
+		scheduled := make(map[string]bool)
+		for _, s := range y.Scheduled {
+			t, ok := tax.LookupAllowanceType(s.AllowanceType)
+			if !ok {
+				return fmt.Errorf("taxYear %d: unknown allowance type %s", y.TaxYear, s.AllowanceType)
+			}
+			if s.EffectiveFrom.IsZero() {
+				return fmt.Errorf("taxYear %d: %s: scheduled versions need effectiveFrom", y.TaxYear, t.Name)
+			}
+			key := t.Name + " " + s.EffectiveFrom.UTC().Format(time.RFC3339Nano)
+			if scheduled[key] {
+				return fmt.Errorf("taxYear %d: %s is scheduled more than once at %s", y.TaxYear, t.Name, s.EffectiveFrom.Format(time.RFC3339))
+			}
+			scheduled[key] = true
+
+			if s.Deleted {
+				continue
+			}
+			if err := validateConfigDeduction(y.TaxYear, t, s.configDeduction); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateConfigDeduction(taxYear int, t tax.AllowanceType, d configDeduction) error {
+	req := allowanceLimitRequest{
+		TaxYear:    taxYear,
+		Amount:     d.Amount,
+		Multiplier: d.Multiplier,
+		IncomeRate: d.IncomeRate,
+		MinAmount:  d.MinAmount,
+		MaxAmount:  d.MaxAmount,
+	}
+	// An import replaces the stored settings, so nothing stored counts; the
+	// document's own bounds must fit the registry.
+	if err := validateAllowanceLimit(&req, t, nil); err != nil {
+		return fmt.Errorf("taxYear %d: %s: %w", taxYear, t.Name, err)
+	}
+	return nil
+}
+
+// diffConfig compares each year in the document with what is stored at asOf.
+// Years the document does not list are left alone.
+func diffConfig(db querier, doc configDocument, asOf time.Time) ([]configChange, error) {
+	changes := []configChange{}
+	for _, y := range doc.TaxYears {
+		current, err := readConfigYear(db, y.TaxYear, asOf)
+		if err != nil {
+			return nil, err
+		}
+
+		if !sameJSON(current.Brackets, y.Brackets) {
+			changes = append(changes, configChange{TaxYear: y.TaxYear, Setting: settingBrackets, Action: configReplace, Old: current.Brackets, New: y.Brackets})
+		}
+		if !sameJSON(current.Rounding, y.Rounding) {
+			changes = append(changes, configChange{TaxYear: y.TaxYear, Setting: settingRounding, Action: configReplace, Old: current.Rounding, New: y.Rounding})
+		}
+
+		for _, t := range tax.AllowanceTypes() {
+			changes = append(changes, deductionChanges(t, current, y, asOf)...)
+		}
+	}
+	return changes, nil
+}
+
+// deductionChanges lists the versions that make one type follow the
+// document from asOf on: one taking effect on approval when the value in
+// force differs, and a scheduled one wherever the stored schedule and the
+// document's part ways.
+func deductionChanges(t tax.AllowanceType, current, proposed configYear, asOf time.Time) []configChange {
+	var changes []configChange
+	add := func(at *time.Time, old, next *configDeduction) {
+		ch := configChange{TaxYear: proposed.TaxYear, Setting: t.Name, Action: configSet, EffectiveFrom: at}
+		if old != nil {
+			ch.Old = *old
+		}
+		if next == nil {
+			ch.Action = configDelete
+		} else {
+			ch.New = *next
+		}
+		changes = append(changes, ch)
+	}
+
+	wanted := scheduledTimeline(proposed.Scheduled, t)
+	wantedBase := findConfigDeduction(proposed.Deductions, t)
+	inForce := findConfigDeduction(current.Deductions, t)
+	if want := wanted.at(asOf, wantedBase); !sameJSON(inForce, want) {
+		add(nil, inForce, want)
+		inForce = want
+	}
+
+	stored := scheduledTimeline(current.Scheduled, t)
+	var points []time.Time
+	for _, e := range append(append(deductionTimeline(nil), stored...), wanted...) {
+		if e.from.After(asOf) {
+			points = append(points, e.from)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Before(points[j]) })
+	for i, at := range points {
+		if i > 0 && at.Equal(points[i-1]) {
+			continue
+		}
+		have, want := stored.at(at, inForce), wanted.at(at, wantedBase)
+		if !sameJSON(have, want) {
+			add(&points[i], have, want)
+			stored = stored.with(at, want)
+		}
+	}
+	return changes
+}
+
+// deductionTimeline holds the values one type takes from each point on, in
+// order, with nil for its default. Of two entries at the same time the later
+// one wins, as a later version does.
+type deductionTimeline []timedDeduction
+
+type timedDeduction struct {
+	from time.Time
+	d    *configDeduction
+}
+
+func scheduledTimeline(scheduled []configScheduled, t tax.AllowanceType) deductionTimeline {
+	var tl deductionTimeline
+	for _, s := range scheduled {
+		d := findConfigDeduction([]configDeduction{s.configDeduction}, t)
+		if d == nil {
+			continue
+		}
+		if s.Deleted {
+			d = nil
+		}
+		tl = tl.with(s.EffectiveFrom, d)
+	}
+	return tl
+}
+
+// at returns the value in force at a time, or base before the first entry.
+func (tl deductionTimeline) at(at time.Time, base *configDeduction) *configDeduction {
+	value := base
+	for _, e := range tl {
+		if !e.from.After(at) {
+			value = e.d
+		}
+	}
+	return value
+}
+
+func (tl deductionTimeline) with(from time.Time, d *configDeduction) deductionTimeline {
+	tl = append(tl, timedDeduction{from: from, d: d})
+	sort.SliceStable(tl, func(i, j int) bool { return tl[i].from.Before(tl[j].from) })
+	return tl
+}
+
+// findConfigDeduction returns the entry for t under its canonical name.
+func findConfigDeduction(deductions []configDeduction, t tax.AllowanceType) *configDeduction {
+	for _, d := range deductions {
+		if found, _ := tax.LookupAllowanceType(d.AllowanceType); found.Name == t.Name {
+			d.AllowanceType = t.Name
+			return &d
+		}
+	}
+	return nil
+}
+
+// applyConfig re-checks the document against the configuration inside tx
+// and stores every difference, each with its own audit entry.
+func applyConfig(c echo.Context, tx *sql.Tx, doc configDocument, now time.Time) error {
+	if err := validateConfig(&doc); err != nil {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	changes, err := diffConfig(tx, doc, now)
+	if err != nil {
+		return err
+	}
+
+	for _, ch := range changes {
+		if ch.Setting == settingBrackets {
+			if err := replaceBrackets(tx, ch.TaxYear, ch.New.([]configBracket)); err != nil {
+				return err
+			}
+			if err := audit.Record(tx, c, "brackets.replace", "brackets", strconv.Itoa(ch.TaxYear), ch.Old, ch.New); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if ch.Setting == settingRounding {
+			if err := replaceRounding(c, tx, "rounding.update", ch.TaxYear, ch.New.(map[string]string)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		t, _ := tax.LookupAllowanceType(ch.Setting)
+		effectiveFrom := now
+		if ch.EffectiveFrom != nil {
+			effectiveFrom = *ch.EffectiveFrom
+		}
+		if ch.Action == configDelete {
+			if _, err := applyDeductionVersion(c, tx, "deduction.delete", t, ch.TaxYear, deductionRow{Deleted: true, EffectiveFrom: effectiveFrom}); err != nil {
+				return err
+			}
+			continue
+		}
+		d := ch.New.(configDeduction)
+		row := deductionRow{
+			Amount:        d.Amount,
+			Multiplier:    d.Multiplier,
+			IncomeRate:    d.IncomeRate,
+			MinAmount:     d.MinAmount,
+			MaxAmount:     d.MaxAmount,
+			EffectiveFrom: effectiveFrom,
+		}
+		if _, err := applyDeductionVersion(c, tx, "deduction.import", t, ch.TaxYear, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// configTaxYears lists the built-in years and every year with stored
+// settings.
+func configTaxYears(db querier) ([]int, error) {
+	rows, err := db.Query("SELECT tax_year FROM taxbracket UNION SELECT tax_year FROM taxdeduction UNION SELECT tax_year FROM taxrounding")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	seen := make(map[int]bool)
+	years := tax.BuiltInTaxYears()
+	for _, year := range years {
+		seen[year] = true
+	}
+	for rows.Next() {
+		var year int
+		if err := rows.Scan(&year); err != nil {
+			return nil, err
+		}
+		if !seen[year] {
+			seen[year] = true
+			years = append(years, year)
+		}
+	}
+	sort.Ints(years)
+	return years, rows.Err()
+}
+
+// readConfigYear reads the stored settings of a year as in force at asOf,
+// with the deduction versions scheduled after it.
+func readConfigYear(db querier, taxYear int, asOf time.Time) (configYear, error) {
+	y := configYear{TaxYear: taxYear, Brackets: []configBracket{}, Deductions: []configDeduction{}, Scheduled: []configScheduled{}}
+
+	rows, err := db.Query("SELECT lower_bound, upper_bound, rate, label FROM taxbracket WHERE tax_year = $1 ORDER BY lower_bound", taxYear)
+	if err != nil {
+		return y, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b configBracket
+		if err := rows.Scan(&b.LowerBound, &b.UpperBound, &b.Rate, &b.Label); err != nil {
+			return y, err
+		}
+		y.Brackets = append(y.Brackets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return y, err
+	}
+
+	if y.Rounding, err = readRounding(db, taxYear); err != nil {
+		return y, err
+	}
+
+	stored, err := listDeductions(db, taxYear, asOf)
+	if err != nil {
+		return y, err
+	}
+	scheduled, err := listScheduledDeductions(db, taxYear, asOf)
+	if err != nil {
+		return y, err
+	}
+	for _, t := range tax.AllowanceTypes() {
+		if row, ok := stored[t.SettingName]; ok {
+			y.Deductions = append(y.Deductions, newConfigDeduction(t, row))
+		}
+		for _, row := range scheduled[t.SettingName] {
+			y.Scheduled = append(y.Scheduled, configScheduled{
+				configDeduction: newConfigDeduction(t, row),
+				Deleted:         row.Deleted,
+				EffectiveFrom:   row.EffectiveFrom.UTC(),
+			})
+		}
+	}
+	return y, nil
+}
+
+func newConfigDeduction(t tax.AllowanceType, row deductionRow) configDeduction {
+	return configDeduction{
+		AllowanceType: t.Name,
+		Amount:        row.Amount,
+		Multiplier:    row.Multiplier,
+		IncomeRate:    row.IncomeRate,
+		MinAmount:     row.MinAmount,
+		MaxAmount:     row.MaxAmount,
+	}
+}
+
+func replaceBrackets(tx *sql.Tx, taxYear int, brackets []configBracket) error {
+	if _, err := tx.Exec("DELETE FROM taxbracket WHERE tax_year = $1", taxYear); err != nil {
+		return err
+	}
+	for _, b := range brackets {
+		_, err := tx.Exec("INSERT INTO taxbracket (lower_bound, upper_bound, rate, label, tax_year) VALUES ($1, $2, $3, $4, $5)",
+			b.LowerBound, b.UpperBound, b.Rate, b.Label, taxYear)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func taxBrackets(brackets []configBracket) []tax.TaxBracket {
+	result := make([]tax.TaxBracket, 0, len(brackets))
+	for _, b := range brackets {
+		tb := tax.TaxBracket{LowerBound: b.LowerBound, Rate: b.Rate, Label: b.Label}
+		if b.UpperBound != nil {
+			tb.UpperBound = *b.UpperBound
+		}
+		result = append(result, tb)
+	}
+	return result
+}
+
+func sameJSON(a, b any) bool {
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(x, y)
+}
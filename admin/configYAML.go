@@ -0,0 +1,186 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const mimeYAML = "application/yaml"
+
+// signedConfigYAML is signedConfig written as YAML. The config is carried
+// as a YAML mapping that converts back to the exact JSON that was signed:
+// keys keep their order and numbers keep their literal form, so the same
+// signature covers both formats.
+type signedConfigYAML struct {
+	Config    yaml.Node `yaml:"config"`
+	Signature string    `yaml:"signature"`
+}
+
+// isYAML reports whether a Content-Type or Accept header asks for YAML.
+func isYAML(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case mimeYAML, "application/x-yaml", "text/yaml", "text/x-yaml":
+			return true
+		}
+	}
+	return false
+}
+
+func marshalConfigYAML(signed signedConfig) ([]byte, error) {
+	var doc signedConfigYAML
+	doc.Signature = signed.Signature
+	dec := json.NewDecoder(bytes.NewReader(signed.Config))
+	dec.UseNumber()
+	if err := jsonToYAML(dec, &doc.Config); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+func unmarshalConfigYAML(r io.Reader) (signedConfig, error) {
+	var signed signedConfig
+	var doc signedConfigYAML
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		return signed, err
+	}
+	if doc.Config.Kind == 0 {
+		return signed, nil
+	}
+	var buf bytes.Buffer
+	if err := yamlToJSON(&doc.Config, &buf); err != nil {
+		return signed, err
+	}
+	signed.Config = buf.Bytes()
+	signed.Signature = doc.Signature
+	return signed, nil
+}
+
+// jsonToYAML reads one JSON value from dec into node.
+func jsonToYAML(dec *json.Decoder, node *yaml.Node) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '{' {
+			node.Kind, node.Tag = yaml.MappingNode, "!!map"
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				var value yaml.Node
+				if err := jsonToYAML(dec, &value); err != nil {
+					return err
+				}
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key.(string)}, &value)
+			}
+		} else {
+			node.Kind, node.Tag = yaml.SequenceNode, "!!seq"
+			for dec.More() {
+				var value yaml.Node
+				if err := jsonToYAML(dec, &value); err != nil {
+					return err
+				}
+				node.Content = append(node.Content, &value)
+			}
+		}
+		_, err := dec.Token() // closing delimiter
+		return err
+	case json.Number:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!float", v.String()
+		if !strings.ContainsAny(node.Value, ".eE") {
+			node.Tag = "!!int"
+		}
+	case string:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!str", v
+	case bool:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!bool", "false"
+		if v {
+			node.Value = "true"
+		}
+	case nil:
+		node.Kind, node.Tag, node.Value = yaml.ScalarNode, "!!null", "null"
+	}
+	return nil
+}
+
+// yamlToJSON writes node as compact JSON. Numbers are copied as written and
+// must also be valid JSON numbers. Aliases are rejected: an export never
+// writes them, and expanding them before the signature is checked would let
+// a small document grow without bound.
+func yamlToJSON(node *yaml.Node, buf *bytes.Buffer) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) != 1 {
+			return errors.New("config must be a single YAML document")
+		}
+		return yamlToJSON(node.Content[0], buf)
+	case yaml.AliasNode:
+		return errors.New("config must not use YAML aliases")
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := json.Marshal(node.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			if err := yamlToJSON(node.Content[i+1], buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, value := range node.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := yamlToJSON(value, buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		switch node.ShortTag() {
+		case "!!null":
+			buf.WriteString("null")
+		case "!!bool":
+			var b bool
+			if err := node.Decode(&b); err != nil {
+				return err
+			}
+			value, _ := json.Marshal(b)
+			buf.Write(value)
+		case "!!int", "!!float":
+			if !json.Valid([]byte(node.Value)) {
+				return errors.New("invalid number " + node.Value)
+			}
+			buf.WriteString(node.Value)
+		default:
+			value, err := json.Marshal(node.Value)
+			if err != nil {
+				return err
+			}
+			buf.Write(value)
+		}
+	}
+	return nil
+}
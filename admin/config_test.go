@@ -0,0 +1,521 @@
+package admin
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+	"github.com/Ter4798/post-test-kbtg/money"
+	"github.com/labstack/echo/v4"
+)
+
+var configKey = []byte("staging-and-production")
+
+func testConfig(t *testing.T) signedConfig {
+	t.Helper()
+	doc := configDocument{
+		ExportedAt: time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC),
+		TaxYears: []configYear{{
+			TaxYear:  2567,
+			Brackets: []configBracket{},
+			Deductions: []configDeduction{
+				{AllowanceType: "personal", Amount: money.New(70000), MaxAmount: ptr(money.New(90000))},
+				{AllowanceType: "k-receipt", Amount: money.New(50000)},
+			},
+		}},
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signedConfig{Config: body, Signature: signConfig(configKey, body)}
+}
+
+func TestVerifyConfig(t *testing.T) {
+	signed := testConfig(t)
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, signed.Config, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	otherSignature := signConfig([]byte("another key"), signed.Config)
+
+	testCases := []struct {
+		name        string
+		key         []byte
+		signed      signedConfig
+		expectedErr string
+	}{
+		{
+			name:   "Signed document",
+			key:    configKey,
+			signed: signed,
+		},
+		{
+			name:   "Reformatted document",
+			key:    configKey,
+			signed: signedConfig{Config: indented.Bytes(), Signature: signed.Signature},
+		},
+		{
+			name:        "Tampered config",
+			key:         configKey,
+			signed:      signedConfig{Config: bytes.Replace(signed.Config, []byte("70000"), []byte("99000"), 1), Signature: signed.Signature},
+			expectedErr: "invalid signature",
+		},
+		{
+			name:        "Tampered signature",
+			key:         configKey,
+			signed:      signedConfig{Config: signed.Config, Signature: strings.Repeat("0", len(signed.Signature))},
+			expectedErr: "invalid signature",
+		},
+		{
+			name:        "Signature that is not hex",
+			key:         configKey,
+			signed:      signedConfig{Config: signed.Config, Signature: "not hex"},
+			expectedErr: "invalid signature",
+		},
+		{
+			name:        "Signed with another key",
+			key:         configKey,
+			signed:      signedConfig{Config: signed.Config, Signature: otherSignature},
+			expectedErr: "invalid signature",
+		},
+		{
+			name:        "Verified with another key",
+			key:         []byte("another key"),
+			signed:      signed,
+			expectedErr: "invalid signature",
+		},
+		{
+			name:        "Missing config",
+			key:         configKey,
+			signed:      signedConfig{Signature: signed.Signature},
+			expectedErr: "config is required",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			doc, err := verifyConfig(tc.key, tc.signed)
+			if tc.expectedErr != "" {
+				if err == nil || err.Error() != tc.expectedErr {
+					t.Errorf("Expected error %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(doc.TaxYears) != 1 || len(doc.TaxYears[0].Deductions) != 2 {
+				t.Errorf("Expected the signed document, got %+v", doc)
+			}
+		})
+	}
+}
+
+func TestConfigYAML(t *testing.T) {
+	signed := testConfig(t)
+	out, err := marshalConfigYAML(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name        string
+		yaml        string
+		expectedErr string
+	}{
+		{
+			name: "Exported document",
+			yaml: string(out),
+		},
+		{
+			name:        "Aliases",
+			yaml:        "config:\n  a: &a [1, 1, 1]\n  b: &b [*a, *a, *a]\n  c: [*b, *b, *b]\nsignature: \"00\"\n",
+			expectedErr: "config must not use YAML aliases",
+		},
+		{
+			name:        "Edited amount",
+			yaml:        strings.Replace(string(out), "70000", "99000", 1),
+			expectedErr: "invalid signature",
+		},
+		{
+			name:        "Edited signature",
+			yaml:        strings.Replace(string(out), signed.Signature, strings.Repeat("0", len(signed.Signature)), 1),
+			expectedErr: "invalid signature",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			parsed, err := unmarshalConfigYAML(strings.NewReader(tc.yaml))
+			if err == nil {
+				_, err = verifyConfig(configKey, parsed)
+			}
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("Expected error %q, got %v", tc.expectedErr, err)
+			}
+			if tc.expectedErr == "" && !bytes.Equal(parsed.Config, signed.Config) {
+				t.Errorf("Expected config %s, got %s", signed.Config, parsed.Config)
+			}
+		})
+	}
+}
+
+func TestIsYAML(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected bool
+	}{
+		{header: "", expected: false},
+		{header: "application/json", expected: false},
+		{header: "application/yaml", expected: true},
+		{header: "application/x-yaml; charset=utf-8", expected: true},
+		{header: "application/json, text/yaml;q=0.5", expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.header, func(t *testing.T) {
+			if got := isYAML(tc.header); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	testCases := []struct {
+		name        string
+		deductions  []configDeduction
+		expectedErr string
+	}{
+		{
+			name:       "Within the registry bounds",
+			deductions: []configDeduction{{AllowanceType: "personal", Amount: money.New(70000), MaxAmount: ptr(money.New(90000))}},
+		},
+		{
+			name:        "Bounds wider than the registry",
+			deductions:  []configDeduction{{AllowanceType: "personal", Amount: money.New(500000), MaxAmount: ptr(money.New(1000000))}},
+			expectedErr: "taxYear 2567: personal: maxAmount must be between 10000 and 100000",
+		},
+		{
+			name:        "Amount above the registry",
+			deductions:  []configDeduction{{AllowanceType: "personal", Amount: money.New(500000)}},
+			expectedErr: "taxYear 2567: personal: amount must be between 10000 and 100000",
+		},
+		{
+			name:        "Amount outside the document bounds",
+			deductions:  []configDeduction{{AllowanceType: "personal", Amount: money.New(95000), MaxAmount: ptr(money.New(90000))}},
+			expectedErr: "taxYear 2567: personal: amount must be between 10000 and 90000",
+		},
+		{
+			name: "Type listed twice",
+			deductions: []configDeduction{
+				{AllowanceType: "personal", Amount: money.New(70000)},
+				{AllowanceType: "personal", Amount: money.New(60000)},
+			},
+			expectedErr: "taxYear 2567: personal is listed more than once",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			doc := configDocument{TaxYears: []configYear{{TaxYear: 2567, Deductions: tc.deductions}}}
+			err := validateConfig(&doc)
+			if tc.expectedErr == "" && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if tc.expectedErr != "" && (err == nil || err.Error() != tc.expectedErr) {
+				t.Errorf("Expected error %q, got %v", tc.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestImportConfigDryRun(t *testing.T) {
+	signed := testConfig(t)
+	jsonBody, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yamlBody, err := marshalConfigYAML(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	stored := func(name string, amount money.Money) []driver.Value {
+		return append([]driver.Value{name}, deductionValues(deductionRow{Version: 1, Amount: amount, EffectiveFrom: now, CreatedAt: now})...)
+	}
+
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "JSON",
+			contentType: echo.MIMEApplicationJSON,
+			body:        string(jsonBody),
+		},
+		{
+			name:        "YAML",
+			contentType: mimeYAML,
+			body:        string(yamlBody),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "FROM taxbracket WHERE tax_year", Columns: []string{"lower_bound", "upper_bound", "rate", "label"}},
+				fakedb.Rule{Match: "FROM taxrounding", Columns: []string{"step", "mode"}},
+				fakedb.Rule{Match: "DISTINCT ON (name, effective_from)", Columns: append([]string{"name"}, strings.Split(deductionColumns, ", ")...)},
+				fakedb.Rule{Match: "DISTINCT ON (name)", Rows: [][]driver.Value{
+					stored("personalAllowance", money.New(60000)),
+					stored("kReceiptAllowance", money.New(50000)),
+					stored("donationAllowance", money.New(80000)),
+				}},
+			)
+			c, rec := newContext(http.MethodPost, tc.body, "alice")
+			c.Request().Header.Set(echo.HeaderContentType, tc.contentType)
+			c.QueryParams().Set("dryRun", "true")
+
+			err := ImportConfig(db, configKey, time.Hour)(c)
+			if status := statusOf(err, rec); status != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d (%v)", status, err)
+			}
+			if calls := f.Calls("INSERT INTO"); len(calls) != 0 {
+				t.Errorf("Expected a dry run to write nothing, got %d writes", len(calls))
+			}
+
+			var resp struct {
+				DryRun  bool           `json:"dryRun"`
+				Changes []configChange `json:"changes"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, ch := range resp.Changes {
+				got = append(got, ch.Setting+" "+ch.Action)
+			}
+			expected := "personal set,donation delete"
+			if !resp.DryRun || strings.Join(got, ",") != expected {
+				t.Errorf("Expected dry run changes %s, got %v", expected, got)
+			}
+		})
+	}
+}
+
+// configStore keeps the tables a configuration export reads and an import
+// writes, answering the queries the way PostgreSQL would.
+type configStore struct {
+	rounding   map[int64]map[string]string
+	deductions []storedDeduction
+}
+
+type storedDeduction struct {
+	name   string
+	year   int64
+	values []driver.Value // deductionColumns
+}
+
+func (s *storedDeduction) version() int64           { return s.values[0].(int64) }
+func (s *storedDeduction) effectiveFrom() time.Time { return s.values[7].(time.Time) }
+
+// latest returns the highest version per name and per key among the
+// deductions of a year that match.
+func (s *configStore) latest(year driver.Value, match func(storedDeduction) bool, key func(storedDeduction) string) [][]driver.Value {
+	found := make(map[string]storedDeduction)
+	var keys []string
+	for _, d := range s.deductions {
+		if d.year != year || !match(d) {
+			continue
+		}
+		k := key(d)
+		prev, ok := found[k]
+		if !ok {
+			keys = append(keys, k)
+		}
+		if !ok || d.effectiveFrom().After(prev.effectiveFrom()) ||
+			d.effectiveFrom().Equal(prev.effectiveFrom()) && d.version() > prev.version() {
+			found[k] = d
+		}
+	}
+	sort.Strings(keys)
+	var rows [][]driver.Value
+	for _, k := range keys {
+		rows = append(rows, append([]driver.Value{found[k].name}, found[k].values...))
+	}
+	return rows
+}
+
+func openConfigStore(s *configStore) (*sql.DB, *fakedb.DB) {
+	deductionNames := append([]string{"name"}, strings.Split(deductionColumns, ", ")...)
+	byName := func(d storedDeduction) string { return d.name }
+	inForce := func(asOf driver.Value) func(storedDeduction) bool {
+		return func(d storedDeduction) bool { return !d.effectiveFrom().After(asOf.(time.Time)) }
+	}
+	return fakedb.Open(
+		fakedb.Rule{Match: "UNION SELECT tax_year", Columns: []string{"tax_year"}, Rows: [][]driver.Value{{int64(2567)}}},
+		fakedb.Rule{Match: "FROM taxbracket", Columns: []string{"lower_bound", "upper_bound", "rate", "label"}},
+		fakedb.Rule{Match: "DELETE FROM taxrounding", Func: func(args []driver.Value) ([][]driver.Value, error) {
+			delete(s.rounding, args[0].(int64))
+			return nil, nil
+		}},
+		fakedb.Rule{Match: "INSERT INTO taxrounding", Func: func(args []driver.Value) ([][]driver.Value, error) {
+			if s.rounding[args[0].(int64)] == nil {
+				s.rounding[args[0].(int64)] = map[string]string{}
+			}
+			s.rounding[args[0].(int64)][args[1].(string)] = args[2].(string)
+			return nil, nil
+		}},
+		fakedb.Rule{Match: "SELECT step, mode FROM taxrounding", Columns: []string{"step", "mode"},
+			Func: func(args []driver.Value) ([][]driver.Value, error) {
+				var rows [][]driver.Value
+				for step, mode := range s.rounding[args[0].(int64)] {
+					rows = append(rows, []driver.Value{step, mode})
+				}
+				return rows, nil
+			}},
+		fakedb.Rule{Match: "INSERT INTO taxdeduction", Func: func(args []driver.Value) ([][]driver.Value, error) {
+			version := int64(1)
+			for _, d := range s.deductions {
+				if d.name == args[0] && d.year == args[1] && d.version() >= version {
+					version = d.version() + 1
+				}
+			}
+			now := time.Now()
+			s.deductions = append(s.deductions, storedDeduction{name: args[0].(string), year: args[1].(int64),
+				values: []driver.Value{version, args[2], args[3], args[4], args[5], args[6], args[7], args[8], now}})
+			return [][]driver.Value{{version, now}}, nil
+		}},
+		fakedb.Rule{Match: "SELECT name, amount, multiplier, income_rate FROM", Columns: []string{"name", "amount", "multiplier", "income_rate"},
+			Func: func(args []driver.Value) ([][]driver.Value, error) {
+				var rows [][]driver.Value
+				for _, row := range s.latest(args[0], inForce(args[1]), byName) {
+					if row[7] != true {
+						rows = append(rows, []driver.Value{row[0], row[2], row[3], row[4]})
+					}
+				}
+				return rows, nil
+			}},
+		fakedb.Rule{Match: "DISTINCT ON (name, effective_from)", Columns: deductionNames,
+			Func: func(args []driver.Value) ([][]driver.Value, error) {
+				after := func(d storedDeduction) bool { return d.effectiveFrom().After(args[1].(time.Time)) }
+				return s.latest(args[0], after, func(d storedDeduction) string {
+					return d.name + " " + d.effectiveFrom().UTC().Format(time.RFC3339Nano)
+				}), nil
+			}},
+		fakedb.Rule{Match: "DISTINCT ON (name)", Columns: deductionNames,
+			Func: func(args []driver.Value) ([][]driver.Value, error) {
+				return s.latest(args[0], inForce(args[1]), byName), nil
+			}},
+		fakedb.Rule{Match: "effective_from <= $3", Columns: strings.Split(deductionColumns, ", "),
+			Func: func(args []driver.Value) ([][]driver.Value, error) {
+				named := func(d storedDeduction) bool { return d.name == args[0] && inForce(args[2])(d) }
+				var rows [][]driver.Value
+				for _, row := range s.latest(args[1], named, byName) {
+					rows = append(rows, row[1:])
+				}
+				return rows, nil
+			}},
+	)
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	now := time.Now()
+	day := func(n int) time.Time { return now.AddDate(0, 0, n).UTC().Truncate(time.Second) }
+	stored := func(name string, version int64, amount driver.Value, deleted bool, effectiveFrom time.Time) storedDeduction {
+		return storedDeduction{name: name, year: 2567,
+			values: []driver.Value{version, amount, nil, nil, nil, nil, deleted, effectiveFrom, effectiveFrom}}
+	}
+
+	source := &configStore{
+		rounding: map[int64]map[string]string{2567: {"taxLevel": "halfEven"}},
+		deductions: []storedDeduction{
+			stored("personalAllowance", 1, "70000.00", false, day(-30)),
+			stored("kReceiptAllowance", 1, "50000.00", false, day(-30)),
+			stored("kReceiptAllowance", 2, "40000.00", false, day(10)),
+			stored("personalAllowance", 2, "0.00", true, day(20)),
+			stored("personalAllowance", 3, "80000.00", false, day(30)),
+		},
+	}
+	target := &configStore{
+		rounding: map[int64]map[string]string{2567: {"incomeCap": "up"}},
+		deductions: []storedDeduction{
+			stored("personalAllowance", 1, "60000.00", false, day(-30)),
+			stored("donationAllowance", 1, "80000.00", false, day(-30)),
+			// Scheduled only in the target, so the import has to undo it.
+			stored("kReceiptAllowance", 1, "45000.00", false, day(15)),
+		},
+	}
+
+	sourceDB, _ := openConfigStore(source)
+	c, rec := newContext(http.MethodGet, "", "alice")
+	if err := ExportConfig(sourceDB, configKey)(c); err != nil {
+		t.Fatal(err)
+	}
+	var signed signedConfig
+	if err := json.Unmarshal(rec.Body.Bytes(), &signed); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := verifyConfig(configKey, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(&doc); err != nil {
+		t.Fatal(err)
+	}
+	var exported configYear
+	for _, y := range doc.TaxYears {
+		if y.TaxYear == 2567 {
+			exported = y
+		}
+	}
+	if exported.Rounding["taxLevel"] != "halfEven" || len(exported.Scheduled) != 3 {
+		t.Fatalf("Expected the rounding and 3 scheduled versions to be exported, got %+v", exported)
+	}
+
+	targetDB, f := openConfigStore(target)
+	tx, err := targetDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ = newContext(http.MethodPost, "", "bob")
+	if err := applyConfig(c, tx, doc, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Calls("INSERT INTO taxdeduction")) == 0 {
+		t.Fatal("Expected the import to add versions")
+	}
+
+	if changes, err := diffConfig(targetDB, doc, time.Now()); err != nil || len(changes) != 0 {
+		t.Errorf("Expected the target to match the document, got %+v, %v", changes, err)
+	}
+	for _, probe := range []time.Time{time.Now(), day(12), day(17), day(25), day(40)} {
+		want, err := readConfigYear(sourceDB, 2567, probe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readConfigYear(targetDB, 2567, probe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameJSON(got.Rounding, want.Rounding) || !sameJSON(got.Deductions, want.Deductions) {
+			t.Errorf("Expected rounding %v and deductions %+v at %v, got %v and %+v", want.Rounding, want.Deductions, probe, got.Rounding, got.Deductions)
+		}
+	}
+}
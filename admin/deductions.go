@@ -0,0 +1,254 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+)
+
+func ListDeductions(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		taxYear, asOf, err := bindDeductionQuery(c)
+		if err != nil {
+			return err
+		}
+
+		rules, err := loadTaxRules(db, taxYear, asOf)
+		if err != nil {
+			return err
+		}
+		stored, err := listDeductions(db, taxYear, asOf)
+		if err != nil {
+			return err
+		}
+		versions, err := listLatestVersions(db, taxYear)
+		if err != nil {
+			return err
+		}
+
+		var resp []deductionResponse
+		for _, t := range tax.AllowanceTypes() {
+			var row *deductionRow
+			if r, ok := stored[t.SettingName]; ok {
+				row = &r
+			}
+			resp = append(resp, newDeductionResponse(t, rules, row, versions[t.SettingName]))
+		}
+
+		return c.JSON(http.StatusOK, struct {
+			Deductions []deductionResponse `json:"deductions"`
+		}{
+			Deductions: resp,
+		})
+	}
+}
+
+func GetDeduction(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		t, err := lookupAllowanceType(c.Param("type"))
+		if err != nil {
+			return err
+		}
+		taxYear, asOf, err := bindDeductionQuery(c)
+		if err != nil {
+			return err
+		}
+
+		return respondWithDeduction(c, db, t, taxYear, asOf)
+	}
+}
+
+// UpdateDeduction, DeleteDeduction and RollbackDeduction only propose the
+// change; it takes effect once another admin approves it.
+func UpdateDeduction(db *sql.DB, expiry time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req, t, err := bindAllowanceLimit(c, db, c.Param("type"))
+		if err != nil {
+			return err
+		}
+		version, err := checkIfMatch(c, db, t, req.TaxYear)
+		if err != nil {
+			return err
+		}
+
+		return propose(c, db, expiry, ProposalUpdate, t, req.TaxYear, &version, req)
+	}
+}
+
+func DeleteDeduction(db *sql.DB, expiry time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		t, err := lookupAllowanceType(c.Param("type"))
+		if err != nil {
+			return err
+		}
+		taxYear, err := parseTaxYear(c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		stored, err := getDeduction(db, t, taxYear, time.Now())
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "deduction is not configured")
+		}
+		version, err := checkIfMatch(c, db, t, taxYear)
+		if err != nil {
+			return err
+		}
+
+		return propose(c, db, expiry, ProposalDelete, t, taxYear, &version, struct {
+			TaxYear int `json:"taxYear"`
+		}{
+			TaxYear: taxYear,
+		})
+	}
+}
+
+func GetDeductionHistory(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		t, err := lookupAllowanceType(c.Param("type"))
+		if err != nil {
+			return err
+		}
+		taxYear, err := parseTaxYear(c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		history, err := listDeductionHistory(db, t, taxYear)
+		if err != nil {
+			return err
+		}
+
+		resp := make([]deductionVersionResponse, 0, len(history))
+		for _, row := range history {
+			resp = append(resp, newDeductionVersionResponse(row))
+		}
+		version := 0
+		if len(history) > 0 {
+			version = history[0].Version
+		}
+		c.Response().Header().Set("ETag", etag(version))
+		return c.JSON(http.StatusOK, struct {
+			History []deductionVersionResponse `json:"history"`
+		}{
+			History: resp,
+		})
+	}
+}
+
+// RollbackDeduction proposes copying an earlier version into a new one, so
+// the history keeps both the change and the rollback.
+func RollbackDeduction(db *sql.DB, expiry time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		t, err := lookupAllowanceType(c.Param("type"))
+		if err != nil {
+			return err
+		}
+
+		var req rollbackRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if err := validateTaxYear(&req.TaxYear); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if err := checkEffectiveFrom(req.EffectiveFrom, time.Now()); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		target, err := getDeductionVersion(db, t, req.TaxYear, req.Version)
+		if err != nil {
+			return err
+		}
+		if target == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "version not found")
+		}
+		version, err := checkIfMatch(c, db, t, req.TaxYear)
+		if err != nil {
+			return err
+		}
+
+		return propose(c, db, expiry, ProposalRollback, t, req.TaxYear, &version, req)
+	}
+}
+
+func bindDeductionQuery(c echo.Context) (int, time.Time, error) {
+	taxYear, err := parseTaxYear(c)
+	if err != nil {
+		return 0, time.Time{}, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	asOf, err := parseAsOf(c)
+	if err != nil {
+		return 0, time.Time{}, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	return taxYear, asOf, nil
+}
+
+func respondWithDeduction(c echo.Context, db *sql.DB, t tax.AllowanceType, taxYear int, asOf time.Time) error {
+	rules, err := loadTaxRules(db, taxYear, asOf)
+	if err != nil {
+		return err
+	}
+	stored, err := getDeduction(db, t, taxYear, asOf)
+	if err != nil {
+		return err
+	}
+	version, err := latestDeductionVersion(db, t, taxYear)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("ETag", etag(version))
+	return c.JSON(http.StatusOK, newDeductionResponse(t, rules, stored, version))
+}
+
+func loadTaxRules(db *sql.DB, taxYear int, asOf time.Time) (tax.TaxRules, error) {
+	rules, err := tax.LoadTaxRules(db, taxYear, asOf)
+	if errors.Is(err, tax.ErrUnsupportedTaxYear) {
+		return rules, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	return rules, err
+}
+
+func newDeductionResponse(t tax.AllowanceType, rules tax.TaxRules, stored *deductionRow, latestVersion int) deductionResponse {
+	min, max := stored.bounds(t)
+	resp := deductionResponse{
+		TaxYear:       rules.TaxYear,
+		AllowanceType: t.Name,
+		Amount:        rules.Limit(t),
+		Multiplier:    rules.Multiplier(t),
+		MinAmount:     min,
+		MaxAmount:     max,
+		Configured:    stored != nil,
+		ETag:          etag(latestVersion),
+	}
+	if rate := rules.IncomeRate(t); rate != 0 {
+		resp.IncomeRate = &rate
+	}
+	if stored != nil {
+		resp.Version = stored.Version
+		resp.EffectiveFrom = &stored.EffectiveFrom
+	}
+	return resp
+}
+
+func newDeductionVersionResponse(row deductionRow) deductionVersionResponse {
+	return deductionVersionResponse{
+		Version:       row.Version,
+		Amount:        row.Amount,
+		Multiplier:    row.Multiplier,
+		IncomeRate:    row.IncomeRate,
+		MinAmount:     row.MinAmount,
+		MaxAmount:     row.MaxAmount,
+		Deleted:       row.Deleted,
+		EffectiveFrom: row.EffectiveFrom,
+		CreatedAt:     row.CreatedAt,
+	}
+}
@@ -0,0 +1,83 @@
+package admin
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// The ETag of a deduction is its latest stored version for the tax year, or
+// 0 when it has never been configured. Future-dated versions count, so a
+// change scheduled by someone else still conflicts.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+func latestDeductionVersion(db queryRower, t tax.AllowanceType, taxYear int) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM taxdeduction WHERE name = $1 AND tax_year = $2",
+		t.SettingName, taxYear).Scan(&version)
+	return version, err
+}
+
+func listLatestVersions(db *sql.DB, taxYear int) (map[string]int, error) {
+	rows, err := db.Query("SELECT name, MAX(version) FROM taxdeduction WHERE tax_year = $1 GROUP BY name", taxYear)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[string]int)
+	for rows.Next() {
+		var name string
+		var version int
+		if err := rows.Scan(&name, &version); err != nil {
+			return nil, err
+		}
+		versions[name] = version
+	}
+	return versions, rows.Err()
+}
+
+// checkIfMatch compares the If-Match header with the current version and
+// answers 412 when it is stale. Every write to a deduction requires the
+// header and answers 428 without it, so no route skips the check. "*"
+// matches any version; weak tags never match, as If-Match uses strong
+// comparison.
+func checkIfMatch(c echo.Context, db queryRower, t tax.AllowanceType, taxYear int) (int, error) {
+	header := c.Request().Header.Get("If-Match")
+	if header == "" {
+		return 0, echo.NewHTTPError(http.StatusPreconditionRequired, "If-Match header is required")
+	}
+
+	version, err := latestDeductionVersion(db, t, taxYear)
+	if err != nil {
+		return 0, err
+	}
+	if strings.TrimSpace(header) == "*" {
+		return version, nil
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == etag(version) {
+			return version, nil
+		}
+	}
+	return 0, errVersionConflict(version)
+}
+
+func errVersionConflict(version int) error {
+	return echo.NewHTTPError(http.StatusPreconditionFailed, "deduction has changed, current ETag is "+etag(version))
+}
+
+// isUniqueViolation reports whether err is a unique constraint failure, which
+// is how the database rejects two writers claiming the same version.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
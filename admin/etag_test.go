@@ -0,0 +1,208 @@
+package admin
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+	"github.com/Ter4798/post-test-kbtg/money"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+func TestCheckIfMatch(t *testing.T) {
+	personal := personalType(t)
+	testCases := []struct {
+		name            string
+		method          string
+		ifMatch         string
+		expectedStatus  int
+		expectedVersion int
+	}{
+		{
+			name:           "PUT without If-Match",
+			method:         http.MethodPut,
+			expectedStatus: http.StatusPreconditionRequired,
+		},
+		{
+			name:           "Legacy POST without If-Match",
+			method:         http.MethodPost,
+			expectedStatus: http.StatusPreconditionRequired,
+		},
+		{
+			name:           "DELETE without If-Match",
+			method:         http.MethodDelete,
+			expectedStatus: http.StatusPreconditionRequired,
+		},
+		{
+			name:            "Current ETag on DELETE",
+			method:          http.MethodDelete,
+			ifMatch:         `"3"`,
+			expectedVersion: 3,
+		},
+		{
+			name:           "Stale ETag",
+			method:         http.MethodPut,
+			ifMatch:        `"2"`,
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "Stale ETag on legacy POST",
+			method:         http.MethodPost,
+			ifMatch:        `"2"`,
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:            "Current ETag",
+			method:          http.MethodPut,
+			ifMatch:         `"3"`,
+			expectedVersion: 3,
+		},
+		{
+			name:            "Current ETag in a list",
+			method:          http.MethodPut,
+			ifMatch:         `"2", "3"`,
+			expectedVersion: 3,
+		},
+		{
+			name:            "Any version",
+			method:          http.MethodPut,
+			ifMatch:         "*",
+			expectedVersion: 3,
+		},
+		{
+			name:           "Weak ETag does not match",
+			method:         http.MethodPut,
+			ifMatch:        `W/"3"`,
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, _ := fakedb.Open(fakedb.Rule{Match: "COALESCE(MAX(version), 0)", Rows: [][]driver.Value{{int64(3)}}})
+			c, rec := newContext(tc.method, "", "alice")
+			if tc.ifMatch != "" {
+				c.Request().Header.Set("If-Match", tc.ifMatch)
+			}
+
+			version, err := checkIfMatch(c, db, personal, 2567)
+			if tc.expectedStatus != 0 {
+				if status := statusOf(err, rec); status != tc.expectedStatus {
+					t.Errorf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if version != tc.expectedVersion {
+				t.Errorf("Expected version %d, got %d", tc.expectedVersion, version)
+			}
+		})
+	}
+}
+
+func TestDeductionWritesRequireIfMatch(t *testing.T) {
+	now := time.Now()
+	stored := deductionRow{Version: 3, Amount: money.New(60000), EffectiveFrom: now.Add(-time.Hour), CreatedAt: now.Add(-time.Hour)}
+	pending := proposal{ID: 1, Kind: ProposalUpdate, AllowanceType: "personal", TaxYear: 2567, Payload: []byte("{}"),
+		Status: ProposalPending, ProposedBy: "alice", ProposedAt: now, ExpiresAt: now.Add(time.Hour), BaseVersion: ptr(3)}
+
+	testCases := []struct {
+		name    string
+		method  string
+		handler func(db *sql.DB, expiry time.Duration) echo.HandlerFunc
+		body    string
+	}{
+		{name: "PUT", method: http.MethodPut, handler: UpdateDeduction, body: `{"taxYear": 2567, "amount": 65000.0}`},
+		{name: "Legacy POST", method: http.MethodPost, handler: UpdateDeduction, body: `{"taxYear": 2567, "amount": 65000.0}`},
+		{name: "DELETE", method: http.MethodDelete, handler: DeleteDeduction},
+		{name: "Rollback", method: http.MethodPost, handler: RollbackDeduction, body: `{"taxYear": 2567, "version": 3}`},
+	}
+
+	for _, tc := range testCases {
+		for _, ifMatch := range []string{"", `"3"`} {
+			t.Run(tc.name+" "+ifMatch, func(t *testing.T) {
+				db, f := fakedb.Open(
+					fakedb.Rule{Match: "effective_from <= $3", Rows: [][]driver.Value{deductionValues(stored)}},
+					fakedb.Rule{Match: "version = $3", Rows: [][]driver.Value{deductionValues(stored)}},
+					fakedb.Rule{Match: "COALESCE(MAX(version), 0)", Rows: [][]driver.Value{{int64(3)}}},
+					fakedb.Rule{Match: "INSERT INTO deduction_proposal", Rows: [][]driver.Value{proposalValues(pending)}},
+				)
+				c, rec := newContext(tc.method, tc.body, "alice", "type", "personal")
+				c.QueryParams().Set("taxYear", "2567")
+				if ifMatch != "" {
+					c.Request().Header.Set("If-Match", ifMatch)
+				}
+
+				expected := http.StatusAccepted
+				if ifMatch == "" {
+					expected = http.StatusPreconditionRequired
+				}
+				err := tc.handler(db, time.Hour)(c)
+				if status := statusOf(err, rec); status != expected {
+					t.Fatalf("Expected status %d, got %d (%v)", expected, status, err)
+				}
+				if proposals := f.Calls("INSERT INTO deduction_proposal"); (len(proposals) == 1) != (expected == http.StatusAccepted) {
+					t.Errorf("Expected a proposal only with If-Match, got %d", len(proposals))
+				}
+			})
+		}
+	}
+}
+
+func TestApplyDeductionVersion(t *testing.T) {
+	personal := personalType(t)
+	errDatabase := errors.New("connection reset")
+	testCases := []struct {
+		name           string
+		insertErr      error
+		expectedStatus int
+	}{
+		{
+			name:           "Version stored",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Another admin stored the same version",
+			insertErr:      &pq.Error{Code: "23505"},
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "Other database errors are not conflicts",
+			insertErr:      errDatabase,
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, _ := fakedb.Open(
+				fakedb.Rule{Match: "INSERT INTO taxdeduction", Rows: [][]driver.Value{{int64(2), time.Now()}}, Err: tc.insertErr},
+				fakedb.Rule{Match: "effective_from <= $3", Columns: []string{"version"}},
+			)
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			c, rec := newContext(http.MethodPost, "", "bob")
+
+			row, err := applyDeductionVersion(c, tx, "deduction.update", personal, 2567, deductionRow{Amount: money.New(70000), EffectiveFrom: time.Now()})
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			if tc.insertErr == nil && row.Version != 2 {
+				t.Errorf("Expected version 2, got %d", row.Version)
+			}
+			if tc.insertErr == errDatabase && !errors.Is(err, errDatabase) {
+				t.Errorf("Expected %v, got %v", errDatabase, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/Ter4798/post-test-kbtg/audit"
+	"github.com/Ter4798/post-test-kbtg/auth"
+	"github.com/labstack/echo/v4"
+)
+
+// RotateSigningKey starts signing tokens with a new key. Tokens signed with
+// the key it replaces stay valid until they expire.
+func RotateSigningKey(db *sql.DB, keys *auth.KeySet) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		kid, err := keys.Rotate()
+		if err != nil {
+			return err
+		}
+		if err := audit.Record(db, c, "key.rotate", "signing_key", kid, nil, nil); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, struct {
+			Keys []auth.JWK `json:"keys"`
+		}{
+			Keys: keys.JWKS(),
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+)
+
+type previewResponse struct {
+	AllowanceType string    `json:"allowanceType"`
+	TaxYear       int       `json:"taxYear"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+	Source        string    `json:"source"`
+	tax.Impact
+}
+
+// PreviewDeduction shows how a deduction change would move the tax of the
+// stored sample population, or of an uploaded taxes.csv, without proposing
+// or saving it. A JSON body is the change itself; a multipart body carries
+// the change as JSON in the change field and the population in taxFile.
+func PreviewDeduction(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		t, err := lookupAllowanceType(c.Param("type"))
+		if err != nil {
+			return err
+		}
+
+		var req allowanceLimitRequest
+		var reqs []tax.Request
+		source := "samples"
+		if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+			if err := json.Unmarshal([]byte(c.FormValue("change")), &req); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid change: "+err.Error())
+			}
+			if reqs, err = readTaxFile(c); err != nil {
+				return err
+			}
+			source = "upload"
+		} else {
+			if err := c.Bind(&req); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err)
+			}
+			if reqs, err = listSamples(db); err != nil {
+				return err
+			}
+		}
+		if err := checkAllowanceLimit(db, &req, t); err != nil {
+			return err
+		}
+		if len(reqs) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "no taxpayers to preview against")
+		}
+
+		effectiveFrom := req.effectiveFrom(time.Now())
+		impact, err := tax.PreviewImpact(c.Request().Context(), db, reqs, req.TaxYear, effectiveFrom, tax.Override{
+			AllowanceType: t.Name,
+			Limit:         req.Amount,
+			Multiplier:    req.Multiplier,
+			IncomeRate:    req.IncomeRate,
+		})
+		if errors.Is(err, tax.ErrUnsupportedTaxYear) {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, previewResponse{
+			AllowanceType: t.Name,
+			TaxYear:       req.TaxYear,
+			EffectiveFrom: effectiveFrom,
+			Source:        source,
+			Impact:        impact,
+		})
+	}
+}
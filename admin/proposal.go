@@ -0,0 +1,457 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/audit"
+	"github.com/Ter4798/post-test-kbtg/auth"
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	ProposalUpdate   = "update"
+	ProposalDelete   = "delete"
+	ProposalRollback = "rollback"
+	ProposalImport   = "import"
+	ProposalRounding = "rounding"
+
+	ProposalCreateUser    = "create-user"
+	ProposalResetPassword = "reset-password"
+	ProposalEnableUser    = "enable-user"
+
+	ProposalPending  = "pending"
+	ProposalApproved = "approved"
+	ProposalRejected = "rejected"
+	ProposalExpired  = "expired"
+
+	// SystemActor decides proposals that expire.
+	SystemActor = "system"
+)
+
+// proposal is a change waiting for a second admin. Payload holds the
+// original request body for the kind of change, except that password
+// hashes are kept in proposal_password.
+type proposal struct {
+	ID             int64           `json:"id"`
+	Kind           string          `json:"kind"`
+	AllowanceType  string          `json:"allowanceType,omitempty"`
+	TaxYear        int             `json:"taxYear,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	ProposedBy     string          `json:"proposedBy"`
+	ProposedAt     time.Time       `json:"proposedAt"`
+	ExpiresAt      time.Time       `json:"expiresAt"`
+	DecidedBy      *string         `json:"decidedBy,omitempty"`
+	DecidedAt      *time.Time      `json:"decidedAt,omitempty"`
+	Reason         *string         `json:"reason,omitempty"`
+	BaseVersion    *int            `json:"baseVersion,omitempty"`
+	AppliedVersion *int            `json:"appliedVersion,omitempty"`
+}
+
+const proposalColumns = "id, kind, allowance_type, tax_year, payload, status, proposed_by, proposed_at, expires_at, decided_by, decided_at, reason, base_version, applied_version"
+
+func (p *proposal) scan(s interface{ Scan(...any) error }) error {
+	return s.Scan(&p.ID, &p.Kind, &p.AllowanceType, &p.TaxYear, &p.Payload, &p.Status, &p.ProposedBy, &p.ProposedAt, &p.ExpiresAt,
+		&p.DecidedBy, &p.DecidedAt, &p.Reason, &p.BaseVersion, &p.AppliedVersion)
+}
+
+type rejectRequest struct {
+	Reason string `json:"reason"`
+}
+
+// propose stores a pending change and answers 202 with it. baseVersion is
+// the version the proposer saw; approval fails if it is no longer current.
+// An import spans every setting, so it has no type, year or base version;
+// a rounding change has a year but no type.
+func propose(c echo.Context, db *sql.DB, expiry time.Duration, kind string, t tax.AllowanceType, taxYear int, baseVersion *int, payload any) error {
+	tx, err := db.BeginTx(c.Request().Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p, err := insertProposal(c, tx, expiry, kind, t, taxYear, baseVersion, payload)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, p)
+}
+
+func insertProposal(c echo.Context, tx *sql.Tx, expiry time.Duration, kind string, t tax.AllowanceType, taxYear int, baseVersion *int, payload any) (proposal, error) {
+	var p proposal
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return p, err
+	}
+
+	err = p.scan(tx.QueryRow(`INSERT INTO deduction_proposal (kind, allowance_type, tax_year, payload, status, proposed_by, expires_at, base_version)
+        VALUES ($1, $2, $3, $4, $5, $6, now() + make_interval(secs => $7), $8)
+        RETURNING `+proposalColumns,
+		kind, t.Name, taxYear, body, ProposalPending, auth.User(c), expiry.Seconds(), baseVersion))
+	if err != nil {
+		return p, err
+	}
+	return p, audit.Record(tx, c, "proposal.create", "proposal", strconv.FormatInt(p.ID, 10), nil, p)
+}
+
+func ListProposals(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := expireProposals(c, db); err != nil {
+			return err
+		}
+
+		query := "SELECT " + proposalColumns + " FROM deduction_proposal"
+		var args []any
+		if status := c.QueryParam("status"); status != "" {
+			query += " WHERE status = $1"
+			args = append(args, status)
+		}
+		rows, err := db.Query(query+" ORDER BY id DESC", args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		proposals := []proposal{}
+		for rows.Next() {
+			var p proposal
+			if err := p.scan(rows); err != nil {
+				return err
+			}
+			proposals = append(proposals, p)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, struct {
+			Proposals []proposal `json:"proposals"`
+		}{
+			Proposals: proposals,
+		})
+	}
+}
+
+func GetProposal(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if err := expireProposals(c, db); err != nil {
+			return err
+		}
+
+		id, err := proposalID(c)
+		if err != nil {
+			return err
+		}
+		var p proposal
+		err = p.scan(db.QueryRow("SELECT "+proposalColumns+" FROM deduction_proposal WHERE id = $1", id))
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "proposal not found")
+		}
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, p)
+	}
+}
+
+// ApproveProposal applies a pending change. The approver must be a
+// different admin from the one who proposed it, and not one whose account
+// the proposer created or whose password the proposer reset.
+func ApproveProposal(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return decideProposal(c, db, func(tx *sql.Tx, p *proposal) error {
+			if p.ProposedBy == auth.User(c) {
+				return echo.NewHTTPError(http.StatusForbidden, "proposal must be approved by a different admin")
+			}
+			if err := checkApprover(tx, auth.User(c), p.ProposedBy); err != nil {
+				return err
+			}
+
+			row, err := applyProposal(c, tx, *p)
+			if err != nil {
+				return err
+			}
+			p.Status = ProposalApproved
+			if row.Version != 0 {
+				p.AppliedVersion = &row.Version
+			}
+			return nil
+		})
+	}
+}
+
+// RejectProposal closes a pending change without applying it. The proposer
+// may reject their own proposal to withdraw it.
+func RejectProposal(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req rejectRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if req.Reason == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "reason is required")
+		}
+
+		return decideProposal(c, db, func(tx *sql.Tx, p *proposal) error {
+			p.Status = ProposalRejected
+			p.Reason = &req.Reason
+			return nil
+		})
+	}
+}
+
+// decideProposal locks a pending proposal, lets decide change it and stores
+// the decision with its audit entry in the same transaction.
+func decideProposal(c echo.Context, db *sql.DB, decide func(tx *sql.Tx, p *proposal) error) error {
+	if err := expireProposals(c, db); err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(c.Request().Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id, err := proposalID(c)
+	if err != nil {
+		return err
+	}
+	var p proposal
+	err = p.scan(tx.QueryRow("SELECT "+proposalColumns+" FROM deduction_proposal WHERE id = $1 FOR UPDATE", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "proposal not found")
+	}
+	if err != nil {
+		return err
+	}
+	if p.Status == ProposalPending && !p.ExpiresAt.After(time.Now()) {
+		p.Status = ProposalExpired
+	}
+	if p.Status != ProposalPending {
+		return echo.NewHTTPError(http.StatusConflict, "proposal is "+p.Status)
+	}
+
+	old := p
+	if err := decide(tx, &p); err != nil {
+		return err
+	}
+
+	user := auth.User(c)
+	err = tx.QueryRow(`UPDATE deduction_proposal SET status = $1, decided_by = $2, decided_at = now(), reason = $3, applied_version = $4
+        WHERE id = $5 RETURNING decided_at`,
+		p.Status, user, p.Reason, p.AppliedVersion, p.ID).Scan(&p.DecidedAt)
+	if err != nil {
+		return err
+	}
+	p.DecidedBy = &user
+	if err := deleteProposalPassword(tx, p); err != nil {
+		return err
+	}
+
+	action := "proposal.approve"
+	if p.Status == ProposalRejected {
+		action = "proposal.reject"
+	}
+	if err := audit.Record(tx, c, action, "proposal", strconv.FormatInt(p.ID, 10), old, p); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, p)
+}
+
+// applyProposal re-checks the change against the current configuration and
+// stores it as a new version. A change proposed without effectiveFrom takes
+// effect when it is approved; one whose effectiveFrom has passed by then is a
+// conflict, as is another change applied since the proposal was made.
+func applyProposal(c echo.Context, tx *sql.Tx, p proposal) (deductionRow, error) {
+	now := time.Now()
+	if p.Kind == ProposalImport {
+		var doc configDocument
+		if err := json.Unmarshal(p.Payload, &doc); err != nil {
+			return deductionRow{}, err
+		}
+		return deductionRow{}, applyConfig(c, tx, doc, now)
+	}
+
+	if p.Kind == ProposalRounding {
+		var req roundingRequest
+		if err := json.Unmarshal(p.Payload, &req); err != nil {
+			return deductionRow{}, err
+		}
+		if err := validateRounding(&req); err != nil {
+			return deductionRow{}, echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		return deductionRow{}, replaceRounding(c, tx, "rounding.update", p.TaxYear, req.Steps)
+	}
+
+	if p.Kind == ProposalCreateUser || p.Kind == ProposalResetPassword || p.Kind == ProposalEnableUser {
+		return deductionRow{}, applyUserProposal(c, tx, p)
+	}
+
+	t, err := lookupAllowanceType(p.AllowanceType)
+	if err != nil {
+		return deductionRow{}, err
+	}
+
+	if p.BaseVersion != nil {
+		version, err := latestDeductionVersion(tx, t, p.TaxYear)
+		if err != nil {
+			return deductionRow{}, err
+		}
+		if version != *p.BaseVersion {
+			return deductionRow{}, errVersionConflict(version)
+		}
+	}
+
+	switch p.Kind {
+	case ProposalUpdate:
+		var req allowanceLimitRequest
+		if err := json.Unmarshal(p.Payload, &req); err != nil {
+			return deductionRow{}, err
+		}
+		if err := checkEffectiveFrom(req.EffectiveFrom, now); err != nil {
+			return deductionRow{}, echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		effectiveFrom := req.effectiveFrom(now)
+		stored, err := getDeduction(tx, t, p.TaxYear, effectiveFrom)
+		if err != nil {
+			return deductionRow{}, err
+		}
+		if err := validateAllowanceLimit(&req, t, stored); err != nil {
+			return deductionRow{}, echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		row := deductionRow{
+			Amount:        req.Amount,
+			Multiplier:    req.Multiplier,
+			IncomeRate:    req.IncomeRate,
+			MinAmount:     req.MinAmount,
+			MaxAmount:     req.MaxAmount,
+			EffectiveFrom: effectiveFrom,
+		}
+		if stored != nil && row.MinAmount == nil {
+			row.MinAmount = stored.MinAmount
+		}
+		if stored != nil && row.MaxAmount == nil {
+			row.MaxAmount = stored.MaxAmount
+		}
+		return applyDeductionVersion(c, tx, "deduction.update", t, p.TaxYear, row)
+
+	case ProposalDelete:
+		stored, err := getDeduction(tx, t, p.TaxYear, now)
+		if err != nil {
+			return deductionRow{}, err
+		}
+		if stored == nil {
+			return deductionRow{}, echo.NewHTTPError(http.StatusConflict, "deduction is not configured")
+		}
+		return applyDeductionVersion(c, tx, "deduction.delete", t, p.TaxYear, deductionRow{Deleted: true, EffectiveFrom: now})
+
+	case ProposalRollback:
+		var req rollbackRequest
+		if err := json.Unmarshal(p.Payload, &req); err != nil {
+			return deductionRow{}, err
+		}
+		if err := checkEffectiveFrom(req.EffectiveFrom, now); err != nil {
+			return deductionRow{}, echo.NewHTTPError(http.StatusConflict, err.Error())
+		}
+		target, err := getDeductionVersion(tx, t, p.TaxYear, req.Version)
+		if err != nil {
+			return deductionRow{}, err
+		}
+		if target == nil {
+			return deductionRow{}, echo.NewHTTPError(http.StatusConflict, "version not found")
+		}
+		target.EffectiveFrom = now
+		if req.EffectiveFrom != nil {
+			target.EffectiveFrom = *req.EffectiveFrom
+		}
+		return applyDeductionVersion(c, tx, "deduction.rollback", t, p.TaxYear, *target)
+	}
+
+	return deductionRow{}, fmt.Errorf("admin: unknown proposal kind %q", p.Kind)
+}
+
+func proposalID(c echo.Context) (int64, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusNotFound, "proposal not found")
+	}
+	return id, nil
+}
+
+// expireProposals closes pending proposals whose window has passed. Each
+// one is decided at its expiry time by SystemActor and audited like any
+// other decision.
+func expireProposals(c echo.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(c.Request().Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`UPDATE deduction_proposal SET status = $1, decided_by = $2, decided_at = expires_at
+        WHERE status = $3 AND expires_at <= now() RETURNING `+proposalColumns, ProposalExpired, SystemActor, ProposalPending)
+	if err != nil {
+		return err
+	}
+	var expired []proposal
+	for rows.Next() {
+		var p proposal
+		if err := p.scan(rows); err != nil {
+			rows.Close()
+			return err
+		}
+		expired = append(expired, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range expired {
+		old := p
+		old.Status, old.DecidedBy, old.DecidedAt = ProposalPending, nil, nil
+		if err := audit.RecordAs(tx, c, SystemActor, "proposal.expire", "proposal", strconv.FormatInt(p.ID, 10), old, p); err != nil {
+			return err
+		}
+		if err := deleteProposalPassword(tx, p); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// checkApprover rejects an approver whose account the proposer created or
+// whose password the proposer last reset, since the proposer may know that
+// password.
+func checkApprover(db queryRower, approver, proposer string) error {
+	var createdBy string
+	var resetBy *string
+	err := db.QueryRow("SELECT created_by, password_reset_by FROM admin_user WHERE username = $1", approver).Scan(&createdBy, &resetBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusForbidden, "approver is not an admin user")
+	}
+	if err != nil {
+		return err
+	}
+	if createdBy == proposer || resetBy != nil && *resetBy == proposer {
+		return echo.NewHTTPError(http.StatusForbidden, "proposal must be approved by an admin the proposer did not create or reset")
+	}
+	return nil
+}
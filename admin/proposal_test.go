@@ -0,0 +1,222 @@
+package admin
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+	"github.com/labstack/echo/v4"
+)
+
+var proposalColumnNames = strings.Split(proposalColumns, ", ")
+
+// auditActions lists the actions recorded so far, in order.
+func auditActions(f *fakedb.DB) []string {
+	var actions []string
+	for _, call := range f.Calls("INSERT INTO audit_log") {
+		actions = append(actions, call.Args[1].(string))
+	}
+	return actions
+}
+
+func TestDecideProposal(t *testing.T) {
+	now := time.Now()
+	pending := proposal{ID: 7, Kind: ProposalUpdate, AllowanceType: "personal", TaxYear: 2567,
+		Payload: json.RawMessage(`{"taxYear": 2567, "amount": "70000.00"}`), Status: ProposalPending,
+		ProposedBy: "alice", ProposedAt: now.Add(-time.Hour), ExpiresAt: now.Add(time.Hour), BaseVersion: ptr(1)}
+	expired := pending
+	expired.ExpiresAt = now.Add(-time.Minute)
+	rejected := pending
+	rejected.Status = ProposalRejected
+	started := pending
+	started.Payload = json.RawMessage(fmt.Sprintf(`{"taxYear": 2567, "amount": "70000.00", "effectiveFrom": %q}`,
+		now.Add(-time.Minute).Format(time.RFC3339Nano)))
+
+	testCases := []struct {
+		name            string
+		handler         func(db *sql.DB) echo.HandlerFunc
+		user            string
+		body            string
+		proposal        *proposal
+		latestVersion   int64
+		approver        []driver.Value
+		expectedStatus  int
+		expectedActions []string
+	}{
+		{
+			name:            "Approved by a second admin",
+			handler:         ApproveProposal,
+			user:            "bob",
+			proposal:        &pending,
+			latestVersion:   1,
+			expectedStatus:  http.StatusOK,
+			expectedActions: []string{"deduction.update", "proposal.approve"},
+		},
+		{
+			name:           "Proposer cannot approve their own proposal",
+			handler:        ApproveProposal,
+			user:           "alice",
+			proposal:       &pending,
+			latestVersion:  1,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Approver account created by the proposer",
+			handler:        ApproveProposal,
+			user:           "bob",
+			proposal:       &pending,
+			latestVersion:  1,
+			approver:       []driver.Value{"alice", nil},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "Approver password reset by the proposer",
+			handler:        ApproveProposal,
+			user:           "bob",
+			proposal:       &pending,
+			latestVersion:  1,
+			approver:       []driver.Value{"bootstrap", "alice"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:            "Approver password reset by someone else",
+			handler:         ApproveProposal,
+			user:            "bob",
+			proposal:        &pending,
+			latestVersion:   1,
+			approver:        []driver.Value{"carol", "carol"},
+			expectedStatus:  http.StatusOK,
+			expectedActions: []string{"deduction.update", "proposal.approve"},
+		},
+		{
+			name:           "Another change was applied since the proposal",
+			handler:        ApproveProposal,
+			user:           "bob",
+			proposal:       &pending,
+			latestVersion:  2,
+			expectedStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:           "Start passed before approval",
+			handler:        ApproveProposal,
+			user:           "bob",
+			proposal:       &started,
+			latestVersion:  1,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Expired proposal cannot be approved",
+			handler:        ApproveProposal,
+			user:           "bob",
+			proposal:       &expired,
+			latestVersion:  1,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Decided proposal cannot be approved",
+			handler:        ApproveProposal,
+			user:           "bob",
+			proposal:       &rejected,
+			latestVersion:  1,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Unknown proposal",
+			handler:        ApproveProposal,
+			user:           "bob",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Reject without a reason",
+			handler:        RejectProposal,
+			user:           "bob",
+			body:           `{}`,
+			proposal:       &pending,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:            "Proposer withdraws their own proposal",
+			handler:         RejectProposal,
+			user:            "alice",
+			body:            `{"reason": "typo"}`,
+			proposal:        &pending,
+			expectedStatus:  http.StatusOK,
+			expectedActions: []string{"proposal.reject"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var proposalRows [][]driver.Value
+			if tc.proposal != nil {
+				proposalRows = [][]driver.Value{proposalValues(*tc.proposal)}
+			}
+			approver := tc.approver
+			if approver == nil {
+				approver = []driver.Value{"bootstrap", nil}
+			}
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "decided_at = expires_at", Columns: proposalColumnNames},
+				fakedb.Rule{Match: "SELECT created_by, password_reset_by", Rows: [][]driver.Value{approver}},
+				fakedb.Rule{Match: "FOR UPDATE", Columns: proposalColumnNames, Rows: proposalRows},
+				fakedb.Rule{Match: "INSERT INTO taxdeduction", Rows: [][]driver.Value{{tc.latestVersion + 1, now}}},
+				fakedb.Rule{Match: "COALESCE(MAX(version), 0)", Rows: [][]driver.Value{{tc.latestVersion}}},
+				fakedb.Rule{Match: "effective_from <= $3", Columns: strings.Split(deductionColumns, ", ")},
+				fakedb.Rule{Match: "RETURNING decided_at", Rows: [][]driver.Value{{now}}},
+			)
+			c, rec := newContext(http.MethodPost, tc.body, tc.user, "id", "7")
+
+			err := tc.handler(db)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			if actions := auditActions(f); strings.Join(actions, ",") != strings.Join(tc.expectedActions, ",") {
+				t.Errorf("Expected audit actions %v, got %v", tc.expectedActions, actions)
+			}
+		})
+	}
+}
+
+func TestExpireProposals(t *testing.T) {
+	now := time.Now()
+	expired := proposal{ID: 3, Kind: ProposalDelete, AllowanceType: "personal", TaxYear: 2567, Payload: json.RawMessage(`{}`),
+		Status: ProposalExpired, ProposedBy: "alice", ProposedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour),
+		DecidedBy: ptr(SystemActor), DecidedAt: ptr(now.Add(-time.Hour))}
+
+	db, f := fakedb.Open(
+		fakedb.Rule{Match: "decided_at = expires_at", Columns: proposalColumnNames, Rows: [][]driver.Value{proposalValues(expired)}},
+	)
+	c, _ := newContext(http.MethodGet, "", "bob")
+
+	if err := expireProposals(c, db); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := f.Calls("INSERT INTO audit_log")
+	if len(calls) != 1 {
+		t.Fatalf("Expected 1 audit entry, got %d", len(calls))
+	}
+	args := calls[0].Args
+	if args[0] != SystemActor || args[1] != "proposal.expire" || args[3] != "3" {
+		t.Errorf("Expected proposal.expire of 3 by %s, got %v of %v by %v", SystemActor, args[1], args[3], args[0])
+	}
+	var old, new proposal
+	if err := json.Unmarshal(args[4].([]byte), &old); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(args[5].([]byte), &new); err != nil {
+		t.Fatal(err)
+	}
+	if old.Status != ProposalPending || old.DecidedAt != nil {
+		t.Errorf("Expected the old value to be pending and undecided, got %s at %v", old.Status, old.DecidedAt)
+	}
+	if new.Status != ProposalExpired || new.DecidedAt == nil {
+		t.Errorf("Expected the new value to be expired with decidedAt, got %s at %v", new.Status, new.DecidedAt)
+	}
+}
@@ -0,0 +1,111 @@
+package admin
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/audit"
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+)
+
+// roundingRequest replaces the rounding steps stored for a tax year. Steps
+// it does not list use the built-in policy.
+type roundingRequest struct {
+	TaxYear int               `json:"taxYear"`
+	Steps   map[string]string `json:"steps"`
+}
+
+type roundingResponse struct {
+	TaxYear    int               `json:"taxYear"`
+	Steps      map[string]string `json:"steps"`
+	Configured map[string]string `json:"configured"`
+}
+
+func GetRounding(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		taxYear, err := parseTaxYear(c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		rules, err := loadTaxRules(db, taxYear, time.Now())
+		if err != nil {
+			return err
+		}
+		stored, err := readRounding(db, taxYear)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, roundingResponse{
+			TaxYear:    taxYear,
+			Steps:      rules.Rounding.Steps(),
+			Configured: stored,
+		})
+	}
+}
+
+// UpdateRounding proposes the change; it takes effect once another admin
+// approves it.
+func UpdateRounding(db *sql.DB, expiry time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req roundingRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if err := validateRounding(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		return propose(c, db, expiry, ProposalRounding, tax.AllowanceType{}, req.TaxYear, nil, req)
+	}
+}
+
+func validateRounding(req *roundingRequest) error {
+	if err := validateTaxYear(&req.TaxYear); err != nil {
+		return err
+	}
+	if req.Steps == nil {
+		req.Steps = map[string]string{}
+	}
+	return tax.ValidateRounding(req.Steps)
+}
+
+func readRounding(db querier, taxYear int) (map[string]string, error) {
+	rows, err := db.Query("SELECT step, mode FROM taxrounding WHERE tax_year = $1", taxYear)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := make(map[string]string)
+	for rows.Next() {
+		var step, mode string
+		if err := rows.Scan(&step, &mode); err != nil {
+			return nil, err
+		}
+		steps[step] = mode
+	}
+	return steps, rows.Err()
+}
+
+// replaceRounding stores steps as the rounding of a tax year with its audit
+// entry inside tx.
+func replaceRounding(c echo.Context, tx *sql.Tx, action string, taxYear int, steps map[string]string) error {
+	old, err := readRounding(tx, taxYear)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM taxrounding WHERE tax_year = $1", taxYear); err != nil {
+		return err
+	}
+	for step, mode := range steps {
+		if _, err := tx.Exec("INSERT INTO taxrounding (tax_year, step, mode) VALUES ($1, $2, $3)", taxYear, step, mode); err != nil {
+			return err
+		}
+	}
+	return audit.Record(tx, c, action, "rounding", strconv.Itoa(taxYear), old, steps)
+}
@@ -0,0 +1,102 @@
+package admin
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+)
+
+func TestUpdateRounding(t *testing.T) {
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "Valid steps",
+			body:           `{"taxYear": 2567, "steps": {"taxLevel": "halfEven", "incomeCap": "down"}}`,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "Back to the built-in policy",
+			body:           `{"taxYear": 2567, "steps": {}}`,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "Unknown step",
+			body:           `{"taxYear": 2567, "steps": {"total": "down"}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Unknown mode",
+			body:           `{"taxYear": 2567, "steps": {"taxLevel": "nearest"}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Negative tax year",
+			body:           `{"taxYear": -1, "steps": {}}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now := time.Now()
+			pending := proposal{ID: 5, Kind: ProposalRounding, TaxYear: 2567, Payload: json.RawMessage(tc.body), Status: ProposalPending,
+				ProposedBy: "alice", ProposedAt: now, ExpiresAt: now.Add(time.Hour)}
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "INSERT INTO deduction_proposal", Rows: [][]driver.Value{proposalValues(pending)}},
+			)
+			c, rec := newContext(http.MethodPut, tc.body, "alice")
+
+			err := UpdateRounding(db, time.Hour)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			if calls := f.Calls("taxrounding"); len(calls) != 0 {
+				t.Errorf("Expected no change before approval, got %d statements", len(calls))
+			}
+		})
+	}
+}
+
+func TestApproveRoundingProposal(t *testing.T) {
+	now := time.Now()
+	pending := proposal{ID: 5, Kind: ProposalRounding, TaxYear: 2567,
+		Payload: json.RawMessage(`{"taxYear": 2567, "steps": {"taxLevel": "halfEven"}}`), Status: ProposalPending,
+		ProposedBy: "alice", ProposedAt: now, ExpiresAt: now.Add(time.Hour)}
+
+	db, f := fakedb.Open(
+		fakedb.Rule{Match: "decided_at = expires_at", Columns: proposalColumnNames},
+		fakedb.Rule{Match: "SELECT created_by, password_reset_by", Rows: [][]driver.Value{{"bootstrap", nil}}},
+		fakedb.Rule{Match: "FOR UPDATE", Rows: [][]driver.Value{proposalValues(pending)}},
+		fakedb.Rule{Match: "SELECT step, mode FROM taxrounding", Rows: [][]driver.Value{{"incomeCap", "up"}}},
+		fakedb.Rule{Match: "RETURNING decided_at", Rows: [][]driver.Value{{now}}},
+	)
+	c, rec := newContext(http.MethodPost, "", "bob", "id", "5")
+
+	err := ApproveProposal(db)(c)
+	if status := statusOf(err, rec); status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d (%v)", status, err)
+	}
+	if calls := f.Calls("DELETE FROM taxrounding"); len(calls) != 1 || calls[0].Args[0] != int64(2567) {
+		t.Errorf("Expected the stored steps of 2567 to be replaced, got %v", calls)
+	}
+	inserts := f.Calls("INSERT INTO taxrounding")
+	if len(inserts) != 1 || inserts[0].Args[1] != "taxLevel" || inserts[0].Args[2] != "halfEven" {
+		t.Errorf("Expected taxLevel to be stored as halfEven, got %v", inserts)
+	}
+	expected := []string{"rounding.update", "proposal.approve"}
+	if actions := auditActions(f); strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected audit actions %v, got %v", expected, actions)
+	}
+	audit := f.Calls("INSERT INTO audit_log")[0]
+	if string(audit.Args[4].([]byte)) != `{"incomeCap":"up"}` {
+		t.Errorf("Expected the old steps in the audit entry, got %s", audit.Args[4])
+	}
+}
@@ -0,0 +1,120 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Ter4798/post-test-kbtg/audit"
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+)
+
+type samplesResponse struct {
+	Rows    int           `json:"rows"`
+	Samples []tax.Request `json:"samples"`
+}
+
+func ListSamples(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		samples, err := listSamples(db)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, samplesResponse{Rows: len(samples), Samples: samples})
+	}
+}
+
+// ReplaceSamples swaps the whole sample population for the rows of an
+// uploaded taxes.csv, in the format accepted by the CSV calculation.
+func ReplaceSamples(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		samples, err := readTaxFile(c)
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.BeginTx(c.Request().Context(), nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var old int
+		if err := tx.QueryRow("SELECT count(*) FROM sample_taxpayer").Scan(&old); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM sample_taxpayer"); err != nil {
+			return err
+		}
+		for _, req := range samples {
+			body, err := json.Marshal(req)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec("INSERT INTO sample_taxpayer (request) VALUES ($1)", body); err != nil {
+				return err
+			}
+		}
+
+		type count struct {
+			Rows int `json:"rows"`
+		}
+		if err := audit.Record(tx, c, "samples.replace", "samples", "sample_taxpayer", count{old}, count{len(samples)}); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, samplesResponse{Rows: len(samples), Samples: samples})
+	}
+}
+
+// readTaxFile parses and validates the taxFile upload.
+func readTaxFile(c echo.Context) ([]tax.Request, error) {
+	file, err := c.FormFile("taxFile")
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	src, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	reqs, err := tax.ParseCsv(src, file.Filename)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	for i := range reqs {
+		if err := tax.ValidateRequest(&reqs[i]); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("row %d: %v", i+1, err))
+		}
+	}
+	return reqs, nil
+}
+
+func listSamples(db *sql.DB) ([]tax.Request, error) {
+	rows, err := db.Query("SELECT request FROM sample_taxpayer ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []tax.Request{}
+	for rows.Next() {
+		var body []byte
+		if err := rows.Scan(&body); err != nil {
+			return nil, err
+		}
+		var req tax.Request
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		samples = append(samples, req)
+	}
+	return samples, rows.Err()
+}
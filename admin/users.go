@@ -0,0 +1,357 @@
+package admin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/audit"
+	"github.com/Ter4798/post-test-kbtg/auth"
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
+)
+
+// adminUser never carries the password hash, so it is also what the audit
+// log records. PasswordResetBy is the admin whose approved reset set the
+// current password; it is cleared when the user changes it themselves.
+type adminUser struct {
+	Username        string     `json:"username"`
+	Disabled        bool       `json:"disabled"`
+	CreatedBy       string     `json:"createdBy"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+	TokensRevokedAt *time.Time `json:"tokensRevokedAt,omitempty"`
+	PasswordResetBy *string    `json:"passwordResetBy,omitempty"`
+}
+
+const adminUserColumns = "username, disabled, created_by, created_at, updated_at, tokens_revoked_at, password_reset_by"
+
+func (u *adminUser) scan(s interface{ Scan(...any) error }) error {
+	return s.Scan(&u.Username, &u.Disabled, &u.CreatedBy, &u.CreatedAt, &u.UpdatedAt, &u.TokensRevokedAt, &u.PasswordResetBy)
+}
+
+type createUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type passwordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	Password    string `json:"password"`
+}
+
+type resetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// userProposal is the payload of a create-user, reset-password or
+// enable-user proposal.
+type userProposal struct {
+	Username string `json:"username"`
+}
+
+// reservedUsernames appear as actors in the audit log and created_by without
+// being accounts.
+var reservedUsernames = map[string]bool{SystemActor: true, "bootstrap": true}
+
+func ListUsers(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		rows, err := db.Query("SELECT " + adminUserColumns + " FROM admin_user ORDER BY username")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		users := []adminUser{}
+		for rows.Next() {
+			var u adminUser
+			if err := u.scan(rows); err != nil {
+				return err
+			}
+			users = append(users, u)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, struct {
+			Users []adminUser `json:"users"`
+		}{
+			Users: users,
+		})
+	}
+}
+
+// CreateUser proposes a new admin account. It only exists once a second
+// admin approves, so no admin can create an account to approve their own
+// proposals with.
+func CreateUser(db *sql.DB, expiry time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req createUserRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if req.Username == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "username is required")
+		}
+		if reservedUsernames[req.Username] {
+			return echo.NewHTTPError(http.StatusBadRequest, "username is reserved")
+		}
+		if err := auth.ValidatePassword(req.Password); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM admin_user WHERE username = $1)", req.Username).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return echo.NewHTTPError(http.StatusConflict, "user already exists")
+		}
+
+		return proposeUser(c, db, expiry, ProposalCreateUser, req.Username, req.Password)
+	}
+}
+
+// ChangePassword rotates the caller's own password after checking the old
+// one. The old password and every token issued with it stop working at once.
+// Other admins' passwords are changed through ResetPassword.
+func ChangePassword(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := auth.User(c)
+		if c.Param("username") != user {
+			return echo.NewHTTPError(http.StatusForbidden, "you can only change your own password")
+		}
+
+		var req passwordRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if err := auth.ValidatePassword(req.Password); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		ok, err := auth.Authenticate(db, user, req.OldPassword)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, "oldPassword is incorrect")
+		}
+		hash, err := auth.HashPassword(req.Password)
+		if err != nil {
+			return err
+		}
+
+		return updateUser(c, db, "user.password", "password_hash = $2, password_reset_by = NULL, tokens_revoked_at = now()", hash)
+	}
+}
+
+// ResetPassword proposes a new password for another admin, who is recorded
+// as reset by the proposer once it is approved.
+func ResetPassword(db *sql.DB, expiry time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		username := c.Param("username")
+		if username == auth.User(c) {
+			return echo.NewHTTPError(http.StatusBadRequest, "change your own password with PUT /admin/users/:username/password")
+		}
+
+		var req resetPasswordRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if err := auth.ValidatePassword(req.Password); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM admin_user WHERE username = $1)", username).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		}
+
+		return proposeUser(c, db, expiry, ProposalResetPassword, username, req.Password)
+	}
+}
+
+// DisableUser blocks an account and its tokens without deleting it, so its
+// name stays attached to the audit log and proposals. Admins cannot disable
+// themselves.
+func DisableUser(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Param("username") == auth.User(c) {
+			return echo.NewHTTPError(http.StatusBadRequest, "you cannot disable your own account")
+		}
+		return updateUser(c, db, "user.disable", "disabled = $2, tokens_revoked_at = now()", true)
+	}
+}
+
+// EnableUser proposes re-enabling a disabled account. Like creating one, it
+// takes effect only once a second admin approves.
+func EnableUser(db *sql.DB, expiry time.Duration) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		username := c.Param("username")
+		var disabled bool
+		err := db.QueryRow("SELECT disabled FROM admin_user WHERE username = $1", username).Scan(&disabled)
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "user not found")
+		}
+		if err != nil {
+			return err
+		}
+		if !disabled {
+			return echo.NewHTTPError(http.StatusConflict, "user is not disabled")
+		}
+
+		return propose(c, db, expiry, ProposalEnableUser, tax.AllowanceType{}, 0, nil, userProposal{Username: username})
+	}
+}
+
+// RevokeTokens ends every session of a user: access and refresh tokens
+// issued before now are rejected.
+func RevokeTokens(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return updateUser(c, db, "user.revoke-tokens", "tokens_revoked_at = now()")
+	}
+}
+
+// updateUser applies set, which uses $2 onwards for args, to the user in the
+// path and records the change.
+func updateUser(c echo.Context, db *sql.DB, action, set string, args ...any) error {
+	tx, err := db.BeginTx(c.Request().Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var old adminUser
+	err = old.scan(tx.QueryRow("SELECT "+adminUserColumns+" FROM admin_user WHERE username = $1 FOR UPDATE", c.Param("username")))
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	var u adminUser
+	err = u.scan(tx.QueryRow("UPDATE admin_user SET "+set+", updated_at = now() WHERE username = $1 RETURNING "+adminUserColumns, append([]any{old.Username}, args...)...))
+	if err != nil {
+		return err
+	}
+	if err := audit.Record(tx, c, action, "user", u.Username, old, u); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, u)
+}
+
+// proposeUser stores a create-user or reset-password proposal. The password
+// hash goes to proposal_password rather than the payload, so it is not shown
+// with the proposal or copied into the audit log.
+func proposeUser(c echo.Context, db *sql.DB, expiry time.Duration, kind, username, password string) error {
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(c.Request().Context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	p, err := insertProposal(c, tx, expiry, kind, tax.AllowanceType{}, 0, nil, userProposal{Username: username})
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO proposal_password (proposal_id, password_hash) VALUES ($1, $2)", p.ID, hash); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusAccepted, p)
+}
+
+// applyUserProposal creates the account, sets its password or enables it
+// from an approved proposal. The proposer is recorded as the creator or
+// resetter, which keeps the account from approving the proposer's changes.
+func applyUserProposal(c echo.Context, tx *sql.Tx, p proposal) error {
+	var req userProposal
+	if err := json.Unmarshal(p.Payload, &req); err != nil {
+		return err
+	}
+	if p.Kind == ProposalEnableUser {
+		return enableUser(c, tx, req.Username)
+	}
+	var hash string
+	if err := tx.QueryRow("SELECT password_hash FROM proposal_password WHERE proposal_id = $1", p.ID).Scan(&hash); err != nil {
+		return err
+	}
+
+	if p.Kind == ProposalCreateUser {
+		var u adminUser
+		err := u.scan(tx.QueryRow(`INSERT INTO admin_user (username, password_hash, created_by) VALUES ($1, $2, $3)
+            ON CONFLICT (username) DO NOTHING RETURNING `+adminUserColumns, req.Username, hash, p.ProposedBy))
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusConflict, "user already exists")
+		}
+		if err != nil {
+			return err
+		}
+		return audit.Record(tx, c, "user.create", "user", u.Username, nil, u)
+	}
+
+	var old adminUser
+	err := old.scan(tx.QueryRow("SELECT "+adminUserColumns+" FROM admin_user WHERE username = $1 FOR UPDATE", req.Username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusConflict, "user not found")
+	}
+	if err != nil {
+		return err
+	}
+	var u adminUser
+	err = u.scan(tx.QueryRow(`UPDATE admin_user SET password_hash = $2, password_reset_by = $3, tokens_revoked_at = now(), updated_at = now()
+        WHERE username = $1 RETURNING `+adminUserColumns, old.Username, hash, p.ProposedBy))
+	if err != nil {
+		return err
+	}
+	return audit.Record(tx, c, "user.password", "user", u.Username, old, u)
+}
+
+func enableUser(c echo.Context, tx *sql.Tx, username string) error {
+	var old adminUser
+	err := old.scan(tx.QueryRow("SELECT "+adminUserColumns+" FROM admin_user WHERE username = $1 FOR UPDATE", username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusConflict, "user not found")
+	}
+	if err != nil {
+		return err
+	}
+	if !old.Disabled {
+		return echo.NewHTTPError(http.StatusConflict, "user is not disabled")
+	}
+	var u adminUser
+	err = u.scan(tx.QueryRow("UPDATE admin_user SET disabled = false, updated_at = now() WHERE username = $1 RETURNING "+adminUserColumns, old.Username))
+	if err != nil {
+		return err
+	}
+	return audit.Record(tx, c, "user.enable", "user", u.Username, old, u)
+}
+
+// deleteProposalPassword drops the stored hash once a user proposal is
+// decided or expires.
+func deleteProposalPassword(tx *sql.Tx, p proposal) error {
+	if p.Kind != ProposalCreateUser && p.Kind != ProposalResetPassword {
+		return nil
+	}
+	_, err := tx.Exec("DELETE FROM proposal_password WHERE proposal_id = $1", p.ID)
+	return err
+}
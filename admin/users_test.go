@@ -0,0 +1,368 @@
+package admin
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/auth"
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+	"github.com/labstack/echo/v4"
+)
+
+func adminUserValues(username, createdBy string) []driver.Value {
+	now := time.Now()
+	return []driver.Value{username, false, createdBy, now, now, nil, nil}
+}
+
+func userProposalValues(kind, username string) []driver.Value {
+	now := time.Now()
+	payload, _ := json.Marshal(userProposal{Username: username})
+	return proposalValues(proposal{ID: 9, Kind: kind, Payload: payload, Status: ProposalPending, ProposedBy: "alice",
+		ProposedAt: now, ExpiresAt: now.Add(time.Hour)})
+}
+
+func TestUserProposals(t *testing.T) {
+	testCases := []struct {
+		name           string
+		handler        func(db *sql.DB, expiry time.Duration) echo.HandlerFunc
+		param          string
+		body           string
+		exists         bool
+		expectedStatus int
+	}{
+		{
+			name:           "Create a user",
+			handler:        CreateUser,
+			body:           `{"username": "carol", "password": "correct horse"}`,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "Create a user that exists",
+			handler:        CreateUser,
+			body:           `{"username": "carol", "password": "correct horse"}`,
+			exists:         true,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Create a reserved user",
+			handler:        CreateUser,
+			body:           `{"username": "system", "password": "correct horse"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Create a user with a short password",
+			handler:        CreateUser,
+			body:           `{"username": "carol", "password": "short"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Reset another admin's password",
+			handler:        ResetPassword,
+			param:          "bob",
+			body:           `{"password": "correct horse"}`,
+			exists:         true,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "Reset an unknown admin's password",
+			handler:        ResetPassword,
+			param:          "nobody",
+			body:           `{"password": "correct horse"}`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Reset your own password",
+			handler:        ResetPassword,
+			param:          "alice",
+			body:           `{"password": "correct horse"}`,
+			exists:         true,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "SELECT EXISTS", Rows: [][]driver.Value{{tc.exists}}},
+				fakedb.Rule{Match: "INSERT INTO deduction_proposal", Rows: [][]driver.Value{userProposalValues(ProposalCreateUser, "carol")}},
+			)
+			c, rec := newContext(http.MethodPost, tc.body, "alice", "username", tc.param)
+
+			err := tc.handler(db, time.Hour)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			if tc.expectedStatus != http.StatusAccepted {
+				return
+			}
+
+			calls := f.Calls("INSERT INTO proposal_password")
+			if len(calls) != 1 {
+				t.Fatalf("Expected the password hash to be stored once, got %d", len(calls))
+			}
+			if hash := calls[0].Args[1].(string); !strings.HasPrefix(hash, "$2") {
+				t.Errorf("Expected a bcrypt hash, got %q", hash)
+			}
+			for _, call := range f.Calls("INSERT INTO") {
+				for _, arg := range call.Args {
+					if b, ok := arg.([]byte); ok && strings.Contains(string(b), "correct horse") {
+						t.Errorf("Expected the password to stay out of %q", call.Query)
+					}
+				}
+			}
+			if calls := f.Calls("INSERT INTO admin_user"); len(calls) != 0 {
+				t.Errorf("Expected no account before approval, got %d inserts", len(calls))
+			}
+		})
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	hash, err := auth.HashPassword("old password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name           string
+		param          string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "Change your own password",
+			param:          "alice",
+			body:           `{"oldPassword": "old password", "password": "new password"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Wrong old password",
+			param:          "alice",
+			body:           `{"oldPassword": "guess", "password": "new password"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Missing old password",
+			param:          "alice",
+			body:           `{"password": "new password"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Change another admin's password",
+			param:          "bob",
+			body:           `{"oldPassword": "old password", "password": "new password"}`,
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "SELECT password_hash FROM admin_user", Rows: [][]driver.Value{{hash}}},
+				fakedb.Rule{Match: "admin_user WHERE username = $1 FOR UPDATE", Rows: [][]driver.Value{adminUserValues("alice", "bootstrap")}},
+				fakedb.Rule{Match: "UPDATE admin_user SET", Rows: [][]driver.Value{adminUserValues("alice", "bootstrap")}},
+			)
+			c, rec := newContext(http.MethodPut, tc.body, "alice", "username", tc.param)
+
+			err := ChangePassword(db)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			updates := f.Calls("UPDATE admin_user SET")
+			if tc.expectedStatus != http.StatusOK {
+				if len(updates) != 0 {
+					t.Errorf("Expected no update, got %d", len(updates))
+				}
+				return
+			}
+			if len(updates) != 1 || !strings.Contains(updates[0].Query, "password_reset_by = NULL") {
+				t.Errorf("Expected the password to be changed and no longer marked as reset, got %v", updates)
+			}
+		})
+	}
+}
+
+func TestApproveUserProposal(t *testing.T) {
+	testCases := []struct {
+		name            string
+		kind            string
+		created         bool
+		expectedStatus  int
+		expectedWrite   string
+		expectedActions []string
+	}{
+		{
+			name:            "Create a user",
+			kind:            ProposalCreateUser,
+			created:         true,
+			expectedStatus:  http.StatusOK,
+			expectedWrite:   "INSERT INTO admin_user",
+			expectedActions: []string{"user.create", "proposal.approve"},
+		},
+		{
+			name:           "User was created in the meantime",
+			kind:           ProposalCreateUser,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:            "Reset a password",
+			kind:            ProposalResetPassword,
+			expectedStatus:  http.StatusOK,
+			expectedWrite:   "UPDATE admin_user SET",
+			expectedActions: []string{"user.password", "proposal.approve"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var created [][]driver.Value
+			if tc.created {
+				created = [][]driver.Value{adminUserValues("carol", "alice")}
+			}
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "decided_at = expires_at", Columns: proposalColumnNames},
+				fakedb.Rule{Match: "deduction_proposal WHERE id = $1 FOR UPDATE", Rows: [][]driver.Value{userProposalValues(tc.kind, "carol")}},
+				fakedb.Rule{Match: "SELECT created_by, password_reset_by", Rows: [][]driver.Value{{"bootstrap", nil}}},
+				fakedb.Rule{Match: "SELECT password_hash FROM proposal_password", Rows: [][]driver.Value{{"$2a$10$hash"}}},
+				fakedb.Rule{Match: "INSERT INTO admin_user", Columns: strings.Split(adminUserColumns, ", "), Rows: created},
+				fakedb.Rule{Match: "admin_user WHERE username = $1 FOR UPDATE", Rows: [][]driver.Value{adminUserValues("carol", "bootstrap")}},
+				fakedb.Rule{Match: "UPDATE admin_user SET", Rows: [][]driver.Value{adminUserValues("carol", "bootstrap")}},
+				fakedb.Rule{Match: "RETURNING decided_at", Rows: [][]driver.Value{{time.Now()}}},
+			)
+			c, rec := newContext(http.MethodPost, "", "bob", "id", "9")
+
+			err := ApproveProposal(db)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			if tc.expectedStatus != http.StatusOK {
+				return
+			}
+			writes := f.Calls(tc.expectedWrite)
+			if len(writes) != 1 || writes[0].Args[1] != "$2a$10$hash" || writes[0].Args[2] != "alice" {
+				t.Errorf("Expected the stored hash to be applied on behalf of alice, got %v", writes)
+			}
+			if actions := auditActions(f); strings.Join(actions, ",") != strings.Join(tc.expectedActions, ",") {
+				t.Errorf("Expected audit actions %v, got %v", tc.expectedActions, actions)
+			}
+			if calls := f.Calls("DELETE FROM proposal_password"); len(calls) != 1 {
+				t.Errorf("Expected the stored hash to be deleted, got %d deletes", len(calls))
+			}
+		})
+	}
+}
+
+func TestEnableUser(t *testing.T) {
+	testCases := []struct {
+		name           string
+		user           []driver.Value
+		expectedStatus int
+	}{
+		{
+			name:           "Disabled user",
+			user:           []driver.Value{true},
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			name:           "User that is not disabled",
+			user:           []driver.Value{false},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Unknown user",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var users [][]driver.Value
+			if tc.user != nil {
+				users = [][]driver.Value{tc.user}
+			}
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "SELECT disabled FROM admin_user", Columns: []string{"disabled"}, Rows: users},
+				fakedb.Rule{Match: "INSERT INTO deduction_proposal", Rows: [][]driver.Value{userProposalValues(ProposalEnableUser, "carol")}},
+			)
+			c, rec := newContext(http.MethodPost, "", "alice", "username", "carol")
+
+			err := EnableUser(db, time.Hour)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			if calls := f.Calls("UPDATE admin_user"); len(calls) != 0 {
+				t.Errorf("Expected no change before approval, got %d updates", len(calls))
+			}
+			proposals := f.Calls("INSERT INTO deduction_proposal")
+			if (len(proposals) == 1) != (tc.expectedStatus == http.StatusAccepted) {
+				t.Errorf("Expected a proposal only when accepted, got %d", len(proposals))
+			} else if len(proposals) == 1 && proposals[0].Args[0] != ProposalEnableUser {
+				t.Errorf("Expected an %s proposal, got %v", ProposalEnableUser, proposals[0].Args[0])
+			}
+		})
+	}
+}
+
+func TestApproveEnableUser(t *testing.T) {
+	disabled := adminUserValues("carol", "bootstrap")
+	disabled[1] = true
+
+	testCases := []struct {
+		name            string
+		approver        []driver.Value
+		user            []driver.Value
+		expectedStatus  int
+		expectedActions []string
+	}{
+		{
+			name:            "Enabled by a second admin",
+			approver:        []driver.Value{"bootstrap", nil},
+			user:            disabled,
+			expectedStatus:  http.StatusOK,
+			expectedActions: []string{"user.enable", "proposal.approve"},
+		},
+		{
+			name:           "Approver account created by the proposer",
+			approver:       []driver.Value{"alice", nil},
+			user:           disabled,
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "User was enabled in the meantime",
+			approver:       []driver.Value{"bootstrap", nil},
+			user:           adminUserValues("carol", "bootstrap"),
+			expectedStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "decided_at = expires_at", Columns: proposalColumnNames},
+				fakedb.Rule{Match: "deduction_proposal WHERE id = $1 FOR UPDATE", Rows: [][]driver.Value{userProposalValues(ProposalEnableUser, "carol")}},
+				fakedb.Rule{Match: "SELECT created_by, password_reset_by", Rows: [][]driver.Value{tc.approver}},
+				fakedb.Rule{Match: "admin_user WHERE username = $1 FOR UPDATE", Rows: [][]driver.Value{tc.user}},
+				fakedb.Rule{Match: "UPDATE admin_user SET", Rows: [][]driver.Value{adminUserValues("carol", "bootstrap")}},
+				fakedb.Rule{Match: "RETURNING decided_at", Rows: [][]driver.Value{{time.Now()}}},
+			)
+			c, rec := newContext(http.MethodPost, "", "bob", "id", "9")
+
+			err := ApproveProposal(db)(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			updates := f.Calls("UPDATE admin_user SET disabled = false")
+			if (len(updates) == 1) != (tc.expectedStatus == http.StatusOK) {
+				t.Errorf("Expected the account to be enabled only on approval, got %d updates", len(updates))
+			}
+			if actions := auditActions(f); strings.Join(actions, ",") != strings.Join(tc.expectedActions, ",") {
+				t.Errorf("Expected audit actions %v, got %v", tc.expectedActions, actions)
+			}
+		})
+	}
+}
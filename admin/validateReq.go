@@ -2,18 +2,98 @@ package admin
 
 import (
 	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+	"github.com/Ter4798/post-test-kbtg/tax"
+	"github.com/labstack/echo/v4"
 )
 
-func validatePersonalAllowance(req *personalAllowanceRequest) error {
-	if req.Amount < 10000 || req.Amount > 100000 {
-		return errors.New("amount must be between 10000 and 100000")
+func validateTaxYear(taxYear *int) error {
+	if *taxYear < 0 {
+		return errors.New("taxYear must be greater than zero")
+	}
+	if *taxYear == 0 {
+		*taxYear = tax.DefaultTaxYear
 	}
 	return nil
 }
 
-func validateKReceiptAllowance(req *kReceiptAllowanceRequest) error {
-	if req.Amount < 0 || req.Amount > 100000 {
-		return errors.New("amount must be between 0 and 100000")
+// validateAllowanceLimit checks new minAmount and maxAmount against the
+// registry, and the amount against both the bounds stored before this
+// request and the new ones, so a request cannot widen its own bounds.
+func validateAllowanceLimit(req *allowanceLimitRequest, t tax.AllowanceType, stored *deductionRow) error {
+	min, max := stored.bounds(t)
+	newMin, newMax := min, max
+	if req.MinAmount != nil {
+		newMin = *req.MinAmount
+		if newMin < t.MinLimit || newMin > t.MaxLimit {
+			return fmt.Errorf("minAmount must be between %d and %d", t.MinLimit.Baht(), t.MaxLimit.Baht())
+		}
+	}
+	if req.MaxAmount != nil {
+		newMax = *req.MaxAmount
+		if newMax < t.MinLimit || newMax > t.MaxLimit {
+			return fmt.Errorf("maxAmount must be between %d and %d", t.MinLimit.Baht(), t.MaxLimit.Baht())
+		}
+	}
+	if newMin > newMax {
+		return errors.New("minAmount must not be greater than maxAmount")
+	}
+	if newMin > min {
+		min = newMin
+	}
+	if newMax < max {
+		max = newMax
+	}
+	if req.Amount < min || req.Amount > max {
+		return fmt.Errorf("amount must be between %d and %d", min.Baht(), max.Baht())
+	}
+	if req.Multiplier != nil {
+		if t.MaxMultiplier == 0 {
+			return fmt.Errorf("multiplier is not configurable for %s", t.Name)
+		}
+		if *req.Multiplier < 100*money.Percent || *req.Multiplier > t.MaxMultiplier {
+			return fmt.Errorf("multiplier must be between 1 and %v", t.MaxMultiplier)
+		}
+	}
+	if req.IncomeRate != nil {
+		if t.MaxIncomeRate == 0 {
+			return fmt.Errorf("incomeRate is not configurable for %s", t.Name)
+		}
+		if *req.IncomeRate <= 0 || *req.IncomeRate > t.MaxIncomeRate {
+			return fmt.Errorf("incomeRate must be greater than 0 and at most %v", t.MaxIncomeRate)
+		}
 	}
 	return nil
 }
+
+func parseTaxYear(c echo.Context) (int, error) {
+	var taxYear int
+	if s := c.QueryParam("taxYear"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, errors.New("taxYear must be a number")
+		}
+		taxYear = v
+	}
+	if err := validateTaxYear(&taxYear); err != nil {
+		return 0, err
+	}
+	return taxYear, nil
+}
+
+// parseAsOf reads the optional asOf query parameter, defaulting to now.
+func parseAsOf(c echo.Context) (time.Time, error) {
+	s := c.QueryParam("asOf")
+	if s == "" {
+		return time.Now(), nil
+	}
+	asOf, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("asOf must be an RFC 3339 timestamp")
+	}
+	return asOf, nil
+}
@@ -0,0 +1,237 @@
+package audit
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/auth"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Entry is one admin mutation. OldValue is null when the change created
+// something and NewValue is null when it removed something.
+type Entry struct {
+	ID           int64           `json:"id"`
+	Actor        string          `json:"actor"`
+	Action       string          `json:"action"`
+	ResourceType string          `json:"resourceType"`
+	ResourceID   string          `json:"resourceId"`
+	OldValue     json.RawMessage `json:"oldValue"`
+	NewValue     json.RawMessage `json:"newValue"`
+	ClientIP     string          `json:"clientIp"`
+	RequestID    string          `json:"requestId"`
+	CreatedAt    time.Time       `json:"createdAt"`
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// Record appends an entry for the current request. Pass the transaction
+// that made the change so the entry is only kept if the change is. The
+// client IP comes from the server's IPExtractor and the request ID from
+// RequestID, so neither is taken from headers the caller controls.
+func Record(db execer, c echo.Context, action, resourceType, resourceID string, oldValue, newValue any) error {
+	return RecordAs(db, c, auth.User(c), action, resourceType, resourceID, oldValue, newValue)
+}
+
+// RecordAs is Record for a change the server makes on its own while
+// handling the request, such as expiring a proposal, with actor in place of
+// the authenticated user.
+func RecordAs(db execer, c echo.Context, actor, action, resourceType, resourceID string, oldValue, newValue any) error {
+	oldJSON, err := marshalValue(oldValue)
+	if err != nil {
+		return err
+	}
+	newJSON, err := marshalValue(newValue)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO audit_log (actor, action, resource_type, resource_id, old_value, new_value, client_ip, request_id)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		actor, action, resourceType, resourceID, oldJSON, newJSON, c.RealIP(), c.Response().Header().Get(echo.HeaderXRequestID))
+	return err
+}
+
+// RequestID gives every request an X-Request-ID generated by the server. An
+// inbound header is replaced rather than trusted, unlike the Echo middleware.
+func RequestID() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				return err
+			}
+			id := hex.EncodeToString(b)
+			c.Request().Header.Set(echo.HeaderXRequestID, id)
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+			return next(c)
+		}
+	}
+}
+
+func marshalValue(v any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+// Filter narrows an audit query. Empty fields match everything.
+type Filter struct {
+	Actor        string
+	Action       string
+	ResourceType string
+	ResourceID   string
+	From         *time.Time
+	To           *time.Time
+	Page         int
+	PageSize     int
+}
+
+func HandleQuery(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter, err := bindFilter(c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		where, args := filter.where()
+
+		var total int
+		if err := db.QueryRow("SELECT COUNT(*) FROM audit_log"+where, args...).Scan(&total); err != nil {
+			return err
+		}
+
+		args = append(args, filter.PageSize, (filter.Page-1)*filter.PageSize)
+		rows, err := db.Query(fmt.Sprintf(`SELECT id, actor, action, resource_type, resource_id, old_value, new_value, client_ip, request_id, created_at
+            FROM audit_log%s ORDER BY id DESC LIMIT $%d OFFSET $%d`, where, len(args)-1, len(args)), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		entries := []Entry{}
+		for rows.Next() {
+			var e Entry
+			var oldValue, newValue []byte
+			if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.ResourceType, &e.ResourceID, &oldValue, &newValue, &e.ClientIP, &e.RequestID, &e.CreatedAt); err != nil {
+				return err
+			}
+			e.OldValue, e.NewValue = nullableJSON(oldValue), nullableJSON(newValue)
+			entries = append(entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, struct {
+			Entries  []Entry `json:"entries"`
+			Page     int     `json:"page"`
+			PageSize int     `json:"pageSize"`
+			Total    int     `json:"total"`
+		}{
+			Entries:  entries,
+			Page:     filter.Page,
+			PageSize: filter.PageSize,
+			Total:    total,
+		})
+	}
+}
+
+func nullableJSON(b []byte) json.RawMessage {
+	if b == nil {
+		return json.RawMessage("null")
+	}
+	return b
+}
+
+func bindFilter(c echo.Context) (Filter, error) {
+	f := Filter{
+		Actor:        c.QueryParam("actor"),
+		Action:       c.QueryParam("action"),
+		ResourceType: c.QueryParam("resourceType"),
+		ResourceID:   c.QueryParam("resourceId"),
+		Page:         1,
+		PageSize:     defaultPageSize,
+	}
+
+	for name, dst := range map[string]**time.Time{"from": &f.From, "to": &f.To} {
+		s := c.QueryParam(name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return f, errors.New(name + " must be an RFC 3339 timestamp")
+		}
+		*dst = &t
+	}
+
+	for name, dst := range map[string]*int{"page": &f.Page, "pageSize": &f.PageSize} {
+		s := c.QueryParam(name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return f, errors.New(name + " must be a number")
+		}
+		*dst = v
+	}
+	if f.Page < 1 {
+		return f, errors.New("page must be greater than zero")
+	}
+	if f.PageSize < 1 || f.PageSize > maxPageSize {
+		return f, fmt.Errorf("pageSize must be between 1 and %d", maxPageSize)
+	}
+	return f, nil
+}
+
+// where builds the WHERE clause for the filter with numbered placeholders.
+func (f Filter) where() (string, []any) {
+	var conditions []string
+	var args []any
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.Actor != "" {
+		add("actor = $%d", f.Actor)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.ResourceType != "" {
+		add("resource_type = $%d", f.ResourceType)
+	}
+	if f.ResourceID != "" {
+		add("resource_id = $%d", f.ResourceID)
+	}
+	if f.From != nil {
+		add("created_at >= $%d", *f.From)
+	}
+	if f.To != nil {
+		add("created_at < $%d", *f.To)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestFilterWhere(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name     string
+		filter   Filter
+		expected string
+		args     int
+	}{
+		{
+			name:     "No filter",
+			expected: "",
+		},
+		{
+			name:     "Actor and resource",
+			filter:   Filter{Actor: "adminTax", ResourceType: "deduction"},
+			expected: " WHERE actor = $1 AND resource_type = $2",
+			args:     2,
+		},
+		{
+			name:     "Time range",
+			filter:   Filter{Action: "deduction.update", From: &from, To: &from},
+			expected: " WHERE action = $1 AND created_at >= $2 AND created_at < $3",
+			args:     3,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			where, args := tc.filter.where()
+			if where != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, where)
+			}
+			if len(args) != tc.args {
+				t.Errorf("Expected %d args, got %d", tc.args, len(args))
+			}
+		})
+	}
+}
+
+type recordingExecer struct {
+	args []any
+}
+
+func (r *recordingExecer) Exec(query string, args ...any) (sql.Result, error) {
+	r.args = args
+	return nil, nil
+}
+
+func TestRecordIgnoresClientHeaders(t *testing.T) {
+	testCases := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{
+			name: "No headers",
+		},
+		{
+			name: "Spoofed headers",
+			headers: map[string]string{
+				echo.HeaderXForwardedFor: "203.0.113.9",
+				echo.HeaderXRealIP:       "203.0.113.9",
+				echo.HeaderXRequestID:    "spoofed",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := echo.New()
+			e.IPExtractor = echo.ExtractIPDirect()
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.RemoteAddr = "192.0.2.1:4321"
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			db := &recordingExecer{}
+			err := RequestID()(func(c echo.Context) error {
+				return Record(db, c, "deduction.update", "deduction", "personal", nil, nil)
+			})(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ip := db.args[6]; ip != "192.0.2.1" {
+				t.Errorf("Expected client IP 192.0.2.1, got %v", ip)
+			}
+			requestID := rec.Header().Get(echo.HeaderXRequestID)
+			if requestID == "" || requestID == "spoofed" {
+				t.Errorf("Expected a generated request ID, got %q", requestID)
+			}
+			if db.args[7] != requestID {
+				t.Errorf("Expected request ID %q, got %v", requestID, db.args[7])
+			}
+		})
+	}
+}
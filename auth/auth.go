@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"net/http"
 	"strings"
@@ -8,7 +9,36 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
-func BasicAuth(username, password string) echo.MiddlewareFunc {
+// UserKey is the context key holding the authenticated username.
+const UserKey = "user"
+
+// User returns the username set by the auth middleware, or an empty string
+// on unauthenticated routes.
+func User(c echo.Context) string {
+	user, _ := c.Get(UserKey).(string)
+	return user
+}
+
+// ParseUsers reads a comma-separated list of name:password pairs.
+func ParseUsers(s string) map[string]string {
+	users := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		name, password, ok := strings.Cut(pair, ":")
+		if ok && name != "" {
+			users[name] = password
+		}
+	}
+	return users
+}
+
+// BasicAuthDB accepts the enabled accounts in the admin_user table.
+func BasicAuthDB(db *sql.DB) echo.MiddlewareFunc {
+	return basicAuth(func(username, password string) (bool, error) {
+		return Authenticate(db, username, password)
+	})
+}
+
+func basicAuth(check func(username, password string) (bool, error)) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			auth := c.Request().Header.Get("Authorization")
@@ -27,10 +57,18 @@ func BasicAuth(username, password string) echo.MiddlewareFunc {
 			}
 
 			credentials := strings.SplitN(string(decoded), ":", 2)
-			if len(credentials) != 2 || credentials[0] != username || credentials[1] != password {
+			if len(credentials) != 2 {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid Credentials")
+			}
+			ok, err := check(credentials[0], credentials[1])
+			if err != nil {
+				return err
+			}
+			if !ok {
 				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid Credentials")
 			}
 
+			c.Set(UserKey, credentials[0])
 			return next(c)
 		}
 	}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(kid string) (*ecdsa.PublicKey, bool) {
+		return &key.PublicKey, kid == "k1"
+	}
+	now := time.Unix(1700000000, 0)
+	valid := Claims{Issuer: Issuer, Subject: "admin", Audience: Audience, IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(), ID: "j1"}
+
+	sign := func(kid string, k *ecdsa.PrivateKey, claims Claims) string {
+		token, err := signJWT(kid, k, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	wrongAudience := valid
+	wrongAudience.Audience = "someone-else"
+	expired := valid
+	expired.ExpiresAt = now.Unix()
+	token := sign("k1", key, valid)
+	parts := strings.Split(token, ".")
+
+	testCases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "Valid", token: token, valid: true},
+		{name: "Unknown key", token: sign("k2", key, valid)},
+		{name: "Signed by another key", token: sign("k1", other, valid)},
+		{name: "Wrong audience", token: sign("k1", key, wrongAudience)},
+		{name: "Expired", token: sign("k1", key, expired)},
+		{name: "Tampered payload", token: parts[0] + "." + b64([]byte(`{"iss":"k-tax","sub":"root","aud":"k-tax-admin","exp":9999999999}`)) + "." + parts[2]},
+		{name: "Algorithm none", token: b64([]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + "."},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := verifyJWT(tc.token, lookup, now)
+			if tc.valid && (err != nil || claims != valid) {
+				t.Errorf("Expected %+v, got %+v, %v", valid, claims, err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const MinKeySecretLength = 32
+
+// minReloadInterval limits how often a token with an unknown key ID reloads
+// the set, so forged tokens cannot make every request read and decrypt the
+// stored keys.
+const minReloadInterval = 10 * time.Second
+
+var ErrNoKeySecret = echo.NewHTTPError(http.StatusInternalServerError, "SIGNING_KEY_SECRET is not set")
+
+// KeySet holds the signing keys kept in the signing_key table, newest first.
+// The newest key signs; every key in the set verifies. Rotating keeps the
+// previous key so tokens it signed stay valid until they expire. Private
+// keys are stored sealed with AES-256-GCM under the key set's secret.
+type KeySet struct {
+	db         *sql.DB
+	aead       cipher.AEAD
+	mu         sync.RWMutex
+	keys       []signingKey
+	reloadedAt time.Time
+}
+
+type signingKey struct {
+	ID        string
+	Private   *ecdsa.PrivateKey
+	CreatedAt time.Time
+}
+
+// JWK is the public half of a P-256 signing key.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+}
+
+// LoadKeySet reads the active keys and creates the first one when there is
+// none. Keys stored before they were encrypted are sealed first. Without a
+// secret the set stays empty: no token can be issued and Rotate fails with
+// ErrNoKeySecret.
+func LoadKeySet(db *sql.DB, secret []byte) (*KeySet, error) {
+	k := &KeySet{db: db}
+	if len(secret) == 0 {
+		return k, nil
+	}
+	if len(secret) < MinKeySecretLength {
+		return nil, fmt.Errorf("SIGNING_KEY_SECRET must be at least %d bytes", MinKeySecretLength)
+	}
+	sum := sha256.Sum256(secret)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	if k.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+
+	if err := k.encryptPlaintext(); err != nil {
+		return nil, err
+	}
+	if err := k.reload(); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		if _, err := k.Rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// encryptPlaintext seals the keys written before private keys were encrypted.
+func (k *KeySet) encryptPlaintext() error {
+	tx, err := k.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT kid, private_key FROM signing_key WHERE NOT encrypted FOR UPDATE")
+	if err != nil {
+		return err
+	}
+	plain := make(map[string][]byte)
+	for rows.Next() {
+		var kid string
+		var der []byte
+		if err := rows.Scan(&kid, &der); err != nil {
+			rows.Close()
+			return err
+		}
+		plain[kid] = der
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for kid, der := range plain {
+		sealed, err := k.seal(kid, der)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE signing_key SET private_key = $2, encrypted = true WHERE kid = $1", kid, sealed); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// seal encrypts a private key, binding it to its key ID so a sealed key
+// copied to another row does not decrypt.
+func (k *KeySet) seal(kid string, der []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, der, []byte(kid)), nil
+}
+
+func (k *KeySet) open(kid string, sealed []byte) ([]byte, error) {
+	size := k.aead.NonceSize()
+	if len(sealed) >= size {
+		if der, err := k.aead.Open(nil, sealed[:size], sealed[size:], []byte(kid)); err == nil {
+			return der, nil
+		}
+	}
+	return nil, fmt.Errorf("signing key %s cannot be decrypted with SIGNING_KEY_SECRET", kid)
+}
+
+func (k *KeySet) reload() error {
+	if k.aead == nil {
+		return ErrNoKeySecret
+	}
+	rows, err := k.db.Query("SELECT kid, private_key, created_at FROM signing_key WHERE retired_at IS NULL AND encrypted ORDER BY created_at DESC")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var keys []signingKey
+	for rows.Next() {
+		var key signingKey
+		var sealed []byte
+		if err := rows.Scan(&key.ID, &sealed, &key.CreatedAt); err != nil {
+			return err
+		}
+		der, err := k.open(key.ID, sealed)
+		if err != nil {
+			return err
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return err
+		}
+		private, ok := parsed.(*ecdsa.PrivateKey)
+		if !ok {
+			continue
+		}
+		key.Private = private
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.reloadedAt = time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+// Rotate adds a new signing key, retires all but the key it replaces and
+// returns the new key ID.
+func (k *KeySet) Rotate() (string, error) {
+	if k.aead == nil {
+		return "", ErrNoKeySecret
+	}
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	kid, err := randomToken(12)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := k.seal(kid, der)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := k.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE signing_key SET retired_at = now() WHERE retired_at IS NULL AND kid NOT IN (
+        SELECT kid FROM signing_key WHERE retired_at IS NULL ORDER BY created_at DESC LIMIT 1)`)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("INSERT INTO signing_key (kid, private_key, encrypted) VALUES ($1, $2, true)", kid, sealed); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return kid, k.reload()
+}
+
+func (k *KeySet) current() (signingKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return signingKey{}, ErrNoKeySecret
+	}
+	return k.keys[0], nil
+}
+
+// publicKey looks up a key ID, reloading once in case another instance
+// rotated the set. Unknown key IDs are rejected without a reload when the
+// set was reloaded less than minReloadInterval ago.
+func (k *KeySet) publicKey(kid string) (*ecdsa.PublicKey, bool) {
+	if key, ok := k.find(kid); ok {
+		return key, true
+	}
+	k.mu.Lock()
+	if time.Since(k.reloadedAt) < minReloadInterval {
+		k.mu.Unlock()
+		return nil, false
+	}
+	k.reloadedAt = time.Now()
+	k.mu.Unlock()
+	if err := k.reload(); err != nil {
+		return nil, false
+	}
+	return k.find(kid)
+}
+
+func (k *KeySet) find(kid string) (*ecdsa.PublicKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return &key.Private.PublicKey, true
+		}
+	}
+	return nil, false
+}
+
+// JWKS returns the public keys in the JSON Web Key Set format.
+func (k *KeySet) JWKS() []JWK {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	jwks := make([]JWK, 0, len(k.keys))
+	for _, key := range k.keys {
+		public, err := key.Private.PublicKey.ECDH()
+		if err != nil {
+			continue
+		}
+		point := public.Bytes() // 0x04 || X || Y
+		jwks = append(jwks, JWK{
+			KeyType:   "EC",
+			Curve:     "P-256",
+			X:         b64(point[1:33]),
+			Y:         b64(point[33:]),
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: "ES256",
+		})
+	}
+	return jwks
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+)
+
+var keySecret = []byte(strings.Repeat("s", MinKeySecretLength))
+
+type storedKey struct {
+	kid        string
+	privateKey []byte
+	encrypted  bool
+}
+
+// openKeys keeps the signing_key table in keys.
+func openKeys(keys *[]storedKey) (*sql.DB, *fakedb.DB) {
+	selectKeys := func(encrypted bool) func([]driver.Value) ([][]driver.Value, error) {
+		return func([]driver.Value) ([][]driver.Value, error) {
+			var rows [][]driver.Value
+			for _, key := range *keys {
+				switch {
+				case key.encrypted != encrypted:
+				case encrypted:
+					rows = append(rows, []driver.Value{key.kid, key.privateKey, time.Now()})
+				default:
+					rows = append(rows, []driver.Value{key.kid, key.privateKey})
+				}
+			}
+			return rows, nil
+		}
+	}
+	return fakedb.Open(
+		fakedb.Rule{Match: "SELECT kid, private_key FROM signing_key WHERE NOT encrypted", Columns: []string{"kid", "private_key"},
+			Func: selectKeys(false)},
+		fakedb.Rule{Match: "SELECT kid, private_key, created_at FROM signing_key WHERE retired_at IS NULL AND encrypted", Columns: []string{"kid", "private_key", "created_at"},
+			Func: selectKeys(true)},
+		fakedb.Rule{Match: "UPDATE signing_key SET private_key = $2, encrypted = true WHERE kid = $1",
+			Func: func(args []driver.Value) ([][]driver.Value, error) {
+				for i := range *keys {
+					if (*keys)[i].kid == args[0] {
+						(*keys)[i].privateKey, (*keys)[i].encrypted = args[1].([]byte), true
+					}
+				}
+				return nil, nil
+			}},
+		fakedb.Rule{Match: "INSERT INTO signing_key",
+			Func: func(args []driver.Value) ([][]driver.Value, error) {
+				*keys = append(*keys, storedKey{kid: args[0].(string), privateKey: args[1].([]byte), encrypted: true})
+				return nil, nil
+			}},
+	)
+}
+
+func TestLoadKeySet(t *testing.T) {
+	var keys []storedKey
+	db, _ := openKeys(&keys)
+
+	k, err := LoadKeySet(db, keySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("Expected the first key to be created, got %d keys", len(keys))
+	}
+	if _, err := x509.ParsePKCS8PrivateKey(keys[0].privateKey); err == nil {
+		t.Error("Expected the private key to be stored encrypted")
+	}
+	first, _ := k.current()
+
+	reloaded, err := LoadKeySet(db, keySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _ := reloaded.current(); key.ID != first.ID || !key.Private.Equal(first.Private) {
+		t.Errorf("Expected key %s to be loaded again, got %s", first.ID, key.ID)
+	}
+
+	if _, err := LoadKeySet(db, []byte(strings.Repeat("x", MinKeySecretLength))); err == nil {
+		t.Error("Expected another secret not to decrypt the key")
+	}
+}
+
+func TestLoadKeySetEncryptsPlaintextKeys(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []storedKey{{kid: "old", privateKey: der}}
+
+	db, _ := openKeys(&keys)
+	k, err := LoadKeySet(db, keySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !keys[0].encrypted || bytes.Equal(keys[0].privateKey, der) {
+		t.Fatalf("Expected the stored key to be encrypted in place, got %+v", keys)
+	}
+	if key, _ := k.current(); key.ID != "old" || !key.Private.Equal(private) {
+		t.Errorf("Expected the existing key to keep signing, got %s", key.ID)
+	}
+}
+
+func TestLoadKeySetSecret(t *testing.T) {
+	testCases := []struct {
+		name        string
+		secret      []byte
+		expectedErr bool
+	}{
+		{name: "No secret"},
+		{name: "Short secret", secret: []byte("short"), expectedErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var keys []storedKey
+			db, _ := openKeys(&keys)
+			k, err := LoadKeySet(db, tc.secret)
+			if tc.expectedErr {
+				if err == nil {
+					t.Error("Expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := k.Rotate(); !errors.Is(err, ErrNoKeySecret) {
+				t.Errorf("Expected %v, got %v", ErrNoKeySecret, err)
+			}
+			if len(keys) != 0 {
+				t.Errorf("Expected no key to be stored, got %d", len(keys))
+			}
+		})
+	}
+}
+
+func TestSealedKeyIsBoundToKeyID(t *testing.T) {
+	var keys []storedKey
+	db, _ := openKeys(&keys)
+	k, err := LoadKeySet(db, keySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := k.seal("k1", []byte("private key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if der, err := k.open("k1", sealed); err != nil || string(der) != "private key" {
+		t.Errorf("Expected the key to decrypt, got %q, %v", der, err)
+	}
+	if _, err := k.open("k2", sealed); err == nil {
+		t.Error("Expected a key moved to another ID not to decrypt")
+	}
+}
+
+func TestPublicKeyReloadInterval(t *testing.T) {
+	var keys []storedKey
+	db, f := openKeys(&keys)
+	k, err := LoadKeySet(db, keySecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloads := func() int { return len(f.Calls("SELECT kid, private_key, created_at FROM signing_key")) }
+	loaded := reloads()
+
+	if _, ok := k.publicKey("forged"); ok {
+		t.Fatal("Expected an unknown key ID to be rejected")
+	}
+	if reloads() != loaded {
+		t.Errorf("Expected no reload right after loading, got %d", reloads()-loaded)
+	}
+
+	// Another instance rotates after the interval has passed.
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := k.seal("k2", der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, storedKey{kid: "k2", privateKey: sealed, encrypted: true})
+	k.reloadedAt = time.Now().Add(-minReloadInterval)
+
+	if key, ok := k.publicKey("k2"); !ok || !key.Equal(&private.PublicKey) {
+		t.Fatal("Expected the rotated key to be found after a reload")
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := k.publicKey("forged"); ok {
+			t.Fatal("Expected an unknown key ID to be rejected")
+		}
+	}
+	if reloads() != loaded+1 {
+		t.Errorf("Expected one reload for the rotated key only, got %d", reloads()-loaded)
+	}
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TokenIssuer hands out short-lived access tokens with refresh tokens. Only
+// a SHA-256 hash of each refresh token is stored.
+type TokenIssuer struct {
+	db         *sql.DB
+	keys       *KeySet
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+func NewTokenIssuer(db *sql.DB, keys *KeySet, accessTTL, refreshTTL time.Duration) *TokenIssuer {
+	return &TokenIssuer{db: db, keys: keys, accessTTL: accessTTL, refreshTTL: refreshTTL}
+}
+
+// Why a refresh token was revoked, kept in refresh_token.revoke_reason.
+const (
+	revokeRotated = "rotated"
+	revokeLogout  = "logout"
+)
+
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"accessToken"`
+	TokenType        string `json:"tokenType"`
+	ExpiresIn        int64  `json:"expiresIn"`
+	RefreshToken     string `json:"refreshToken"`
+	RefreshExpiresIn int64  `json:"refreshExpiresIn"`
+}
+
+func Login(t *TokenIssuer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req loginRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		ok, err := Authenticate(t.db, req.Username, req.Password)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Invalid Credentials")
+		}
+
+		tx, err := t.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		resp, err := t.issue(tx, req.Username)
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// Refresh exchanges a refresh token for a new pair. Each refresh token works
+// once; presenting a rotated one again revokes every session of the user,
+// since it means the token was copied. A token revoked by Logout is only
+// rejected, so a client retrying after logout does not end other sessions.
+func Refresh(t *TokenIssuer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req refreshRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		tx, err := t.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		var id int64
+		var username string
+		var revoked, valid bool
+		var reason string
+		err = tx.QueryRow(`SELECT r.id, r.username, r.revoked_at IS NOT NULL, COALESCE(r.revoke_reason, ''),
+            r.expires_at > now() AND NOT u.disabled AND (u.tokens_revoked_at IS NULL OR r.created_at > u.tokens_revoked_at)
+            FROM refresh_token r JOIN admin_user u ON u.username = r.username
+            WHERE r.token_hash = $1 FOR UPDATE OF r`, hashToken(req.RefreshToken)).Scan(&id, &username, &revoked, &reason, &valid)
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusUnauthorized, ErrInvalidToken.Error())
+		}
+		if err != nil {
+			return err
+		}
+		if revoked && reason == revokeRotated {
+			if _, err := tx.Exec("UPDATE admin_user SET tokens_revoked_at = now() WHERE username = $1", username); err != nil {
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			return echo.NewHTTPError(http.StatusUnauthorized, "refresh token was already used")
+		}
+		if revoked || !valid {
+			return echo.NewHTTPError(http.StatusUnauthorized, ErrInvalidToken.Error())
+		}
+
+		if _, err := tx.Exec("UPDATE refresh_token SET revoked_at = now(), revoke_reason = $2 WHERE id = $1", id, revokeRotated); err != nil {
+			return err
+		}
+		resp, err := t.issue(tx, username)
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+// Logout revokes the refresh token in the body and the access token in the
+// Authorization header, whichever are given.
+func Logout(t *TokenIssuer) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req refreshRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		if req.RefreshToken != "" {
+			_, err := t.db.Exec("UPDATE refresh_token SET revoked_at = now(), revoke_reason = $2 WHERE token_hash = $1 AND revoked_at IS NULL",
+				hashToken(req.RefreshToken), revokeLogout)
+			if err != nil {
+				return err
+			}
+		}
+		if token, ok := bearerToken(c); ok {
+			if claims, err := verifyJWT(token, t.keys.publicKey, time.Now()); err == nil {
+				if err := t.revokeAccessToken(claims); err != nil {
+					return err
+				}
+			}
+		}
+		return c.NoContent(http.StatusNoContent)
+	}
+}
+
+func JWKS(keys *KeySet) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, struct {
+			Keys []JWK `json:"keys"`
+		}{
+			Keys: keys.JWKS(),
+		})
+	}
+}
+
+// TokenAuth accepts a Bearer access token and hands any other Authorization
+// scheme to fallback, so Basic auth keeps working alongside tokens. Besides
+// the token itself it checks that the user is still enabled and that the
+// token was not revoked. Revocation is judged by the created_at of the
+// refresh token issued with the access token, the same database clock that
+// sets tokens_revoked_at and that Refresh compares against; the whole-second
+// iat claim would reject tokens issued in the second of a revocation.
+func TokenAuth(t *TokenIssuer, fallback echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withFallback := fallback(next)
+		return func(c echo.Context) error {
+			token, ok := bearerToken(c)
+			if !ok {
+				return withFallback(c)
+			}
+
+			claims, err := verifyJWT(token, t.keys.publicKey, time.Now())
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			}
+			var active bool
+			err = t.db.QueryRow(`SELECT NOT u.disabled AND (u.tokens_revoked_at IS NULL OR r.created_at > u.tokens_revoked_at)
+                AND NOT EXISTS (SELECT 1 FROM revoked_token WHERE jti = $2)
+                FROM refresh_token r JOIN admin_user u ON u.username = r.username
+                WHERE r.username = $1 AND r.access_jti = $2`, claims.Subject, claims.ID).Scan(&active)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if !active {
+				return echo.NewHTTPError(http.StatusUnauthorized, "token has been revoked")
+			}
+
+			c.Set(UserKey, claims.Subject)
+			return next(c)
+		}
+	}
+}
+
+func (t *TokenIssuer) issue(tx *sql.Tx, username string) (tokenResponse, error) {
+	now := time.Now()
+	jti, err := randomToken(16)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	key, err := t.keys.current()
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	access, err := signJWT(key.ID, key.Private, Claims{
+		Issuer:    Issuer,
+		Subject:   username,
+		Audience:  Audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(t.accessTTL).Unix(),
+		ID:        jti,
+	})
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	refresh, err := randomToken(32)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+	_, err = tx.Exec("INSERT INTO refresh_token (token_hash, username, expires_at, access_jti) VALUES ($1, $2, $3, $4)",
+		hashToken(refresh), username, now.Add(t.refreshTTL), jti)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	return tokenResponse{
+		AccessToken:      access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(t.accessTTL.Seconds()),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int64(t.refreshTTL.Seconds()),
+	}, nil
+}
+
+// revokeAccessToken blocks one access token until it would have expired
+// anyway, and drops entries that no longer matter.
+func (t *TokenIssuer) revokeAccessToken(claims Claims) error {
+	if _, err := t.db.Exec("DELETE FROM revoked_token WHERE expires_at < now()"); err != nil {
+		return err
+	}
+	_, err := t.db.Exec("INSERT INTO revoked_token (jti, expires_at) VALUES ($1, to_timestamp($2)) ON CONFLICT (jti) DO NOTHING",
+		claims.ID, claims.ExpiresAt)
+	return err
+}
+
+func bearerToken(c echo.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.Request().Header.Get("Authorization"), " ")
+	return token, ok && scheme == "Bearer" && token != ""
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
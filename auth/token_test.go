@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+	"github.com/labstack/echo/v4"
+)
+
+func testIssuer(t *testing.T, db *sql.DB) *TokenIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &KeySet{db: db, keys: []signingKey{{ID: "k1", Private: key, CreatedAt: time.Now()}}}
+	return NewTokenIssuer(db, keys, time.Minute, time.Hour)
+}
+
+func tokenContext(body string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(req, rec), rec
+}
+
+func statusOf(err error, rec *httptest.ResponseRecorder) int {
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code
+	}
+	if err != nil {
+		return http.StatusInternalServerError
+	}
+	return rec.Code
+}
+
+func TestRefresh(t *testing.T) {
+	testCases := []struct {
+		name           string
+		revoked        bool
+		reason         string
+		valid          bool
+		expectedStatus int
+		expectedRevoke bool
+	}{
+		{
+			name:           "Active token",
+			valid:          true,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Expired token",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Rotated token used again",
+			revoked:        true,
+			reason:         revokeRotated,
+			valid:          true,
+			expectedStatus: http.StatusUnauthorized,
+			expectedRevoke: true,
+		},
+		{
+			name:           "Token used after logout",
+			revoked:        true,
+			reason:         revokeLogout,
+			valid:          true,
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Token revoked before reasons were kept",
+			revoked:        true,
+			valid:          true,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, f := fakedb.Open(
+				fakedb.Rule{Match: "FROM refresh_token r JOIN admin_user u", Rows: [][]driver.Value{{int64(7), "alice", tc.revoked, tc.reason, tc.valid}}},
+			)
+			c, rec := tokenContext(`{"refreshToken": "abc"}`)
+
+			err := Refresh(testIssuer(t, db))(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+			if revokes := f.Calls("SET tokens_revoked_at"); (len(revokes) > 0) != tc.expectedRevoke {
+				t.Errorf("Expected every session revoked to be %v, got %d updates", tc.expectedRevoke, len(revokes))
+			}
+
+			rotations := f.Calls("UPDATE refresh_token SET")
+			if tc.expectedStatus != http.StatusOK {
+				if len(rotations) != 0 {
+					t.Errorf("Expected no rotation, got %d", len(rotations))
+				}
+				return
+			}
+			if len(rotations) != 1 || rotations[0].Args[1] != revokeRotated {
+				t.Errorf("Expected the token to be revoked as rotated, got %v", rotations)
+			}
+			if inserts := f.Calls("INSERT INTO refresh_token"); len(inserts) != 1 {
+				t.Errorf("Expected a new refresh token, got %d", len(inserts))
+			}
+		})
+	}
+}
+
+func TestLogout(t *testing.T) {
+	db, f := fakedb.Open()
+	c, rec := tokenContext(`{"refreshToken": "abc"}`)
+
+	err := Logout(testIssuer(t, db))(c)
+	if status := statusOf(err, rec); status != http.StatusNoContent {
+		t.Fatalf("Expected status 204, got %d (%v)", status, err)
+	}
+	calls := f.Calls("UPDATE refresh_token SET")
+	if len(calls) != 1 || calls[0].Args[0] != hashToken("abc") || calls[0].Args[1] != revokeLogout {
+		t.Errorf("Expected the token to be revoked by logout, got %v", calls)
+	}
+}
+
+func TestTokenAuthRevocation(t *testing.T) {
+	testCases := []struct {
+		name           string
+		revokedAt      func(issued time.Time) driver.Value
+		unknown        bool
+		expectedStatus int
+	}{
+		{
+			name:           "Never revoked",
+			revokedAt:      func(time.Time) driver.Value { return nil },
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name: "Issued in the revocation second after it",
+			revokedAt: func(issued time.Time) driver.Value {
+				return issued.Add(-time.Nanosecond).Truncate(time.Second)
+			},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Issued before the revocation",
+			revokedAt:      func(issued time.Time) driver.Value { return issued.Add(time.Microsecond) },
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Issued without a refresh token",
+			revokedAt:      func(time.Time) driver.Value { return nil },
+			unknown:        true,
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			created := map[string]time.Time{}
+			db, _ := fakedb.Open(
+				fakedb.Rule{Match: "INSERT INTO refresh_token", Func: func(args []driver.Value) ([][]driver.Value, error) {
+					created[args[3].(string)] = time.Now()
+					return nil, nil
+				}},
+				fakedb.Rule{Match: "FROM refresh_token r JOIN admin_user u ON u.username = r.username", Columns: []string{"active"},
+					Func: func(args []driver.Value) ([][]driver.Value, error) {
+						issued, ok := created[args[1].(string)]
+						if !ok || args[0] != "alice" {
+							return nil, nil
+						}
+						revokedAt, _ := tc.revokedAt(issued).(time.Time)
+						return [][]driver.Value{{revokedAt.IsZero() || issued.After(revokedAt)}}, nil
+					}},
+			)
+			issuer := testIssuer(t, db)
+
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens, err := issuer.issue(tx, "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			if tc.unknown {
+				clear(created)
+			}
+
+			c, rec := tokenContext("")
+			c.Request().Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+			fallback := func(echo.HandlerFunc) echo.HandlerFunc {
+				return func(echo.Context) error { return echo.ErrUnauthorized }
+			}
+			err = TokenAuth(issuer, fallback)(func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			})(c)
+			if status := statusOf(err, rec); status != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+		})
+	}
+}
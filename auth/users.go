@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	MinPasswordLength = 8
+	// bcrypt ignores everything after 72 bytes.
+	MaxPasswordLength = 72
+)
+
+// dummyHash is compared against when the user does not exist, so a wrong
+// username takes as long to reject as a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+func ValidatePassword(password string) error {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return fmt.Errorf("password must be between %d and %d bytes", MinPasswordLength, MaxPasswordLength)
+	}
+	return nil
+}
+
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Authenticate checks the password of an enabled admin_user.
+func Authenticate(db *sql.DB, username, password string) (bool, error) {
+	var hash string
+	err := db.QueryRow("SELECT password_hash FROM admin_user WHERE username = $1 AND NOT disabled", username).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
+
+// Bootstrap creates the given admins unless an account with the same name
+// already exists, so a password rotated through the API is not reset by the
+// environment on the next start.
+func Bootstrap(db *sql.DB, users map[string]string) error {
+	for username, password := range users {
+		if username == "" || password == "" {
+			continue
+		}
+		hash, err := HashPassword(password)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`INSERT INTO admin_user (username, password_hash, created_by) VALUES ($1, $2, 'bootstrap')
+            ON CONFLICT (username) DO NOTHING`, username, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type storedUser struct {
+	hash     string
+	disabled bool
+}
+
+// openUsers answers the admin_user queries of Authenticate and Bootstrap
+// from users, applying NOT disabled and ON CONFLICT DO NOTHING itself.
+func openUsers(users map[string]storedUser) (*sql.DB, *fakedb.DB) {
+	return fakedb.Open(
+		fakedb.Rule{Match: "SELECT password_hash FROM admin_user WHERE username = $1 AND NOT disabled", Columns: []string{"password_hash"},
+			Func: func(args []driver.Value) ([][]driver.Value, error) {
+				u, ok := users[args[0].(string)]
+				if !ok || u.disabled {
+					return nil, nil
+				}
+				return [][]driver.Value{{u.hash}}, nil
+			}},
+		fakedb.Rule{Match: "ON CONFLICT (username) DO NOTHING",
+			Func: func(args []driver.Value) ([][]driver.Value, error) {
+				username := args[0].(string)
+				if _, ok := users[username]; !ok {
+					users[username] = storedUser{hash: args[1].(string)}
+				}
+				return nil, nil
+			}},
+	)
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := openUsers(map[string]storedUser{
+		"alice": {hash: hash},
+		"bob":   {hash: hash, disabled: true},
+	})
+
+	testCases := []struct {
+		name     string
+		username string
+		password string
+		expected bool
+	}{
+		{name: "Correct password", username: "alice", password: "correct horse", expected: true},
+		{name: "Wrong password", username: "alice", password: "battery staple"},
+		{name: "Empty password", username: "alice", password: ""},
+		{name: "Disabled user", username: "bob", password: "correct horse"},
+		{name: "Unknown user", username: "mallory", password: "correct horse"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ok, err := Authenticate(db, tc.username, tc.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, ok)
+			}
+		})
+	}
+}
+
+// An unknown user is compared against dummyHash so that rejecting it costs
+// a bcrypt comparison, like a wrong password does.
+func TestAuthenticateUnknownUserUsesDummyHash(t *testing.T) {
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := openUsers(map[string]storedUser{"alice": {hash: hash}})
+	if cost, err := bcrypt.Cost(dummyHash); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("Expected dummyHash to use the default cost, got %d (%v)", cost, err)
+	}
+
+	elapsed := func(username string) time.Duration {
+		start := time.Now()
+		if _, err := Authenticate(db, username, "battery staple"); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(start)
+	}
+	wrongPassword := elapsed("alice")
+	unknownUser := elapsed("mallory")
+	if unknownUser < wrongPassword/4 {
+		t.Errorf("Expected an unknown user to take about as long as a wrong password, got %v and %v", unknownUser, wrongPassword)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	users := map[string]storedUser{}
+	db, f := openUsers(users)
+
+	if err := Bootstrap(db, map[string]string{"alice": "first password", "": "no name", "bob": ""}); err != nil {
+		t.Fatal(err)
+	}
+	first := users["alice"].hash
+	if err := Bootstrap(db, map[string]string{"alice": "second password"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 1 {
+		t.Errorf("Expected only alice to be created, got %d users", len(users))
+	}
+	if users["alice"].hash != first {
+		t.Error("Expected a second bootstrap to keep the existing password")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(first), []byte("first password")) != nil {
+		t.Error("Expected alice to keep the first password")
+	}
+	for _, call := range f.Calls("INSERT INTO admin_user") {
+		if !strings.Contains(call.Query, "'bootstrap'") {
+			t.Errorf("Expected bootstrapped users to be created by bootstrap, got %q", call.Query)
+		}
+	}
+}
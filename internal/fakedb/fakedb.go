@@ -0,0 +1,157 @@
+// Package fakedb is a database/sql driver for handler tests. It answers each
+// statement from the first rule whose Match is part of the query, so tests
+// can run without PostgreSQL.
+package fakedb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Rule answers the statements that contain Match. Rows is returned as is,
+// or Func is called with the arguments when it is set. Columns only needs
+// setting when a query can return no rows. Exec reports one row
+// affected per returned row, or one when the rule returns none.
+type Rule struct {
+	Match   string
+	Columns []string
+	Rows    [][]driver.Value
+	Func    func(args []driver.Value) ([][]driver.Value, error)
+	Err     error
+}
+
+// Call is one statement run against the database.
+type Call struct {
+	Query string
+	Args  []driver.Value
+}
+
+// DB records every statement. Exec statements without a rule succeed;
+// queries without a rule fail, so a missing rule shows up in the test.
+type DB struct {
+	mu    sync.Mutex
+	rules []Rule
+	calls []Call
+}
+
+// Open returns a *sql.DB backed by rules and the DB that records its calls.
+func Open(rules ...Rule) (*sql.DB, *DB) {
+	f := &DB{rules: rules}
+	return sql.OpenDB(f), f
+}
+
+// Calls returns the statements run so far that contain match.
+func (f *DB) Calls(match string) []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []Call
+	for _, call := range f.calls {
+		if strings.Contains(call.Query, match) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (f *DB) Connect(context.Context) (driver.Conn, error) { return conn{f}, nil }
+
+func (f *DB) Driver() driver.Driver { return fakeDriver{f} }
+
+func (f *DB) run(query string, args []driver.Value) (*Rule, [][]driver.Value, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, Call{Query: query, Args: args})
+	var rule *Rule
+	for i := range f.rules {
+		if strings.Contains(query, f.rules[i].Match) {
+			rule = &f.rules[i]
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	if rule == nil {
+		return nil, nil, nil
+	}
+	if rule.Err != nil {
+		return rule, nil, rule.Err
+	}
+	if rule.Func != nil {
+		rows, err := rule.Func(args)
+		return rule, rows, err
+	}
+	return rule, rule.Rows, nil
+}
+
+type fakeDriver struct{ f *DB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return conn{d.f}, nil }
+
+type conn struct{ f *DB }
+
+func (c conn) Prepare(query string) (driver.Stmt, error) { return stmt{c.f, query}, nil }
+func (c conn) Close() error                              { return nil }
+func (c conn) Begin() (driver.Tx, error)                 { return tx{}, nil }
+
+// BeginTx accepts any isolation level and read-only transactions; the fake
+// has no concurrency to isolate.
+func (c conn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) { return tx{}, nil }
+
+type tx struct{}
+
+func (tx) Commit() error   { return nil }
+func (tx) Rollback() error { return nil }
+
+type stmt struct {
+	f     *DB
+	query string
+}
+
+func (s stmt) Close() error  { return nil }
+func (s stmt) NumInput() int { return -1 }
+
+func (s stmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, rows, err := s.f.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(max(len(rows), 1)), nil
+}
+
+func (s stmt) Query(args []driver.Value) (driver.Rows, error) {
+	rule, values, err := s.f.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	if rule == nil {
+		return nil, fmt.Errorf("fakedb: no rule for query %q", s.query)
+	}
+	columns := rule.Columns
+	if columns == nil && len(values) > 0 {
+		for i := range values[0] {
+			columns = append(columns, fmt.Sprintf("column%d", i))
+		}
+	}
+	return &rows{columns: columns, values: values}, nil
+}
+
+type rows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *rows) Columns() []string { return r.columns }
+func (r *rows) Close() error      { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -15,6 +16,7 @@ import (
 	_ "github.com/lib/pq"
 
 	"github.com/Ter4798/post-test-kbtg/admin"
+	"github.com/Ter4798/post-test-kbtg/audit"
 	"github.com/Ter4798/post-test-kbtg/tax"
 	"github.com/labstack/echo/v4"
 )
@@ -30,13 +32,253 @@ func main() {
 	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS taxdeduction (
         id SERIAL PRIMARY KEY,
         name TEXT NOT NULL,
-        amount FLOAT8 NOT NULL
+        amount NUMERIC(15,2) NOT NULL
     )`)
 	if err != nil {
 		panic(err)
 	}
 
+	_, err = db.Exec(`ALTER TABLE taxdeduction ADD COLUMN IF NOT EXISTS tax_year INT NOT NULL DEFAULT 2567`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE taxdeduction ALTER COLUMN amount TYPE NUMERIC(15,2)`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE taxdeduction
+        ADD COLUMN IF NOT EXISTS multiplier NUMERIC(7,4),
+        ADD COLUMN IF NOT EXISTS income_rate NUMERIC(7,4)`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE taxdeduction
+        ADD COLUMN IF NOT EXISTS min_amount NUMERIC(15,2),
+        ADD COLUMN IF NOT EXISTS max_amount NUMERIC(15,2)`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE taxdeduction
+        ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1,
+        ADD COLUMN IF NOT EXISTS deleted BOOLEAN NOT NULL DEFAULT false,
+        ADD COLUMN IF NOT EXISTS effective_from TIMESTAMPTZ NOT NULL DEFAULT 'epoch',
+        ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()`)
+	if err != nil {
+		panic(err)
+	}
+
+	// Rows written before versioning all default to version 1; number them in
+	// insert order so each setting has one row per version.
+	_, err = db.Exec(`UPDATE taxdeduction t SET version = n.version
+        FROM (SELECT id, row_number() OVER (PARTITION BY name, tax_year ORDER BY version, id) AS version FROM taxdeduction) n
+        WHERE t.id = n.id AND (t.name, t.tax_year) IN (
+            SELECT name, tax_year FROM taxdeduction GROUP BY name, tax_year, version HAVING count(*) > 1)`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS taxdeduction_version_key ON taxdeduction (name, tax_year, version)`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS taxbracket (
+        id SERIAL PRIMARY KEY,
+        lower_bound NUMERIC(15,2) NOT NULL,
+        upper_bound NUMERIC(15,2),
+        rate NUMERIC(5,4) NOT NULL,
+        label TEXT NOT NULL
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE taxbracket ADD COLUMN IF NOT EXISTS tax_year INT NOT NULL DEFAULT 2567`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE taxbracket
+        ALTER COLUMN lower_bound TYPE NUMERIC(15,2),
+        ALTER COLUMN upper_bound TYPE NUMERIC(15,2),
+        ALTER COLUMN rate TYPE NUMERIC(5,4)`)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := tax.SeedTaxBrackets(db); err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS taxrounding (
+        tax_year INT NOT NULL,
+        step TEXT NOT NULL,
+        mode TEXT NOT NULL,
+        PRIMARY KEY (tax_year, step)
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS audit_log (
+        id BIGSERIAL PRIMARY KEY,
+        actor TEXT NOT NULL,
+        action TEXT NOT NULL,
+        resource_type TEXT NOT NULL,
+        resource_id TEXT NOT NULL,
+        old_value JSONB,
+        new_value JSONB,
+        client_ip TEXT NOT NULL,
+        request_id TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+    BEGIN
+        RAISE EXCEPTION 'audit_log is append-only';
+    END;
+    $$ LANGUAGE plpgsql`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE OR REPLACE TRIGGER audit_log_append_only
+        BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+        FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS deduction_proposal (
+        id BIGSERIAL PRIMARY KEY,
+        kind TEXT NOT NULL,
+        allowance_type TEXT NOT NULL,
+        tax_year INT NOT NULL,
+        payload JSONB NOT NULL,
+        status TEXT NOT NULL,
+        proposed_by TEXT NOT NULL,
+        proposed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        expires_at TIMESTAMPTZ NOT NULL,
+        decided_by TEXT,
+        decided_at TIMESTAMPTZ,
+        reason TEXT,
+        applied_version INT
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE deduction_proposal ADD COLUMN IF NOT EXISTS base_version INT`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sample_taxpayer (
+        id SERIAL PRIMARY KEY,
+        request JSONB NOT NULL
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS admin_user (
+        username TEXT PRIMARY KEY,
+        password_hash TEXT NOT NULL,
+        disabled BOOLEAN NOT NULL DEFAULT false,
+        created_by TEXT NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+        updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE admin_user ADD COLUMN IF NOT EXISTS tokens_revoked_at TIMESTAMPTZ`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE admin_user ADD COLUMN IF NOT EXISTS password_reset_by TEXT`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS proposal_password (
+        proposal_id BIGINT PRIMARY KEY REFERENCES deduction_proposal (id),
+        password_hash TEXT NOT NULL
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS signing_key (
+        kid TEXT PRIMARY KEY,
+        private_key BYTEA NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp(),
+        retired_at TIMESTAMPTZ
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE signing_key ADD COLUMN IF NOT EXISTS encrypted BOOLEAN NOT NULL DEFAULT false`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS refresh_token (
+        id BIGSERIAL PRIMARY KEY,
+        token_hash TEXT NOT NULL UNIQUE,
+        username TEXT NOT NULL REFERENCES admin_user (username),
+        expires_at TIMESTAMPTZ NOT NULL,
+        revoked_at TIMESTAMPTZ,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE refresh_token ADD COLUMN IF NOT EXISTS revoke_reason TEXT`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`ALTER TABLE refresh_token ADD COLUMN IF NOT EXISTS access_jti TEXT`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS refresh_token_access_jti_idx ON refresh_token (access_jti)`)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS revoked_token (
+        jti TEXT PRIMARY KEY,
+        expires_at TIMESTAMPTZ NOT NULL
+    )`)
+	if err != nil {
+		panic(err)
+	}
+
+	adminUsers := auth.ParseUsers(os.Getenv("ADMIN_USERS"))
+	adminUsers[os.Getenv("ADMIN_USERNAME")] = os.Getenv("ADMIN_PASSWORD")
+	if err := auth.Bootstrap(db, adminUsers); err != nil {
+		panic(err)
+	}
+
 	e := echo.New()
+	// The server is reached directly; behind a proxy, switch to
+	// echo.ExtractIPFromXFFHeader with that proxy as a trust option.
+	e.IPExtractor = echo.ExtractIPDirect()
+	e.Use(audit.RequestID())
 	port := fmt.Sprintf(":%s", os.Getenv("PORT"))
 
 	e.POST("/tax/calculations", func(c echo.Context) error {
@@ -50,27 +292,100 @@ func main() {
 			return echo.NewHTTPError(http.StatusBadRequest, err)
 		}
 
-		t, taxRefund, taxLevels, err := tax.CalculateTax(db, req.TotalIncome, req.WHT, req.Allowances)
+		req.Explain = c.QueryParam("explain") == "true"
+
+		resp, err := tax.CalculateTax(db, *req)
+		if errors.Is(err, tax.ErrUnsupportedTaxYear) {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err)
 		}
-		resp := &tax.Response{
-			Tax:       t,
-			TaxLevels: taxLevels,
-		}
-		if taxRefund > 0 {
-			resp.TaxRefund = taxRefund
-		}
 
 		return c.JSON(http.StatusOK, resp)
 	})
 
-	e.POST("/admin/deductions/personal", admin.UpdatePersonalAllowance(db), auth.BasicAuth(os.Getenv("ADMIN_USERNAME"), os.Getenv("ADMIN_PASSWORD")))
+	accessTTL := 15 * time.Minute
+	if v := os.Getenv("ACCESS_TOKEN_TTL"); v != "" {
+		accessTTL, err = time.ParseDuration(v)
+		if err != nil {
+			panic(err)
+		}
+	}
+	refreshTTL := 7 * 24 * time.Hour
+	if v := os.Getenv("REFRESH_TOKEN_TTL"); v != "" {
+		refreshTTL, err = time.ParseDuration(v)
+		if err != nil {
+			panic(err)
+		}
+	}
+	keys, err := auth.LoadKeySet(db, []byte(os.Getenv("SIGNING_KEY_SECRET")))
+	if err != nil {
+		panic(err)
+	}
+	tokens := auth.NewTokenIssuer(db, keys, accessTTL, refreshTTL)
+
+	e.POST("/auth/login", auth.Login(tokens))
+	e.POST("/auth/refresh", auth.Refresh(tokens))
+	e.POST("/auth/logout", auth.Logout(tokens))
+	e.GET("/.well-known/jwks.json", auth.JWKS(keys))
+
+	a := e.Group("/admin", auth.TokenAuth(tokens, auth.BasicAuthDB(db)))
+
+	proposalExpiry := 72 * time.Hour
+	if v := os.Getenv("PROPOSAL_EXPIRY"); v != "" {
+		proposalExpiry, err = time.ParseDuration(v)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	a.GET("/deductions", admin.ListDeductions(db))
+	a.GET("/deductions/:type", admin.GetDeduction(db))
+	a.PUT("/deductions/:type", admin.UpdateDeduction(db, proposalExpiry))
+	a.POST("/deductions/:type", admin.UpdateDeduction(db, proposalExpiry))
+	a.DELETE("/deductions/:type", admin.DeleteDeduction(db, proposalExpiry))
+	a.GET("/deductions/:type/history", admin.GetDeductionHistory(db))
+	a.POST("/deductions/:type/rollback", admin.RollbackDeduction(db, proposalExpiry))
+	a.POST("/deductions/:type/preview", admin.PreviewDeduction(db))
 
-	e.POST("/admin/deductions/k-receipt", admin.UpdateKReceiptAllowance(db), auth.BasicAuth(os.Getenv("ADMIN_USERNAME"), os.Getenv("ADMIN_PASSWORD")))
+	a.GET("/rounding", admin.GetRounding(db))
+	a.PUT("/rounding", admin.UpdateRounding(db, proposalExpiry))
+
+	a.GET("/samples", admin.ListSamples(db))
+	a.PUT("/samples", admin.ReplaceSamples(db))
+
+	a.GET("/proposals", admin.ListProposals(db))
+	a.GET("/proposals/:id", admin.GetProposal(db))
+	a.POST("/proposals/:id/approve", admin.ApproveProposal(db))
+	a.POST("/proposals/:id/reject", admin.RejectProposal(db))
+
+	configKey := []byte(os.Getenv("CONFIG_SIGNING_KEY"))
+	a.GET("/config/export", admin.ExportConfig(db, configKey))
+	a.POST("/config/import", admin.ImportConfig(db, configKey, proposalExpiry))
+
+	a.GET("/users", admin.ListUsers(db))
+	a.POST("/users", admin.CreateUser(db, proposalExpiry))
+	a.PUT("/users/:username/password", admin.ChangePassword(db))
+	a.POST("/users/:username/password-reset", admin.ResetPassword(db, proposalExpiry))
+	a.POST("/users/:username/disable", admin.DisableUser(db))
+	a.POST("/users/:username/enable", admin.EnableUser(db, proposalExpiry))
+	a.POST("/users/:username/revoke-tokens", admin.RevokeTokens(db))
+
+	a.POST("/keys/rotate", admin.RotateSigningKey(db, keys))
+
+	a.GET("/audit", audit.HandleQuery(db))
 
 	e.POST("/tax/calculations/upload-csv", tax.HandlePersonalCalculationsCSV(db))
 
+	e.POST("/tax/planning", tax.HandlePlanning(db))
+
+	e.POST("/tax/scenarios", tax.HandleScenarios(db))
+
+	e.POST("/tax/payroll", tax.HandlePayroll(db))
+
+	e.POST("/tax/payroll/batch", tax.HandlePayrollBatch(db))
+
 	go func() {
 		if err := e.Start(port); err != nil && err != http.ErrServerClosed {
 			e.Logger.Fatal("ListenAndServe error: ", err)
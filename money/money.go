@@ -0,0 +1,300 @@
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in satang, so every value is an exact number of Baht
+// with two decimal places.
+type Money int64
+
+const (
+	Satang Money = 1
+	Baht   Money = 100
+)
+
+type RoundingMode int
+
+const (
+	HalfUp RoundingMode = iota
+	HalfEven
+	Down
+	Up
+)
+
+var roundingModeNames = map[RoundingMode]string{
+	HalfUp:   "halfUp",
+	HalfEven: "halfEven",
+	Down:     "down",
+	Up:       "up",
+}
+
+func (m RoundingMode) String() string {
+	if name, ok := roundingModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("RoundingMode(%d)", int(m))
+}
+
+// ParseRoundingMode reads the names returned by String, such as "halfUp".
+func ParseRoundingMode(s string) (RoundingMode, error) {
+	for mode, name := range roundingModeNames {
+		if name == s {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rounding mode %q", s)
+}
+
+// maxDecimalLength and maxExponent bound the decimals parseScaled accepts.
+const (
+	maxDecimalLength = 64
+	maxExponent      = 20
+)
+
+var (
+	errInvalidDecimal  = errors.New("invalid decimal value")
+	errTooManyDecimals = errors.New("decimal value has too many decimal places")
+	errOutOfRange      = errors.New("decimal value is out of range")
+)
+
+func New(baht int64) Money {
+	return Money(baht) * Baht
+}
+
+func Parse(s string) (Money, error) {
+	v, err := parseScaled(s, int64(Baht))
+	if err != nil {
+		return 0, err
+	}
+	return Money(v), nil
+}
+
+func MustParse(s string) Money {
+	m, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func Min(a, b Money) Money {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func Max(a, b Money) Money {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (m Money) MulRate(r Rate, mode RoundingMode) Money {
+	return Money(mulDiv(int64(m), int64(r), rateScale, mode))
+}
+
+// MulRatio returns m * num / den, rounding once at the end.
+func (m Money) MulRatio(num, den Rate, mode RoundingMode) Money {
+	return Money(mulDiv(int64(m), int64(num), int64(den), mode))
+}
+
+func (m Money) Mul(n int64) Money {
+	return m * Money(n)
+}
+
+func (m Money) Div(n int64, mode RoundingMode) Money {
+	return Money(mulDiv(int64(m), 1, n, mode))
+}
+
+// Baht returns the whole-Baht part of m.
+func (m Money) Baht() int64 {
+	return int64(m / Baht)
+}
+
+func (m Money) String() string {
+	sign := ""
+	v := int64(m)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, v/100, v%100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	v, err := parseJSONNumber(b)
+	if err != nil {
+		return err
+	}
+	parsed, err := Parse(v)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func (m *Money) Scan(src interface{}) error {
+	v, err := scanString(src)
+	if err != nil {
+		return err
+	}
+	parsed, err := Parse(v)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// parseScaled reads a plain decimal such as "-1234.5" or "1.5e3" and returns
+// it multiplied by scale, a power of ten. Only a sign, digits, one decimal
+// point and a small exponent are accepted, so a hostile input cannot make
+// parsing expensive.
+func parseScaled(s string, scale int64) (int64, error) {
+	if s == "" || len(s) > maxDecimalLength {
+		return 0, errInvalidDecimal
+	}
+	negative := s[0] == '-'
+	if s[0] == '-' || s[0] == '+' {
+		s = s[1:]
+	}
+
+	mantissa, exponent := s, 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		e, err := strconv.Atoi(s[i+1:])
+		if err != nil || e < -maxExponent || e > maxExponent {
+			return 0, errInvalidDecimal
+		}
+		mantissa, exponent = s[:i], e
+	}
+	whole, frac, _ := strings.Cut(mantissa, ".")
+	if whole == "" && frac == "" || !isDigits(whole) || !isDigits(frac) {
+		return 0, errInvalidDecimal
+	}
+
+	places := 0
+	for p := scale; p > 1; p /= 10 {
+		places++
+	}
+	digits := strings.TrimLeft(whole+frac, "0")
+	if shift := exponent - len(frac) + places; shift >= 0 {
+		if digits != "" {
+			digits += strings.Repeat("0", shift)
+		}
+	} else {
+		keep := max(len(digits)+shift, 0)
+		if strings.Trim(digits[keep:], "0") != "" {
+			return 0, errTooManyDecimals
+		}
+		digits = digits[:keep]
+	}
+	if digits == "" {
+		return 0, nil
+	}
+
+	v, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, errOutOfRange
+	}
+	if negative {
+		v = -v
+	}
+	return v, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseJSONNumber(b []byte) (string, error) {
+	s := string(b)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		unquoted, err := strconv.Unquote(s)
+		if err != nil {
+			return "", errInvalidDecimal
+		}
+		s = unquoted
+	}
+	return s, nil
+}
+
+func scanString(src interface{}) (string, error) {
+	switch v := src.(type) {
+	case []byte:
+		return string(v), nil
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("cannot scan %T into a decimal", src)
+	}
+}
+
+// mulDiv returns a*b/c rounded with mode, computed without intermediate
+// overflow.
+func mulDiv(a, b, c int64, mode RoundingMode) int64 {
+	num := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+	den := big.NewInt(c)
+	if den.Sign() < 0 {
+		num.Neg(num)
+		den.Neg(den)
+	}
+
+	q, r := new(big.Int).QuoRem(num, den, new(big.Int))
+	if r.Sign() == 0 {
+		return q.Int64()
+	}
+
+	away := false
+	switch mode {
+	case Down:
+		away = false
+	case Up:
+		away = true
+	case HalfUp, HalfEven:
+		cmp := new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(den)
+		switch {
+		case cmp > 0:
+			away = true
+		case cmp == 0:
+			away = mode == HalfUp || q.Bit(0) == 1
+		}
+	}
+
+	if away {
+		if num.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q.Int64()
+}
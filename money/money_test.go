@@ -0,0 +1,144 @@
+package money
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		input     string
+		want      Money
+		expectErr bool
+	}{
+		{"0", 0, false},
+		{"500000", New(500000), false},
+		{"500000.0", New(500000), false},
+		{"149999.99", Money(14999999), false},
+		{"-12.5", Money(-1250), false},
+		{"1e5", New(100000), false},
+		{"0.001", 0, true},
+		{"abc", 0, true},
+		{"", 0, true},
+		{"+7", New(7), false},
+		{".5", MustParse("0.50"), false},
+		{"1.5E3", New(1500), false},
+		{"12345e-2", MustParse("123.45"), false},
+		{"0.500000", MustParse("0.50"), false},
+		{"-0", 0, false},
+		{"1e-3", 0, true},
+		{"1/4", 0, true},
+		{"1e1000000", 0, true},
+		{"1e21", 0, true},
+		{"99999999999999999999", 0, true},
+		{strings.Repeat("0", 65), 0, true},
+		{"0x10", 0, true},
+		{"1_000", 0, true},
+		{"Inf", 0, true},
+		{"NaN", 0, true},
+		{".", 0, true},
+		{"-", 0, true},
+		{"e5", 0, true},
+		{"1e", 0, true},
+		{"1.2.3", 0, true},
+		{"--1", 0, true},
+		{" 1", 0, true},
+	}
+
+	for _, tc := range testCases {
+		got, err := Parse(tc.input)
+		if (err != nil) != tc.expectErr {
+			t.Errorf("Parse(%q) returned error %v, expected error: %v", tc.input, err, tc.expectErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Parse(%q) returned %v, expected %v", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestMulRate(t *testing.T) {
+	testCases := []struct {
+		amount Money
+		rate   Rate
+		mode   RoundingMode
+		want   Money
+	}{
+		{MustParse("349999.99"), 10 * Percent, HalfUp, New(35000)},
+		{MustParse("349999.99"), 10 * Percent, Down, MustParse("34999.99")},
+		{MustParse("0.05"), 10 * Percent, HalfUp, MustParse("0.01")},
+		{MustParse("0.05"), 10 * Percent, HalfEven, 0},
+		{MustParse("0.15"), 10 * Percent, HalfEven, MustParse("0.02")},
+		{MustParse("0.01"), 10 * Percent, Up, MustParse("0.01")},
+		{MustParse("-0.05"), 10 * Percent, HalfUp, MustParse("-0.01")},
+		{New(500000), 15 * Percent, HalfUp, New(75000)},
+	}
+
+	for _, tc := range testCases {
+		got := tc.amount.MulRate(tc.rate, tc.mode)
+		if got != tc.want {
+			t.Errorf("%v.MulRate(%v, %v) returned %v, expected %v", tc.amount, tc.rate, tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestDiv(t *testing.T) {
+	if got := New(100).Div(3, HalfUp); got != MustParse("33.33") {
+		t.Errorf("Div returned %v, expected 33.33", got)
+	}
+	if got := New(200).Div(3, HalfUp); got != MustParse("66.67") {
+		t.Errorf("Div returned %v, expected 66.67", got)
+	}
+	if got := New(200).Div(3, Down); got != MustParse("66.66") {
+		t.Errorf("Div returned %v, expected 66.66", got)
+	}
+}
+
+func TestParseRoundingMode(t *testing.T) {
+	for _, mode := range []RoundingMode{HalfUp, HalfEven, Down, Up} {
+		if got, err := ParseRoundingMode(mode.String()); err != nil || got != mode {
+			t.Errorf("ParseRoundingMode(%q) returned %v, %v", mode.String(), got, err)
+		}
+	}
+	if _, err := ParseRoundingMode("nearest"); err == nil {
+		t.Errorf("Expected an error for an unknown mode")
+	}
+}
+
+func TestRateOf(t *testing.T) {
+	if got := RateOf(New(29000), New(500000), HalfUp); got != MustParseRate("0.058") {
+		t.Errorf("RateOf returned %v, expected 0.058", got)
+	}
+	if got := RateOf(New(1), New(3), HalfUp); got != MustParseRate("0.3333") {
+		t.Errorf("RateOf returned %v, expected 0.3333", got)
+	}
+	if got := RateOf(New(1), 0, HalfUp); got != 0 {
+		t.Errorf("RateOf returned %v, expected 0", got)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Amount Money `json:"amount"`
+		Rate   Rate  `json:"rate"`
+	}
+	if err := json.Unmarshal([]byte(`{"amount": 29000.5, "rate": 0.15}`), &v); err != nil {
+		t.Fatalf("Unmarshal returned error %v", err)
+	}
+	if v.Amount != MustParse("29000.50") || v.Rate != 15*Percent {
+		t.Errorf("Unmarshal returned %v, %v", v.Amount, v.Rate)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Marshal returned error %v", err)
+	}
+	if string(b) != `{"amount":29000.50,"rate":0.15}` {
+		t.Errorf("Marshal returned %s", b)
+	}
+
+	if err := json.Unmarshal([]byte(`{"amount": 0.001}`), &v); err == nil {
+		t.Errorf("Unmarshal accepted an amount with more than two decimal places")
+	}
+}
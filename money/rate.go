@@ -0,0 +1,89 @@
+package money
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+const rateScale = 10000
+
+// Rate is a fraction with four decimal places, so 0.15 is Rate(1500).
+type Rate int64
+
+const Percent Rate = 100
+
+func ParseRate(s string) (Rate, error) {
+	v, err := parseScaled(s, rateScale)
+	if err != nil {
+		return 0, err
+	}
+	return Rate(v), nil
+}
+
+func MustParseRate(s string) Rate {
+	r, err := ParseRate(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// RateOf returns part as a fraction of whole, or zero when whole is zero.
+func RateOf(part, whole Money, mode RoundingMode) Rate {
+	if whole == 0 {
+		return 0
+	}
+	return Rate(mulDiv(int64(part), rateScale, int64(whole), mode))
+}
+
+func (r Rate) String() string {
+	sign := ""
+	v := int64(r)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	frac := strings.TrimRight(fmt.Sprintf("%04d", v%rateScale), "0")
+	if frac == "" {
+		return fmt.Sprintf("%s%d", sign, v/rateScale)
+	}
+	return fmt.Sprintf("%s%d.%s", sign, v/rateScale, frac)
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (r *Rate) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	v, err := parseJSONNumber(b)
+	if err != nil {
+		return err
+	}
+	parsed, err := ParseRate(v)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r *Rate) Scan(src interface{}) error {
+	v, err := scanString(src)
+	if err != nil {
+		return err
+	}
+	parsed, err := ParseRate(v)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r Rate) Value() (driver.Value, error) {
+	return r.String(), nil
+}
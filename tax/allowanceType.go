@@ -0,0 +1,225 @@
+package tax
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+// AllowanceType describes one kind of deduction. Types without a Claim
+// function are claimed through Request.Allowances; the others are derived
+// from the rest of the request. Types are applied in ascending Order, so a
+// type with a higher Order sees the income left after the earlier ones.
+// Multiplier and IncomeRate settings are only configurable when the type
+// declares a maximum for them.
+type AllowanceType struct {
+	Name              string
+	SettingName       string
+	Order             int
+	DefaultLimit      money.Money
+	MinLimit          money.Money
+	MaxLimit          money.Money
+	DefaultMultiplier money.Rate
+	MaxMultiplier     money.Rate
+	DefaultIncomeRate money.Rate
+	MaxIncomeRate     money.Rate
+	Validate          func(Allowance) error
+	Claim             func(req Request, c CapContext) money.Money
+	Cap               CapRule
+}
+
+// CapContext carries what a cap rule may depend on. Income is the gross
+// assessable income and NetIncome what is left after expenses and the
+// allowances applied before this one.
+type CapContext struct {
+	TaxYear    int
+	Limit      money.Money
+	Income     money.Money
+	NetIncome  money.Money
+	IncomeRate money.Rate
+	Rounding   money.RoundingMode
+}
+
+// CapRule returns the most that may be deducted for a type, or false when the
+// claimed amount is deducted in full.
+type CapRule func(c CapContext) (money.Money, bool)
+
+var (
+	allowanceTypes     []AllowanceType
+	allowanceTypeIndex = make(map[string]int)
+)
+
+func RegisterAllowanceType(t AllowanceType) {
+	if _, ok := allowanceTypeIndex[t.Name]; ok {
+		panic(fmt.Sprintf("tax: allowance type %q registered twice", t.Name))
+	}
+	if t.Validate == nil {
+		t.Validate = validateNonNegative
+	}
+	if t.Cap == nil {
+		t.Cap = capAtLimit
+	}
+	if t.DefaultMultiplier == 0 {
+		t.DefaultMultiplier = 100 * money.Percent
+	}
+	allowanceTypeIndex[t.Name] = len(allowanceTypes)
+	allowanceTypes = append(allowanceTypes, t)
+}
+
+func LookupAllowanceType(name string) (AllowanceType, bool) {
+	i, ok := allowanceTypeIndex[name]
+	if !ok {
+		return AllowanceType{}, false
+	}
+	return allowanceTypes[i], true
+}
+
+func AllowanceTypes() []AllowanceType {
+	return append([]AllowanceType(nil), allowanceTypes...)
+}
+
+func orderedAllowanceTypes() []AllowanceType {
+	types := AllowanceTypes()
+	sort.SliceStable(types, func(i, j int) bool {
+		return types[i].Order < types[j].Order
+	})
+	return types
+}
+
+func (t AllowanceType) Claimable() bool {
+	return t.Claim == nil
+}
+
+func claimableAllowanceTypeNames() []string {
+	var names []string
+	for _, t := range allowanceTypes {
+		if t.Claimable() {
+			names = append(names, t.Name)
+		}
+	}
+	return names
+}
+
+func validateNonNegative(a Allowance) error {
+	if a.Amount < 0 {
+		return errors.New("invalid allowance amount must be greater than 0")
+	}
+	return nil
+}
+
+func capAtLimit(c CapContext) (money.Money, bool) {
+	return c.Limit, true
+}
+
+// capClaimed is used by derived types whose Claim already applies the limit
+// per person.
+func capClaimed(c CapContext) (money.Money, bool) {
+	return 0, false
+}
+
+func capAtIncomeRate(rate money.Rate) CapRule {
+	return func(c CapContext) (money.Money, bool) {
+		return money.Min(c.Limit, c.Income.MulRate(rate, c.Rounding)), true
+	}
+}
+
+func capAtNetIncomeRate(c CapContext) (money.Money, bool) {
+	if c.NetIncome <= 0 {
+		return 0, true
+	}
+	return money.Min(c.Limit, c.NetIncome.MulRate(c.IncomeRate, c.Rounding)), true
+}
+
+func claimLimit(req Request, c CapContext) money.Money {
+	return c.Limit
+}
+
+func init() {
+	RegisterAllowanceType(AllowanceType{
+		Name:         "personal",
+		SettingName:  "personalAllowance",
+		DefaultLimit: money.New(60000),
+		MinLimit:     money.New(10000),
+		MaxLimit:     money.New(100000),
+		Claim:        claimLimit,
+	})
+	// Education, sport and public hospital donations are deducted at twice
+	// the amount and come before general donations, which are capped on the
+	// income left after them.
+	RegisterAllowanceType(AllowanceType{
+		Name:              "donation-education",
+		SettingName:       "donationEducationAllowance",
+		Order:             1,
+		DefaultLimit:      money.New(100000),
+		MaxLimit:          money.New(1000000),
+		DefaultMultiplier: 200 * money.Percent,
+		MaxMultiplier:     300 * money.Percent,
+		DefaultIncomeRate: 10 * money.Percent,
+		MaxIncomeRate:     100 * money.Percent,
+		Cap:               capAtNetIncomeRate,
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:              "donation",
+		SettingName:       "donationAllowance",
+		Order:             2,
+		DefaultLimit:      money.New(100000),
+		MaxLimit:          money.New(1000000),
+		MaxMultiplier:     300 * money.Percent,
+		DefaultIncomeRate: 10 * money.Percent,
+		MaxIncomeRate:     100 * money.Percent,
+		Cap:               capAtNetIncomeRate,
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "k-receipt",
+		SettingName:  "kReceiptAllowance",
+		DefaultLimit: money.New(50000),
+		MaxLimit:     money.New(100000),
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "life-insurance",
+		SettingName:  "lifeInsuranceAllowance",
+		DefaultLimit: money.New(100000),
+		MaxLimit:     money.New(100000),
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "health-insurance",
+		SettingName:  "healthInsuranceAllowance",
+		DefaultLimit: money.New(25000),
+		MaxLimit:     money.New(25000),
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "ssf",
+		SettingName:  "ssfAllowance",
+		DefaultLimit: money.New(200000),
+		MaxLimit:     money.New(200000),
+		Cap:          capAtIncomeRate(30 * money.Percent),
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "rmf",
+		SettingName:  "rmfAllowance",
+		DefaultLimit: money.New(500000),
+		MaxLimit:     money.New(500000),
+		Cap:          capAtIncomeRate(30 * money.Percent),
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "provident-fund",
+		SettingName:  "providentFundAllowance",
+		DefaultLimit: money.New(500000),
+		MaxLimit:     money.New(500000),
+		Cap:          capAtIncomeRate(15 * money.Percent),
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "social-security",
+		SettingName:  "socialSecurityAllowance",
+		DefaultLimit: money.New(9000),
+		MaxLimit:     money.New(15000),
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "home-loan-interest",
+		SettingName:  "homeLoanInterestAllowance",
+		DefaultLimit: money.New(100000),
+		MaxLimit:     money.New(100000),
+	})
+}
@@ -2,54 +2,80 @@ package tax
 
 import (
 	"database/sql"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/money"
 )
 
-func calculateDeductions(allowances []Allowance, maxDonation float64, maxKReceipt float64) float64 {
-	var totalDeduction float64
-
-	for _, allowance := range allowances {
-		switch allowance.AllowanceType {
-		case "donation":
-			deduction := allowance.Amount
-			if deduction > maxDonation {
-				deduction = maxDonation
-			}
-			totalDeduction += deduction
-		case "k-receipt":
-			deduction := allowance.Amount
-			if deduction > maxKReceipt {
-				deduction = maxKReceipt
-			}
-			totalDeduction += deduction
+func calculateDeductions(req Request, rules TaxRules, netIncome money.Money) ([]AllowanceStep, money.Money) {
+	claimed := make(map[string]money.Money)
+	for _, allowance := range req.Allowances {
+		claimed[allowance.AllowanceType] += allowance.Amount
+	}
+
+	var steps []AllowanceStep
+	var totalDeduction money.Money
+	for _, t := range orderedAllowanceTypes() {
+		c := CapContext{
+			TaxYear:    rules.TaxYear,
+			Limit:      rules.Limit(t),
+			Income:     req.grossIncome(),
+			NetIncome:  netIncome - totalDeduction,
+			IncomeRate: rules.IncomeRate(t),
+			Rounding:   rules.Rounding.IncomeCap,
+		}
+
+		amount, ok := claimed[t.Name]
+		if !t.Claimable() {
+			amount = t.Claim(req, c)
+			ok = amount > 0
+		}
+		if !ok {
+			continue
+		}
+
+		step := AllowanceStep{
+			AllowanceType: t.Name,
+			Claimed:       amount,
+			Multiplier:    rules.Multiplier(t),
+			Applied:       amount.MulRate(rules.Multiplier(t), rules.Rounding.Allowance),
 		}
+		if limit, capped := t.Cap(c); capped {
+			step.Cap = &limit
+			step.Applied = money.Min(step.Applied, limit)
+		}
+		steps = append(steps, step)
+		totalDeduction += step.Applied
 	}
-	return totalDeduction
+	return steps, totalDeduction
 }
 
-func calculateTaxableIncome(totalIncome, totalDeduction float64) float64 {
-	return totalIncome - totalDeduction
+func allowanceResults(steps []AllowanceStep) []AllowanceResult {
+	var results []AllowanceResult
+	for _, step := range steps {
+		results = append(results, AllowanceResult{
+			AllowanceType: step.AllowanceType,
+			Claimed:       step.Claimed,
+			Allowed:       step.Applied,
+		})
+	}
+	return results
 }
 
-func calculateGraduatedTax(taxableIncome float64) float64 {
-	var tax float64
+func calculateTaxableIncome(totalIncome, totalDeduction money.Money) money.Money {
+	return totalIncome - totalDeduction
+}
 
-	switch {
-	case taxableIncome <= 150000:
-		tax = 0
-	case taxableIncome <= 500000:
-		tax = 0.1 * (taxableIncome - 150000)
-	case taxableIncome <= 1000000:
-		tax = 35000 + 0.15*(taxableIncome-500000)
-	case taxableIncome <= 2000000:
-		tax = 110000 + 0.2*(taxableIncome-1000000)
-	default:
-		tax = 310000 + 0.35*(taxableIncome-2000000)
+func calculateGraduatedTax(taxableIncome money.Money, brackets []TaxBracket, rounding money.RoundingMode) money.Money {
+	var tax money.Money
+	for _, level := range calculateTaxLevels(taxableIncome, brackets, rounding) {
+		tax += level.Tax
 	}
 	return tax
 }
 
-func calculateNetTaxAndRefund(tax, wht float64) (float64, float64) {
-	taxRefund := 0.0
+func calculateNetTaxAndRefund(tax, wht money.Money) (money.Money, money.Money) {
+	var taxRefund money.Money
 	if tax < wht {
 		taxRefund = wht - tax
 		tax = 0
@@ -60,59 +86,112 @@ func calculateNetTaxAndRefund(tax, wht float64) (float64, float64) {
 	return tax, taxRefund
 }
 
-func calculateTaxLevels(taxableIncome float64) []TaxLevel {
-	taxLevels := []TaxLevel{
-		{"0-150,000", 0.0},
-		{"150,001-500,000", 0.0},
-		{"500,001-1,000,000", 0.0},
-		{"1,000,001-2,000,000", 0.0},
-		{"2,000,001 ขึ้นไป", 0.0},
+func calculateBracketSteps(taxableIncome money.Money, brackets []TaxBracket, rounding money.RoundingMode) []BracketStep {
+	steps := make([]BracketStep, 0, len(brackets))
+	for _, bracket := range brackets {
+		base := bracket.incomeInBracket(taxableIncome)
+		steps = append(steps, BracketStep{
+			Level:      bracket.Label,
+			LowerBound: bracket.LowerBound,
+			UpperBound: bracket.UpperBound,
+			Base:       base,
+			Rate:       bracket.Rate,
+			Tax:        base.MulRate(bracket.Rate, rounding),
+		})
 	}
+	return steps
+}
 
-	switch {
-	case taxableIncome <= 150000:
-		// No tax
-	case taxableIncome <= 500000:
-		taxLevels[1].Tax = 0.1 * (taxableIncome - 150000)
-	case taxableIncome <= 1000000:
-		taxLevels[1].Tax = 35000.0
-		taxLevels[2].Tax = 0.15 * (taxableIncome - 500000)
-	case taxableIncome <= 2000000:
-		taxLevels[1].Tax = 35000.0
-		taxLevels[2].Tax = 75000.0
-		taxLevels[3].Tax = 0.2 * (taxableIncome - 1000000)
-	default:
-		taxLevels[1].Tax = 35000.0
-		taxLevels[2].Tax = 75000.0
-		taxLevels[3].Tax = 200000.0
-		taxLevels[4].Tax = 0.35 * (taxableIncome - 2000000)
+func calculateTaxLevels(taxableIncome money.Money, brackets []TaxBracket, rounding money.RoundingMode) []TaxLevel {
+	taxLevels := make([]TaxLevel, 0, len(brackets))
+	for _, step := range calculateBracketSteps(taxableIncome, brackets, rounding) {
+		taxLevels = append(taxLevels, TaxLevel{
+			Level: step.Level,
+			Tax:   step.Tax,
+		})
 	}
-
 	return taxLevels
 }
 
-func CalculateTax(db *sql.DB, totalIncome float64, wht float64, allowances []Allowance) (float64, float64, []TaxLevel, error) {
-	personalAllowance, err := getPersonalAllowance(db)
-	if err != nil {
-		return 0, 0, nil, err
+func calculate(req Request, rules TaxRules) Response {
+	if req.HalfYear {
+		rules = rules.halfYear()
 	}
 
-	maxKReceipt, err := getKReceiptAllowance(db)
-	if err != nil {
-		return 0, 0, nil, err
+	if len(req.Dividends) == 0 {
+		return assess(req, rules, nil)
+	}
+	final := calculateDividends(req, DividendElectionFinal, rules.Rounding)
+	included := calculateDividends(req, DividendElectionInclude, rules.Rounding)
+	finalResp := assess(req, rules, &final)
+	includedResp := assess(req, rules, &included)
+	return chooseDividendElection(finalResp, includedResp)
+}
+
+func assess(req Request, rules TaxRules, dividend *DividendResult) Response {
+	incomes, netIncome := calculateExpenses(req, rules)
+	expenses := req.grossIncome() - netIncome
+
+	var dividendIncome, dividendCredit money.Money
+	if dividend != nil && dividend.Election == DividendElectionInclude {
+		dividendIncome = dividend.Amount + dividend.TaxCredit
+		dividendCredit = dividend.WithholdingTax + dividend.TaxCredit
 	}
+	grossIncome := req.grossIncome() + dividendIncome
+	netIncome += dividendIncome
+
+	allowanceSteps, totalDeduction := calculateDeductions(req, rules, netIncome)
+
+	taxableIncome := calculateTaxableIncome(netIncome, totalDeduction)
 
-	maxDonation := 100000.0
+	progressiveTax := calculateGraduatedTax(taxableIncome, rules.Brackets, rules.Rounding.TaxLevel)
 
-	totalDeduction := calculateDeductions(allowances, maxDonation, maxKReceipt) + personalAllowance
+	taxLevels := calculateTaxLevels(taxableIncome, rules.Brackets, rules.Rounding.TaxLevel)
 
-	taxableIncome := calculateTaxableIncome(totalIncome, totalDeduction)
+	method := chooseTaxMethod(progressiveTax, calculateMinimumTax(req, rules, dividendIncome))
 
-	tax := calculateGraduatedTax(taxableIncome)
+	netTax, taxRefund := calculateNetTaxAndRefund(method.tax(), req.WHT+req.PrepaidTax+dividendCredit)
 
-	taxLevels := calculateTaxLevels(taxableIncome)
+	resp := Response{
+		TaxYear:    rules.TaxYear,
+		Tax:        netTax,
+		TaxRefund:  taxRefund,
+		TaxLevels:  taxLevels,
+		TaxMethod:  method,
+		Rates:      calculateTaxRates(grossIncome, taxableIncome, method.tax(), rules.Brackets, rules.Rounding.Rate),
+		Incomes:    incomes,
+		Allowances: allowanceResults(allowanceSteps),
+		Dividend:   dividend,
+	}
+
+	if req.Explain {
+		resp.Explanation = &Explanation{
+			ConfigVersion:  rules.Version,
+			GrossIncome:    grossIncome,
+			Expenses:       expenses,
+			NetIncome:      netIncome,
+			Allowances:     allowanceSteps,
+			TotalAllowance: totalDeduction,
+			TaxableIncome:  taxableIncome,
+			Brackets:       calculateBracketSteps(taxableIncome, rules.Brackets, rules.Rounding.TaxLevel),
+			TaxMethod:      method.Applied,
+			GrossTax:       method.tax(),
+			WHT:            req.WHT,
+			PrepaidTax:     req.PrepaidTax,
+			DividendCredit: dividendCredit,
+			NetTax:         netTax,
+			TaxRefund:      taxRefund,
+		}
+	}
 
-	netTax, taxRefund := calculateNetTaxAndRefund(tax, wht)
+	return resp
+}
+
+func CalculateTax(db *sql.DB, req Request) (Response, error) {
+	rules, err := getTaxRules(db, req.TaxYear, time.Now())
+	if err != nil {
+		return Response{}, err
+	}
 
-	return netTax, taxRefund, taxLevels, nil
+	return calculate(req, rules), nil
 }
@@ -0,0 +1,88 @@
+package tax
+
+import (
+	"errors"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+const (
+	DividendElectionFinal   = "final"
+	DividendElectionInclude = "include"
+)
+
+var (
+	dividendWithholdingRate  = 10 * money.Percent
+	defaultCorporateRate     = 20 * money.Percent
+	maxDividendCorporateRate = 50 * money.Percent
+)
+
+// Dividend is a dividend received from a Thai company. CorporateRate is the
+// rate the company paid on the profit behind it and defaults to 20%; use 0
+// for dividends paid from exempt profit, which carry no credit.
+type Dividend struct {
+	Amount        money.Money `json:"amount"`
+	CorporateRate *money.Rate `json:"corporateRate,omitempty"`
+}
+
+// DividendResult compares the two ways dividends can be taxed. With the
+// final election the 10% withheld at source is the end of it; with the
+// include election the dividend plus its tax credit is added to income and
+// both the withholding and the credit are credited against the tax due.
+// FinalTax and IncludedTax are the total tax borne under each election.
+type DividendResult struct {
+	Election       string      `json:"election"`
+	Amount         money.Money `json:"amount"`
+	WithholdingTax money.Money `json:"withholdingTax"`
+	TaxCredit      money.Money `json:"taxCredit"`
+	FinalTax       money.Money `json:"finalTax"`
+	IncludedTax    money.Money `json:"includedTax"`
+}
+
+func (d Dividend) corporateRate() money.Rate {
+	if d.CorporateRate == nil {
+		return defaultCorporateRate
+	}
+	return *d.CorporateRate
+}
+
+// calculateDividends totals the dividends for an election. The credit for
+// each dividend is amount * rate / (1 - rate), so 20% corporate tax gives a
+// credit of a quarter of the dividend.
+func calculateDividends(req Request, election string, rounding RoundingPolicy) DividendResult {
+	result := DividendResult{Election: election}
+	for _, d := range req.Dividends {
+		rate := d.corporateRate()
+		result.Amount += d.Amount
+		result.WithholdingTax += d.Amount.MulRate(dividendWithholdingRate, rounding.DividendWithholding)
+		result.TaxCredit += d.Amount.MulRatio(rate, 100*money.Percent-rate, rounding.DividendCredit)
+	}
+	return result
+}
+
+// chooseDividendElection returns the response with the lower total tax,
+// preferring the final election on a tie since it needs nothing declared.
+func chooseDividendElection(final, included Response) Response {
+	finalTax := final.TaxMethod.tax() + final.Dividend.WithholdingTax
+	includedTax := included.TaxMethod.tax() - included.Dividend.TaxCredit
+
+	chosen := final
+	if includedTax < finalTax {
+		chosen = included
+	}
+	chosen.Dividend.FinalTax = finalTax
+	chosen.Dividend.IncludedTax = includedTax
+	return chosen
+}
+
+func validateDividends(req *Request) error {
+	for _, d := range req.Dividends {
+		if d.Amount < 0 {
+			return errors.New("dividend amount must not be negative")
+		}
+		if rate := d.corporateRate(); rate < 0 || rate > maxDividendCorporateRate {
+			return errors.New("corporateRate must be between 0 and 0.5")
+		}
+	}
+	return nil
+}
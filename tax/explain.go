@@ -0,0 +1,57 @@
+package tax
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+// Explanation lists every step of a calculation so a result can be traced
+// back to the inputs and the configuration it was computed with.
+type Explanation struct {
+	ConfigVersion  string          `json:"configVersion"`
+	GrossIncome    money.Money     `json:"grossIncome"`
+	Expenses       money.Money     `json:"expenses"`
+	NetIncome      money.Money     `json:"netIncome"`
+	Allowances     []AllowanceStep `json:"allowances"`
+	TotalAllowance money.Money     `json:"totalAllowance"`
+	TaxableIncome  money.Money     `json:"taxableIncome"`
+	Brackets       []BracketStep   `json:"brackets"`
+	TaxMethod      string          `json:"taxMethod"`
+	GrossTax       money.Money     `json:"grossTax"`
+	WHT            money.Money     `json:"wht"`
+	PrepaidTax     money.Money     `json:"prepaidTax,omitempty"`
+	DividendCredit money.Money     `json:"dividendCredit,omitempty"`
+	NetTax         money.Money     `json:"netTax"`
+	TaxRefund      money.Money     `json:"taxRefund"`
+}
+
+type AllowanceStep struct {
+	AllowanceType string       `json:"allowanceType"`
+	Claimed       money.Money  `json:"claimed"`
+	Multiplier    money.Rate   `json:"multiplier"`
+	Cap           *money.Money `json:"cap,omitempty"`
+	Applied       money.Money  `json:"applied"`
+}
+
+type BracketStep struct {
+	Level      string      `json:"level"`
+	LowerBound money.Money `json:"lowerBound"`
+	UpperBound money.Money `json:"upperBound,omitempty"`
+	Base       money.Money `json:"base"`
+	Rate       money.Rate  `json:"rate"`
+	Tax        money.Money `json:"tax"`
+}
+
+// rulesVersion fingerprints the resolved rules, so two calculations report
+// the same version exactly when they used the same configuration.
+func rulesVersion(rules TaxRules) (string, error) {
+	b, err := json.Marshal(rules)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:6]), nil
+}
@@ -0,0 +1,195 @@
+package tax
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+const (
+	maxParents              = 4
+	parentMinAge            = 60
+	childMaxAge             = 20
+	studyingChildMaxAge     = 25
+	childBonusFromBirthYear = 2561 // 2018
+)
+
+var parentMaxIncome = money.New(30000)
+
+type TaxpayerProfile struct {
+	Spouse             *Spouse  `json:"spouse,omitempty"`
+	Children           []Child  `json:"children,omitempty"`
+	Parents            []Parent `json:"parents,omitempty"`
+	DisabledDependents int      `json:"disabledDependents,omitempty"`
+}
+
+type Spouse struct {
+	HasIncome bool `json:"hasIncome"`
+}
+
+// Child.BirthYear uses the Buddhist Era like TaxYear.
+type Child struct {
+	BirthYear int  `json:"birthYear"`
+	Studying  bool `json:"studying,omitempty"`
+}
+
+type Parent struct {
+	Age    int         `json:"age"`
+	Income money.Money `json:"income"`
+}
+
+func (c Child) eligible(taxYear int) bool {
+	age := taxYear - c.BirthYear
+	return age < childMaxAge || (c.Studying && age < studyingChildMaxAge)
+}
+
+func (p Parent) eligible() bool {
+	return p.Age >= parentMinAge && p.Income <= parentMaxIncome
+}
+
+// splitChildren separates eligible children into those claiming the regular
+// child allowance and those claiming the higher amount available from the
+// second child born in 2018 or later.
+func splitChildren(children []Child, taxYear int) (regular, bonus int) {
+	sorted := append([]Child(nil), children...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].BirthYear < sorted[j].BirthYear
+	})
+
+	for i, child := range sorted {
+		if !child.eligible(taxYear) {
+			continue
+		}
+		if i > 0 && child.BirthYear >= childBonusFromBirthYear {
+			bonus++
+		} else {
+			regular++
+		}
+	}
+	return regular, bonus
+}
+
+func claimSpouse(req Request, c CapContext) money.Money {
+	if req.Profile == nil || req.Profile.Spouse == nil || req.Profile.Spouse.HasIncome {
+		return 0
+	}
+	return c.Limit
+}
+
+func claimChild(req Request, c CapContext) money.Money {
+	if req.Profile == nil {
+		return 0
+	}
+	regular, _ := splitChildren(req.Profile.Children, c.TaxYear)
+	return c.Limit.Mul(int64(regular))
+}
+
+func claimChildBonus(req Request, c CapContext) money.Money {
+	if req.Profile == nil {
+		return 0
+	}
+	_, bonus := splitChildren(req.Profile.Children, c.TaxYear)
+	return c.Limit.Mul(int64(bonus))
+}
+
+func claimParent(req Request, c CapContext) money.Money {
+	if req.Profile == nil {
+		return 0
+	}
+	var count int64
+	for _, parent := range req.Profile.Parents {
+		if parent.eligible() {
+			count++
+		}
+	}
+	return c.Limit.Mul(count)
+}
+
+func claimDisabledDependent(req Request, c CapContext) money.Money {
+	if req.Profile == nil {
+		return 0
+	}
+	return c.Limit.Mul(int64(req.Profile.DisabledDependents))
+}
+
+// maxDisabledDependents allows one claim for each relative who can be a
+// dependent (the parents of both spouses, the spouse and the listed
+// children) plus one other person in the taxpayer's care.
+func maxDisabledDependents(p *TaxpayerProfile) int {
+	return maxParents + 1 + len(p.Children) + 1
+}
+
+func validateProfile(req *Request) error {
+	p := req.Profile
+	if p == nil {
+		return nil
+	}
+	if len(p.Parents) > maxParents {
+		return errors.New("invalid profile at most 4 parents can be claimed")
+	}
+	for _, parent := range p.Parents {
+		if parent.Age < 0 || parent.Income < 0 {
+			return errors.New("invalid profile parent age and income must not be negative")
+		}
+	}
+	taxYear := resolveTaxYear(req.TaxYear)
+	for _, child := range p.Children {
+		if child.BirthYear <= 0 {
+			return errors.New("invalid profile child birthYear must be greater than zero")
+		}
+		if child.BirthYear > taxYear {
+			return errors.New("invalid profile child birthYear must not be after taxYear")
+		}
+	}
+	if p.DisabledDependents < 0 {
+		return errors.New("invalid profile disabledDependents must not be negative")
+	}
+	if p.DisabledDependents > maxDisabledDependents(p) {
+		return fmt.Errorf("invalid profile at most %d disabledDependents can be claimed", maxDisabledDependents(p))
+	}
+	return nil
+}
+
+func init() {
+	RegisterAllowanceType(AllowanceType{
+		Name:         "spouse",
+		SettingName:  "spouseAllowance",
+		DefaultLimit: money.New(60000),
+		MaxLimit:     money.New(100000),
+		Claim:        claimSpouse,
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "child",
+		SettingName:  "childAllowance",
+		DefaultLimit: money.New(30000),
+		MaxLimit:     money.New(100000),
+		Claim:        claimChild,
+		Cap:          capClaimed,
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "child-2018",
+		SettingName:  "child2018Allowance",
+		DefaultLimit: money.New(60000),
+		MaxLimit:     money.New(100000),
+		Claim:        claimChildBonus,
+		Cap:          capClaimed,
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "parent",
+		SettingName:  "parentAllowance",
+		DefaultLimit: money.New(30000),
+		MaxLimit:     money.New(60000),
+		Claim:        claimParent,
+		Cap:          capClaimed,
+	})
+	RegisterAllowanceType(AllowanceType{
+		Name:         "disabled-dependent",
+		SettingName:  "disabledDependentAllowance",
+		DefaultLimit: money.New(60000),
+		MaxLimit:     money.New(100000),
+		Claim:        claimDisabledDependent,
+		Cap:          capClaimed,
+	})
+}
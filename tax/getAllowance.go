@@ -1,43 +1,43 @@
 package tax
 
 import (
-	"database/sql"
-)
-
-func getPersonalAllowance(db *sql.DB) (float64, error) {
-	var personalAllowance float64 = 60000.0
-	var exists bool
-
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM taxdeduction WHERE name = 'personalAllowance')").Scan(&exists)
-	if err != nil {
-		return 0, err
-	}
+	"time"
 
-	if exists {
-		err = db.QueryRow("SELECT amount FROM taxdeduction WHERE name = 'personalAllowance'").Scan(&personalAllowance)
-		if err != nil {
-			return 0, err
-		}
-	}
+	"github.com/Ter4798/post-test-kbtg/money"
+)
 
-	return personalAllowance, nil
+type deduction struct {
+	Amount     money.Money
+	Multiplier *money.Rate
+	IncomeRate *money.Rate
 }
 
-func getKReceiptAllowance(db *sql.DB) (float64, error) {
-	var kReceiptAllowance float64 = 50000.0
-	var exists bool
-
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM taxdeduction WHERE name = 'kReceiptAllowance')").Scan(&exists)
+// getDeductions returns, for each setting, the latest version that is in
+// force at asOf. A deleted version means the setting falls back to its
+// default.
+func getDeductions(db querier, taxYear int, asOf time.Time) (map[string]deduction, error) {
+	rows, err := db.Query(`SELECT name, amount, multiplier, income_rate FROM (
+            SELECT DISTINCT ON (name) name, amount, multiplier, income_rate, deleted FROM taxdeduction
+            WHERE tax_year = $1 AND effective_from <= $2
+            ORDER BY name, effective_from DESC, version DESC
+        ) d WHERE NOT deleted`, taxYear, asOf)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-
-	if exists {
-		err = db.QueryRow("SELECT amount FROM taxdeduction WHERE name = 'kReceiptAllowance'").Scan(&kReceiptAllowance)
-		if err != nil {
-			return 0, err
+	defer rows.Close()
+
+	deductions := make(map[string]deduction)
+	for rows.Next() {
+		var name string
+		var d deduction
+		if err := rows.Scan(&name, &d.Amount, &d.Multiplier, &d.IncomeRate); err != nil {
+			return nil, err
 		}
+		deductions[name] = d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	return kReceiptAllowance, nil
+	return deductions, nil
 }
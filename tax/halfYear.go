@@ -0,0 +1,47 @@
+package tax
+
+import (
+	"errors"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+// halfYear returns the rules for a PND.94 return, which covers January to
+// June income with every allowance limit halved. The bracket table is the
+// same as the annual one.
+func (r TaxRules) halfYear() TaxRules {
+	half := r
+	half.Limits = make(map[string]money.Money, len(allowanceTypes))
+	for _, t := range allowanceTypes {
+		half.Limits[t.Name] = r.Limit(t).Div(2, r.Rounding.HalfYear)
+	}
+	return half
+}
+
+// validateHalfYear only accepts categorised 40(5) to 40(8) income on a
+// half-year return. The tax paid on that return is credited on the annual
+// one through PrepaidTax.
+func validateHalfYear(req *Request) error {
+	if req.PrepaidTax < 0 || req.PrepaidTax > req.grossIncome() {
+		return errors.New("prepaidTax must be between 0 and totalIncome")
+	}
+	if !req.HalfYear {
+		return nil
+	}
+	if req.PrepaidTax != 0 {
+		return errors.New("prepaidTax is only allowed on the annual calculation")
+	}
+	if len(req.Dividends) > 0 {
+		return errors.New("dividends are only allowed on the annual calculation")
+	}
+	if len(req.Incomes) == 0 {
+		return errors.New("halfYear requires incomes")
+	}
+	for _, i := range req.Incomes {
+		category, ok := lookupIncomeCategory(i.Category)
+		if ok && !category.HalfYear {
+			return errors.New("halfYear incomes should be 40(5) to 40(8)")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package tax
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+// ImpactRow compares one taxpayer under the current and proposed rules.
+// Difference is the change in net position, tax payable less refund, so a
+// negative value means the taxpayer is better off.
+type ImpactRow struct {
+	Row            int         `json:"row"`
+	TaxYear        int         `json:"taxYear"`
+	CurrentTax     money.Money `json:"currentTax"`
+	ProposedTax    money.Money `json:"proposedTax"`
+	CurrentRefund  money.Money `json:"currentRefund"`
+	ProposedRefund money.Money `json:"proposedRefund"`
+	Difference     money.Money `json:"difference"`
+}
+
+type Impact struct {
+	Rows           int         `json:"rows"`
+	Affected       int         `json:"affected"`
+	CurrentTax     money.Money `json:"currentTax"`
+	ProposedTax    money.Money `json:"proposedTax"`
+	CurrentRefund  money.Money `json:"currentRefund"`
+	ProposedRefund money.Money `json:"proposedRefund"`
+	Difference     money.Money `json:"difference"`
+	Details        []ImpactRow `json:"details"`
+}
+
+// PreviewImpact runs every request under the rules in force at asOf and
+// again with o applied to taxYear. Requests for other years are unaffected.
+// Nothing is written.
+func PreviewImpact(ctx context.Context, db *sql.DB, reqs []Request, taxYear int, asOf time.Time, o Override) (Impact, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return Impact{}, err
+	}
+	defer tx.Rollback()
+
+	current := make(map[int]TaxRules)
+	for _, req := range reqs {
+		year := resolveTaxYear(req.TaxYear)
+		if _, ok := current[year]; ok {
+			continue
+		}
+		if current[year], err = getTaxRules(tx, year, asOf); err != nil {
+			return Impact{}, err
+		}
+	}
+
+	proposed, err := getTaxRules(tx, taxYear, asOf, o)
+	if err != nil {
+		return Impact{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Impact{}, err
+	}
+
+	return compareImpact(reqs, current, proposed), nil
+}
+
+func compareImpact(reqs []Request, current map[int]TaxRules, proposed TaxRules) Impact {
+	impact := Impact{Rows: len(reqs), Details: []ImpactRow{}}
+	for i, req := range reqs {
+		req.Explain = false
+		year := resolveTaxYear(req.TaxYear)
+		before := calculate(req, current[year])
+		after := before
+		if year == proposed.TaxYear {
+			after = calculate(req, proposed)
+		}
+
+		row := ImpactRow{
+			Row:            i + 1,
+			TaxYear:        year,
+			CurrentTax:     before.Tax,
+			ProposedTax:    after.Tax,
+			CurrentRefund:  before.TaxRefund,
+			ProposedRefund: after.TaxRefund,
+			Difference:     (after.Tax - after.TaxRefund) - (before.Tax - before.TaxRefund),
+		}
+		if row.CurrentTax != row.ProposedTax || row.CurrentRefund != row.ProposedRefund {
+			impact.Affected++
+		}
+		impact.CurrentTax += row.CurrentTax
+		impact.ProposedTax += row.ProposedTax
+		impact.CurrentRefund += row.CurrentRefund
+		impact.ProposedRefund += row.ProposedRefund
+		impact.Difference += row.Difference
+		impact.Details = append(impact.Details, row)
+	}
+	return impact
+}
@@ -0,0 +1,129 @@
+package tax
+
+import (
+	"errors"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+// incomeCategory is an assessable income type under Section 40 with its
+// standard expense deduction. Categories sharing a capGroup share one cap.
+// HalfYear marks the categories that are filed on the PND.94 return.
+type incomeCategory struct {
+	Name          string
+	Rate          money.Rate
+	Cap           money.Money
+	CapGroup      string
+	ActualAllowed bool
+	HalfYear      bool
+}
+
+var incomeCategories = []incomeCategory{
+	{Name: "40(1)", Rate: 50 * money.Percent, Cap: money.New(100000), CapGroup: "40(1)-40(2)"},
+	{Name: "40(2)", Rate: 50 * money.Percent, Cap: money.New(100000), CapGroup: "40(1)-40(2)"},
+	{Name: "40(3)", Rate: 50 * money.Percent, Cap: money.New(100000), CapGroup: "40(3)"},
+	{Name: "40(4)"},
+	{Name: "40(5)", Rate: 30 * money.Percent, ActualAllowed: true, HalfYear: true},
+	{Name: "40(6)", Rate: 30 * money.Percent, ActualAllowed: true, HalfYear: true},
+	{Name: "40(7)", Rate: 60 * money.Percent, ActualAllowed: true, HalfYear: true},
+	{Name: "40(8)", Rate: 60 * money.Percent, ActualAllowed: true, HalfYear: true},
+}
+
+func lookupIncomeCategory(name string) (incomeCategory, bool) {
+	for _, category := range incomeCategories {
+		if category.Name == name {
+			return category, true
+		}
+	}
+	return incomeCategory{}, false
+}
+
+func (r Request) grossIncome() money.Money {
+	if len(r.Incomes) == 0 {
+		return r.TotalIncome
+	}
+	var total money.Money
+	for _, income := range r.Incomes {
+		total += income.Amount
+	}
+	return total
+}
+
+// calculateExpenses applies the standard expense deduction to each income
+// category and returns the income left for allowances. A request that only
+// has totalIncome is taken as already net of expenses.
+func calculateExpenses(req Request, rules TaxRules) ([]IncomeResult, money.Money) {
+	if len(req.Incomes) == 0 {
+		return nil, req.TotalIncome
+	}
+
+	type categoryTotal struct {
+		amount    money.Money
+		actual    money.Money
+		hasActual bool
+	}
+	totals := make(map[string]*categoryTotal)
+	for _, income := range req.Incomes {
+		total, ok := totals[income.Category]
+		if !ok {
+			total = &categoryTotal{}
+			totals[income.Category] = total
+		}
+		total.amount += income.Amount
+		if income.Expense != nil {
+			total.actual += *income.Expense
+			total.hasActual = true
+		}
+	}
+
+	var results []IncomeResult
+	var netIncome money.Money
+	usedCap := make(map[string]money.Money)
+	for _, category := range incomeCategories {
+		total, ok := totals[category.Name]
+		if !ok {
+			continue
+		}
+
+		var expense money.Money
+		if category.ActualAllowed && total.hasActual {
+			expense = total.actual
+		} else {
+			expense = total.amount.MulRate(category.Rate, rules.Rounding.Expense)
+			if category.Cap > 0 {
+				expense = money.Min(expense, category.Cap-usedCap[category.CapGroup])
+				usedCap[category.CapGroup] += expense
+			}
+		}
+
+		results = append(results, IncomeResult{
+			Category:  category.Name,
+			Income:    total.amount,
+			Expense:   expense,
+			NetIncome: total.amount - expense,
+		})
+		netIncome += total.amount - expense
+	}
+	return results, netIncome
+}
+
+func validateIncomes(req *Request) error {
+	for _, income := range req.Incomes {
+		category, ok := lookupIncomeCategory(income.Category)
+		if !ok {
+			return errors.New("invalid income category should be 40(1) to 40(8)")
+		}
+		if income.Amount < 0 {
+			return errors.New("invalid income amount must not be negative")
+		}
+		if income.Expense != nil {
+			if !category.ActualAllowed {
+				return errors.New("invalid income expense actual expenses are only allowed for 40(5) to 40(8)")
+			}
+			if *income.Expense < 0 || *income.Expense > income.Amount {
+				return errors.New("invalid income expense must be between zero and the income amount")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package tax
+
+import (
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+const (
+	TaxMethodProgressive = "progressive"
+	TaxMethodMinimum     = "minimum"
+)
+
+// The alternative method charges 0.5% of assessable income other than
+// 40(1) when that income exceeds 120,000 (60,000 on a half-year return) and
+// the result exceeds 5,000.
+var (
+	minimumTaxRate           = money.MustParseRate("0.005")
+	minimumTaxIncomeFloor    = money.New(120000)
+	minimumTaxExemptionFloor = money.New(5000)
+)
+
+type TaxMethod struct {
+	Applied     string      `json:"applied"`
+	Progressive money.Money `json:"progressive"`
+	Minimum     money.Money `json:"minimum"`
+}
+
+func calculateMinimumTax(req Request, rules TaxRules, dividendIncome money.Money) money.Money {
+	income := dividendIncome
+	for _, i := range req.Incomes {
+		if i.Category != "40(1)" {
+			income += i.Amount
+		}
+	}
+	floor := minimumTaxIncomeFloor
+	if req.HalfYear {
+		floor = floor.Div(2, rules.Rounding.HalfYear)
+	}
+	if income <= floor {
+		return 0
+	}
+
+	tax := income.MulRate(minimumTaxRate, rules.Rounding.MinimumTax)
+	if tax <= minimumTaxExemptionFloor {
+		return 0
+	}
+	return tax
+}
+
+func chooseTaxMethod(progressive, minimum money.Money) TaxMethod {
+	method := TaxMethod{
+		Applied:     TaxMethodProgressive,
+		Progressive: progressive,
+		Minimum:     minimum,
+	}
+	if minimum > progressive {
+		method.Applied = TaxMethodMinimum
+	}
+	return method
+}
+
+func (m TaxMethod) tax() money.Money {
+	if m.Applied == TaxMethodMinimum {
+		return m.Minimum
+	}
+	return m.Progressive
+}
@@ -0,0 +1,165 @@
+package tax
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+	"github.com/labstack/echo/v4"
+)
+
+const maxPayrollBatch = 1000
+
+// PayrollRequest describes one employee for a payroll month. YTDIncome and
+// YTDWithheld cover the months before Month, including earlier bonuses and
+// income from a previous employer in the same year.
+type PayrollRequest struct {
+	EmployeeID    string           `json:"employeeId,omitempty"`
+	TaxYear       int              `json:"taxYear,omitempty"`
+	Month         int              `json:"month"`
+	MonthlySalary money.Money      `json:"monthlySalary"`
+	Bonus         money.Money      `json:"bonus"`
+	YTDIncome     money.Money      `json:"ytdIncome"`
+	YTDWithheld   money.Money      `json:"ytdWithheld"`
+	Allowances    []Allowance      `json:"allowances"`
+	Profile       *TaxpayerProfile `json:"profile,omitempty"`
+}
+
+type PayrollResponse struct {
+	EmployeeID        string      `json:"employeeId,omitempty"`
+	TaxYear           int         `json:"taxYear"`
+	Month             int         `json:"month"`
+	ProjectedIncome   money.Money `json:"projectedIncome"`
+	AnnualTax         money.Money `json:"annualTax"`
+	SalaryWithholding money.Money `json:"salaryWithholding"`
+	BonusWithholding  money.Money `json:"bonusWithholding"`
+	Withholding       money.Money `json:"withholding"`
+}
+
+type PayrollBatchRequest struct {
+	Employees []PayrollRequest `json:"employees"`
+}
+
+func HandlePayroll(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req PayrollRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		resps, err := calculatePayrollBatch(c, db, []PayrollRequest{req})
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, resps[0])
+	}
+}
+
+func HandlePayrollBatch(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req PayrollBatchRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if len(req.Employees) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "at least one employee is required")
+		}
+		if len(req.Employees) > maxPayrollBatch {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("at most %d employees are allowed", maxPayrollBatch))
+		}
+
+		resps, err := calculatePayrollBatch(c, db, req.Employees)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, struct {
+			Withholdings []PayrollResponse `json:"withholdings"`
+		}{
+			Withholdings: resps,
+		})
+	}
+}
+
+func calculatePayrollBatch(c echo.Context, db *sql.DB, reqs []PayrollRequest) ([]PayrollResponse, error) {
+	years := make([]int, 0, len(reqs))
+	for i := range reqs {
+		if err := validatePayrollRequest(&reqs[i]); err != nil {
+			if len(reqs) > 1 {
+				err = fmt.Errorf("employee %d: %w", i+1, err)
+			}
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		years = append(years, reqs[i].TaxYear)
+	}
+
+	rules, err := getTaxRulesSnapshot(c.Request().Context(), db, years)
+	if errors.Is(err, ErrUnsupportedTaxYear) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	resps := make([]PayrollResponse, 0, len(reqs))
+	for _, req := range reqs {
+		resps = append(resps, calculatePayroll(req, rules[resolveTaxYear(req.TaxYear)]))
+	}
+	return resps, nil
+}
+
+func validatePayrollRequest(req *PayrollRequest) error {
+	if req.Month < 1 || req.Month > 12 {
+		return errors.New("month must be between 1 and 12")
+	}
+	if req.MonthlySalary < 0 || req.Bonus < 0 || req.YTDIncome < 0 || req.YTDWithheld < 0 {
+		return errors.New("monthlySalary, bonus, ytdIncome and ytdWithheld must not be negative")
+	}
+
+	annual := payrollTaxRequest(*req, true)
+	return ValidateRequest(&annual)
+}
+
+// payrollTaxRequest projects the year's employment income: what was paid so
+// far, the salary for this and every remaining month, and optionally this
+// month's bonus. Only the months still to be paid are projected, so a
+// mid-year joiner is not annualised as if they had worked the full year.
+func payrollTaxRequest(req PayrollRequest, withBonus bool) Request {
+	income := req.YTDIncome + req.MonthlySalary.Mul(int64(13-req.Month))
+	if withBonus {
+		income += req.Bonus
+	}
+	return Request{
+		TaxYear:    req.TaxYear,
+		Incomes:    []Income{{Category: "40(1)", Amount: income}},
+		Allowances: req.Allowances,
+		Profile:    req.Profile,
+	}
+}
+
+// calculatePayroll follows the PND.1 method: the projected annual tax on
+// regular salary, less what has already been withheld, is spread evenly over
+// the remaining months, and the extra tax caused by a bonus is withheld in
+// full in the month it is paid.
+func calculatePayroll(req PayrollRequest, rules TaxRules) PayrollResponse {
+	withBonus := calculate(payrollTaxRequest(req, true), rules)
+	withoutBonus := calculate(payrollTaxRequest(req, false), rules)
+
+	remainingMonths := int64(13 - req.Month)
+	salaryWithholding := money.Max(withoutBonus.Tax-req.YTDWithheld, 0).Div(remainingMonths, rules.Rounding.Withholding)
+	bonusWithholding := withBonus.Tax - withoutBonus.Tax
+
+	return PayrollResponse{
+		EmployeeID:        req.EmployeeID,
+		TaxYear:           withBonus.TaxYear,
+		Month:             req.Month,
+		ProjectedIncome:   payrollTaxRequest(req, true).grossIncome(),
+		AnnualTax:         withBonus.Tax,
+		SalaryWithholding: salaryWithholding,
+		BonusWithholding:  bonusWithholding,
+		Withholding:       salaryWithholding + bonusWithholding,
+	}
+}
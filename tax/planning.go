@@ -0,0 +1,260 @@
+package tax
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	PlanGoalZeroTax   = "zero-tax"
+	PlanGoalMaxRefund = "max-refund"
+	PlanGoalBracket   = "bracket"
+)
+
+type PlanRequest struct {
+	Request        Request  `json:"request"`
+	Goal           string   `json:"goal"`
+	Bracket        string   `json:"bracket,omitempty"`
+	AllowanceTypes []string `json:"allowanceTypes,omitempty"`
+}
+
+type Contribution struct {
+	AllowanceType string      `json:"allowanceType"`
+	Amount        money.Money `json:"amount"`
+	RemainingCap  money.Money `json:"remainingCap"`
+}
+
+type PlanResponse struct {
+	Goal          string         `json:"goal"`
+	Achieved      bool           `json:"achieved"`
+	Contributions []Contribution `json:"contributions"`
+	Total         money.Money    `json:"total"`
+	Result        Response       `json:"result"`
+}
+
+func HandlePlanning(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req PlanRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		if err := validatePlanRequest(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		rules, err := getTaxRules(db, req.Request.TaxYear, time.Now())
+		if errors.Is(err, ErrUnsupportedTaxYear) {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+
+		resp, err := plan(req, rules)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		return c.JSON(http.StatusOK, resp)
+	}
+}
+
+func validatePlanRequest(req *PlanRequest) error {
+	if err := ValidateRequest(&req.Request); err != nil {
+		return err
+	}
+
+	switch req.Goal {
+	case PlanGoalZeroTax, PlanGoalMaxRefund:
+	case PlanGoalBracket:
+		if req.Bracket == "" {
+			return errors.New("bracket is required for the bracket goal")
+		}
+	default:
+		return errors.New("invalid goal should be zero-tax, max-refund, bracket")
+	}
+
+	for _, name := range req.AllowanceTypes {
+		t, ok := LookupAllowanceType(name)
+		if !ok || !t.Claimable() {
+			return errors.New("invalid allowance type " + name)
+		}
+	}
+	return nil
+}
+
+// plan adds contributions one allowance type at a time, starting with the
+// types that deduct the most per Baht, until the goal is met. Each type is
+// filled only up to the point where more money stops lowering taxable
+// income, and the last one only as far as the goal needs. Because later
+// contributions can shrink the cap of earlier ones, a final pass trims every
+// contribution to what the final result still needs. The remaining cap of
+// each type is measured against that final plan.
+func plan(req PlanRequest, rules TaxRules) (PlanResponse, error) {
+	goal, err := planGoal(req, rules)
+	if err != nil {
+		return PlanResponse{}, err
+	}
+
+	base := req.Request
+	base.Explain = true
+
+	var contributions []Contribution
+	evaluate := func(extra ...Contribution) Response {
+		next := base
+		next.Allowances = append([]Allowance(nil), base.Allowances...)
+		for _, c := range append(append([]Contribution(nil), contributions...), extra...) {
+			next.Allowances = append(next.Allowances, Allowance{AllowanceType: c.AllowanceType, Amount: c.Amount})
+		}
+		return calculate(next, rules)
+	}
+
+	result := evaluate()
+	achieved := goal != nil && goal(result)
+
+	for _, t := range planCandidates(req, rules) {
+		if achieved {
+			break
+		}
+
+		withExtra := func(amount money.Money) Response {
+			return evaluate(Contribution{AllowanceType: t.Name, Amount: amount})
+		}
+
+		limit := rules.Limit(t)
+		floor := withExtra(limit).Explanation.TaxableIncome
+		if floor >= result.Explanation.TaxableIncome {
+			continue
+		}
+		room := searchMoney(0, limit, func(amount money.Money) bool {
+			return withExtra(amount).Explanation.TaxableIncome <= floor
+		})
+
+		amount := room
+		if goal != nil && goal(withExtra(room)) {
+			amount = searchMoney(0, room, func(amount money.Money) bool {
+				return goal(withExtra(amount))
+			})
+			achieved = true
+		}
+
+		contributions = append(contributions, Contribution{
+			AllowanceType: t.Name,
+			Amount:        amount,
+		})
+		result = evaluate()
+	}
+
+	target := result.Explanation.TaxableIncome
+	for i := range contributions {
+		amount := contributions[i].Amount
+		trimmed := searchMoney(0, amount, func(a money.Money) bool {
+			contributions[i].Amount = a
+			r := evaluate()
+			return r.Explanation.TaxableIncome <= target && (goal == nil || !achieved || goal(r))
+		})
+		contributions[i].Amount = trimmed
+	}
+
+	final := evaluate()
+	for i := range contributions {
+		t, _ := LookupAllowanceType(contributions[i].AllowanceType)
+		contributions[i].RemainingCap = remainingCap(t, rules, final, evaluate)
+	}
+
+	resp := PlanResponse{
+		Goal:          req.Goal,
+		Achieved:      achieved || goal == nil,
+		Contributions: []Contribution{},
+		Result:        final,
+	}
+	for _, c := range contributions {
+		if c.Amount == 0 {
+			continue
+		}
+		resp.Contributions = append(resp.Contributions, c)
+		resp.Total += c.Amount
+	}
+	if !req.Request.Explain {
+		resp.Result.Explanation = nil
+	}
+	return resp, nil
+}
+
+// remainingCap returns the smallest extra amount of t that lowers taxable
+// income as far as more of t can, on top of the plan that produced result,
+// or zero when more of t no longer lowers it.
+func remainingCap(t AllowanceType, rules TaxRules, result Response, evaluate func(...Contribution) Response) money.Money {
+	withExtra := func(amount money.Money) Response {
+		return evaluate(Contribution{AllowanceType: t.Name, Amount: amount})
+	}
+	floor := withExtra(rules.Limit(t)).Explanation.TaxableIncome
+	if floor >= result.Explanation.TaxableIncome {
+		return 0
+	}
+	return searchMoney(0, rules.Limit(t), func(amount money.Money) bool {
+		return withExtra(amount).Explanation.TaxableIncome <= floor
+	})
+}
+
+func planGoal(req PlanRequest, rules TaxRules) (func(Response) bool, error) {
+	switch req.Goal {
+	case PlanGoalZeroTax:
+		return func(r Response) bool { return r.Tax == 0 }, nil
+	case PlanGoalBracket:
+		for _, b := range rules.Brackets {
+			if b.Label != req.Bracket {
+				continue
+			}
+			if b.UpperBound == 0 {
+				return func(Response) bool { return true }, nil
+			}
+			return func(r Response) bool { return r.Explanation.TaxableIncome <= b.UpperBound }, nil
+		}
+		return nil, errors.New("invalid bracket " + req.Bracket)
+	default:
+		return nil, nil
+	}
+}
+
+func planCandidates(req PlanRequest, rules TaxRules) []AllowanceType {
+	var candidates []AllowanceType
+	if len(req.AllowanceTypes) > 0 {
+		for _, name := range req.AllowanceTypes {
+			t, _ := LookupAllowanceType(name)
+			candidates = append(candidates, t)
+		}
+	} else {
+		for _, t := range orderedAllowanceTypes() {
+			if t.Claimable() {
+				candidates = append(candidates, t)
+			}
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rules.Multiplier(candidates[i]) > rules.Multiplier(candidates[j])
+	})
+	return candidates
+}
+
+// searchMoney returns the smallest amount in [lo, hi] for which ok holds,
+// given that ok(hi) holds and ok is monotonic.
+func searchMoney(lo, hi money.Money, ok func(money.Money) bool) money.Money {
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if ok(mid) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return hi
+}
@@ -0,0 +1,189 @@
+package tax
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+	"github.com/labstack/echo/v4"
+)
+
+const maxScenarios = 20
+
+// Scenario describes a what-if variation. Changes holds request fields that
+// replace the matching fields of the base request, for example
+// {"wht": 0} or {"allowances": [...]}; fields not listed are inherited.
+type Scenario struct {
+	Name    string          `json:"name"`
+	Changes json.RawMessage `json:"changes"`
+}
+
+type ScenarioRequest struct {
+	Base      Request    `json:"base"`
+	Scenarios []Scenario `json:"scenarios"`
+}
+
+type ScenarioDelta struct {
+	Tax            money.Money `json:"tax"`
+	TaxRefund      money.Money `json:"taxRefund"`
+	TaxableIncome  money.Money `json:"taxableIncome"`
+	TotalAllowance money.Money `json:"totalAllowance"`
+}
+
+type ScenarioResult struct {
+	Name   string        `json:"name"`
+	Result Response      `json:"result"`
+	Delta  ScenarioDelta `json:"delta"`
+}
+
+type ScenarioResponse struct {
+	ConfigVersions map[int]string   `json:"configVersions"`
+	Base           Response         `json:"base"`
+	Scenarios      []ScenarioResult `json:"scenarios"`
+}
+
+type namedRequest struct {
+	Name    string
+	Request Request
+}
+
+func HandleScenarios(db *sql.DB) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var req ScenarioRequest
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		scenarios, err := buildScenarios(req)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+
+		explain := c.QueryParam("explain") == "true"
+		req.Base.Explain = explain
+		for i := range scenarios {
+			scenarios[i].Request.Explain = explain
+		}
+
+		years := []int{req.Base.TaxYear}
+		for _, s := range scenarios {
+			years = append(years, s.Request.TaxYear)
+		}
+		rules, err := getTaxRulesSnapshot(c.Request().Context(), db, years)
+		if errors.Is(err, ErrUnsupportedTaxYear) {
+			return echo.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+
+		return c.JSON(http.StatusOK, compareScenarios(req.Base, scenarios, rules))
+	}
+}
+
+// buildScenarios validates the base request and applies each scenario's
+// changes on top of it.
+func buildScenarios(req ScenarioRequest) ([]namedRequest, error) {
+	if err := ValidateRequest(&req.Base); err != nil {
+		return nil, err
+	}
+	if len(req.Scenarios) == 0 {
+		return nil, errors.New("at least one scenario is required")
+	}
+	if len(req.Scenarios) > maxScenarios {
+		return nil, fmt.Errorf("at most %d scenarios are allowed", maxScenarios)
+	}
+
+	base, err := json.Marshal(req.Base)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	scenarios := make([]namedRequest, 0, len(req.Scenarios))
+	for _, s := range req.Scenarios {
+		if s.Name == "" {
+			return nil, errors.New("scenario name is required")
+		}
+		if names[s.Name] {
+			return nil, errors.New("duplicate scenario name " + s.Name)
+		}
+		names[s.Name] = true
+
+		r, err := applyChanges(base, s.Changes)
+		if err != nil {
+			return nil, fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+		if err := ValidateRequest(&r); err != nil {
+			return nil, fmt.Errorf("scenario %s: %w", s.Name, err)
+		}
+		scenarios = append(scenarios, namedRequest{Name: s.Name, Request: r})
+	}
+	return scenarios, nil
+}
+
+func applyChanges(base []byte, changes json.RawMessage) (Request, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(base, &fields); err != nil {
+		return Request{}, err
+	}
+	if len(changes) > 0 {
+		overrides := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(changes, &overrides); err != nil {
+			return Request{}, errors.New("changes must be an object")
+		}
+		for k, v := range overrides {
+			fields[k] = v
+		}
+	}
+
+	merged, err := json.Marshal(fields)
+	if err != nil {
+		return Request{}, err
+	}
+	var r Request
+	if err := json.Unmarshal(merged, &r); err != nil {
+		return Request{}, err
+	}
+	return r, nil
+}
+
+// compareScenarios calculates the base and every scenario against the same
+// rules and reports each scenario's difference from the base.
+func compareScenarios(base Request, scenarios []namedRequest, rules map[int]TaxRules) ScenarioResponse {
+	evaluate := func(req Request) (Response, Explanation) {
+		explain := req.Explain
+		req.Explain = true
+		resp := calculate(req, rules[resolveTaxYear(req.TaxYear)])
+		explanation := *resp.Explanation
+		if !explain {
+			resp.Explanation = nil
+		}
+		return resp, explanation
+	}
+
+	resp := ScenarioResponse{ConfigVersions: make(map[int]string)}
+	for year, r := range rules {
+		resp.ConfigVersions[year] = r.Version
+	}
+
+	var baseExplanation Explanation
+	resp.Base, baseExplanation = evaluate(base)
+	for _, s := range scenarios {
+		result, explanation := evaluate(s.Request)
+		resp.Scenarios = append(resp.Scenarios, ScenarioResult{
+			Name:   s.Name,
+			Result: result,
+			Delta: ScenarioDelta{
+				Tax:            result.Tax - resp.Base.Tax,
+				TaxRefund:      result.TaxRefund - resp.Base.TaxRefund,
+				TaxableIncome:  explanation.TaxableIncome - baseExplanation.TaxableIncome,
+				TotalAllowance: explanation.TotalAllowance - baseExplanation.TotalAllowance,
+			},
+		})
+	}
+	return resp
+}
@@ -1,28 +1,67 @@
 package tax
 
+import (
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
 type Allowance struct {
-	AllowanceType string  `json:"allowanceType"`
-	Amount        float64 `json:"amount"`
+	AllowanceType string      `json:"allowanceType"`
+	Amount        money.Money `json:"amount"`
+}
+
+type Income struct {
+	Category string       `json:"category"`
+	Amount   money.Money  `json:"amount"`
+	Expense  *money.Money `json:"expense,omitempty"`
 }
 
 type Request struct {
-	TotalIncome float64     `json:"totalIncome"`
-	WHT         float64     `json:"wht"`
-	Allowances  []Allowance `json:"allowances"`
+	TaxYear     int              `json:"taxYear,omitempty"`
+	TotalIncome money.Money      `json:"totalIncome"`
+	Incomes     []Income         `json:"incomes,omitempty"`
+	WHT         money.Money      `json:"wht"`
+	PrepaidTax  money.Money      `json:"prepaidTax,omitempty"`
+	HalfYear    bool             `json:"halfYear,omitempty"`
+	Dividends   []Dividend       `json:"dividends,omitempty"`
+	Allowances  []Allowance      `json:"allowances"`
+	Profile     *TaxpayerProfile `json:"profile,omitempty"`
+	Explain     bool             `json:"-"`
 }
 
 type TaxLevel struct {
-	Level string  `json:"level"`
-	Tax   float64 `json:"tax"`
+	Level string      `json:"level"`
+	Tax   money.Money `json:"tax"`
+}
+
+type AllowanceResult struct {
+	AllowanceType string      `json:"allowanceType"`
+	Claimed       money.Money `json:"claimed"`
+	Allowed       money.Money `json:"allowed"`
+}
+
+type IncomeResult struct {
+	Category  string      `json:"category"`
+	Income    money.Money `json:"income"`
+	Expense   money.Money `json:"expense"`
+	NetIncome money.Money `json:"netIncome"`
 }
 
 type Response struct {
-	Tax       float64    `json:"tax"`
-	TaxRefund float64    `json:"taxRefund,omitempty"`
-	TaxLevels []TaxLevel `json:"taxLevels"`
+	TaxYear     int               `json:"taxYear"`
+	Tax         money.Money       `json:"tax"`
+	TaxRefund   money.Money       `json:"taxRefund,omitempty"`
+	TaxLevels   []TaxLevel        `json:"taxLevels"`
+	TaxMethod   TaxMethod         `json:"taxMethod"`
+	Rates       TaxRates          `json:"rates"`
+	Incomes     []IncomeResult    `json:"incomes,omitempty"`
+	Allowances  []AllowanceResult `json:"allowances,omitempty"`
+	Dividend    *DividendResult   `json:"dividend,omitempty"`
+	Explanation *Explanation      `json:"explanation,omitempty"`
 }
 
 type TaxResponse struct {
-	TotalIncome float64 `json:"totalIncome"`
-	Tax         float64 `json:"tax"`
+	TaxYear     int         `json:"taxYear"`
+	TotalIncome money.Money `json:"totalIncome"`
+	Tax         money.Money `json:"tax"`
+	Rates       TaxRates    `json:"rates"`
 }
@@ -0,0 +1,134 @@
+package tax
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+// TaxBracket is one step of the progressive tax table. An UpperBound of zero
+// means the bracket has no upper limit.
+type TaxBracket struct {
+	LowerBound money.Money
+	UpperBound money.Money
+	Rate       money.Rate
+	Label      string
+}
+
+var defaultTaxBrackets = []TaxBracket{
+	{LowerBound: money.New(0), UpperBound: money.New(150000), Rate: 0, Label: "0-150,000"},
+	{LowerBound: money.New(150000), UpperBound: money.New(500000), Rate: 10 * money.Percent, Label: "150,001-500,000"},
+	{LowerBound: money.New(500000), UpperBound: money.New(1000000), Rate: 15 * money.Percent, Label: "500,001-1,000,000"},
+	{LowerBound: money.New(1000000), UpperBound: money.New(2000000), Rate: 20 * money.Percent, Label: "1,000,001-2,000,000"},
+	{LowerBound: money.New(2000000), UpperBound: 0, Rate: 35 * money.Percent, Label: "2,000,001 ขึ้นไป"},
+}
+
+// ValidateBrackets checks that a bracket table starts at zero, has no gaps
+// or overlaps and ends with an open bracket.
+func ValidateBrackets(brackets []TaxBracket) error {
+	if len(brackets) == 0 {
+		return errors.New("at least one bracket is required")
+	}
+	if brackets[0].LowerBound != 0 {
+		return errors.New("the first bracket must start at 0")
+	}
+	for i, b := range brackets {
+		if b.Label == "" {
+			return fmt.Errorf("bracket %d: label is required", i+1)
+		}
+		if b.Rate < 0 || b.Rate > 100*money.Percent {
+			return fmt.Errorf("bracket %d: rate must be between 0 and 1", i+1)
+		}
+		if i > 0 && b.LowerBound != brackets[i-1].UpperBound {
+			return fmt.Errorf("bracket %d: must start where bracket %d ends", i+1, i)
+		}
+		last := i == len(brackets)-1
+		if last && b.UpperBound != 0 {
+			return errors.New("the last bracket must have no upper bound")
+		}
+		if !last && b.UpperBound <= b.LowerBound {
+			return fmt.Errorf("bracket %d: upper bound must be greater than lower bound", i+1)
+		}
+	}
+	return nil
+}
+
+func (b TaxBracket) incomeInBracket(taxableIncome money.Money) money.Money {
+	if taxableIncome <= b.LowerBound {
+		return 0
+	}
+	if b.UpperBound > 0 && taxableIncome > b.UpperBound {
+		return b.UpperBound - b.LowerBound
+	}
+	return taxableIncome - b.LowerBound
+}
+
+// getTaxBrackets returns the stored table for a year, or nil when there is
+// none. A stored table that fails ValidateBrackets is an error rather than
+// silently producing wrong tax.
+func getTaxBrackets(db querier, taxYear int) ([]TaxBracket, error) {
+	rows, err := db.Query("SELECT lower_bound, upper_bound, rate, label FROM taxbracket WHERE tax_year = $1 ORDER BY lower_bound", taxYear)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var brackets []TaxBracket
+	for rows.Next() {
+		var b TaxBracket
+		var upperBound *money.Money
+		if err := rows.Scan(&b.LowerBound, &upperBound, &b.Rate, &b.Label); err != nil {
+			return nil, err
+		}
+		if upperBound != nil {
+			b.UpperBound = *upperBound
+		}
+		brackets = append(brackets, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(brackets) > 0 {
+		if err := ValidateBrackets(brackets); err != nil {
+			return nil, fmt.Errorf("invalid tax brackets for %d: %w", taxYear, err)
+		}
+	}
+	return brackets, nil
+}
+
+// SeedTaxBrackets stores the built-in bracket table for each built-in year
+// that has no rows yet, so a fresh database holds the brackets it calculates
+// with. Years that already have rows are left alone.
+func SeedTaxBrackets(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, year := range BuiltInTaxYears() {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM taxbracket WHERE tax_year = $1)", year).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		for _, b := range defaultTaxRules[year].Brackets {
+			var upperBound *money.Money
+			if b.UpperBound != 0 {
+				upper := b.UpperBound
+				upperBound = &upper
+			}
+			_, err := tx.Exec("INSERT INTO taxbracket (lower_bound, upper_bound, rate, label, tax_year) VALUES ($1, $2, $3, $4, $5)",
+				b.LowerBound, upperBound, b.Rate, b.Label, year)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,48 @@
+package tax
+
+import (
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+// TaxRates summarises where a taxpayer sits in the bracket table. The
+// effective rates use the tax due before withholding is credited.
+type TaxRates struct {
+	MarginalBracket      string       `json:"marginalBracket"`
+	MarginalRate         money.Rate   `json:"marginalRate"`
+	EffectiveRate        money.Rate   `json:"effectiveRate"`
+	EffectiveTaxableRate money.Rate   `json:"effectiveTaxableRate"`
+	NextBracket          string       `json:"nextBracket,omitempty"`
+	ToNextBracket        *money.Money `json:"toNextBracket,omitempty"`
+}
+
+func calculateTaxRates(grossIncome, taxableIncome, tax money.Money, brackets []TaxBracket, rounding money.RoundingMode) TaxRates {
+	taxableIncome = money.Max(taxableIncome, 0)
+	rates := TaxRates{
+		EffectiveRate:        money.RateOf(tax, grossIncome, rounding),
+		EffectiveTaxableRate: money.RateOf(tax, taxableIncome, rounding),
+	}
+
+	i := marginalBracket(taxableIncome, brackets)
+	if i < 0 {
+		return rates
+	}
+	rates.MarginalBracket = brackets[i].Label
+	rates.MarginalRate = brackets[i].Rate
+	if i+1 < len(brackets) {
+		toNext := brackets[i].UpperBound - taxableIncome
+		rates.NextBracket = brackets[i+1].Label
+		rates.ToNextBracket = &toNext
+	}
+	return rates
+}
+
+// marginalBracket returns the index of the bracket the last satang of
+// taxable income falls in. Income on a boundary belongs to the lower bracket.
+func marginalBracket(taxableIncome money.Money, brackets []TaxBracket) int {
+	for i, b := range brackets {
+		if b.UpperBound == 0 || taxableIncome <= b.UpperBound {
+			return i
+		}
+	}
+	return len(brackets) - 1
+}
@@ -0,0 +1,323 @@
+package tax
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Ter4798/post-test-kbtg/money"
+)
+
+const DefaultTaxYear = 2567
+
+var ErrUnsupportedTaxYear = errors.New("tax year is not supported")
+
+// querier is satisfied by both *sql.DB and *sql.Tx so rules can be read
+// inside a transaction when several years must come from one snapshot.
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+type TaxRules struct {
+	TaxYear     int
+	Brackets    []TaxBracket
+	Limits      map[string]money.Money
+	Multipliers map[string]money.Rate
+	IncomeRates map[string]money.Rate
+	Rounding    RoundingPolicy
+	Version     string `json:"-"`
+}
+
+// RoundingPolicy selects how each calculation step rounds to the satang.
+// The zero value is HalfUp everywhere, so built-in rules set every step.
+type RoundingPolicy struct {
+	TaxLevel            money.RoundingMode `json:"taxLevel"`
+	Expense             money.RoundingMode `json:"expense"`
+	MinimumTax          money.RoundingMode `json:"minimumTax"`
+	Allowance           money.RoundingMode `json:"allowance"`
+	IncomeCap           money.RoundingMode `json:"incomeCap"`
+	HalfYear            money.RoundingMode `json:"halfYear"`
+	DividendWithholding money.RoundingMode `json:"dividendWithholding"`
+	DividendCredit      money.RoundingMode `json:"dividendCredit"`
+	Withholding         money.RoundingMode `json:"withholding"`
+	Rate                money.RoundingMode `json:"rate"`
+}
+
+var defaultRounding = RoundingPolicy{
+	TaxLevel:            money.HalfUp,
+	Expense:             money.HalfUp,
+	MinimumTax:          money.HalfUp,
+	Allowance:           money.HalfUp,
+	IncomeCap:           money.Down,
+	HalfYear:            money.HalfUp,
+	DividendWithholding: money.HalfUp,
+	DividendCredit:      money.Down,
+	Withholding:         money.HalfUp,
+	Rate:                money.HalfUp,
+}
+
+// step returns the field for a step name as used in the taxrounding table.
+func (p *RoundingPolicy) step(name string) (*money.RoundingMode, bool) {
+	steps := map[string]*money.RoundingMode{
+		"taxLevel":            &p.TaxLevel,
+		"expense":             &p.Expense,
+		"minimumTax":          &p.MinimumTax,
+		"allowance":           &p.Allowance,
+		"incomeCap":           &p.IncomeCap,
+		"halfYear":            &p.HalfYear,
+		"dividendWithholding": &p.DividendWithholding,
+		"dividendCredit":      &p.DividendCredit,
+		"withholding":         &p.Withholding,
+		"rate":                &p.Rate,
+	}
+	mode, ok := steps[name]
+	return mode, ok
+}
+
+// roundingSteps lists the step names in the order of RoundingPolicy.
+var roundingSteps = []string{"taxLevel", "expense", "minimumTax", "allowance", "incomeCap", "halfYear",
+	"dividendWithholding", "dividendCredit", "withholding", "rate"}
+
+// Steps returns the mode of every step by its taxrounding name.
+func (p RoundingPolicy) Steps() map[string]string {
+	steps := make(map[string]string, len(roundingSteps))
+	for _, name := range roundingSteps {
+		mode, _ := p.step(name)
+		steps[name] = mode.String()
+	}
+	return steps
+}
+
+// ValidateRounding checks step and mode names as stored in taxrounding.
+func ValidateRounding(steps map[string]string) error {
+	var p RoundingPolicy
+	names := make([]string, 0, len(steps))
+	for name := range steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := p.step(name); !ok {
+			return fmt.Errorf("unknown rounding step %q", name)
+		}
+		if _, err := money.ParseRoundingMode(steps[name]); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+var defaultTaxRules = map[int]TaxRules{
+	2566: {
+		TaxYear:  2566,
+		Brackets: defaultTaxBrackets,
+		Rounding: defaultRounding,
+		Limits: map[string]money.Money{
+			"personal":  money.New(60000),
+			"donation":  money.New(100000),
+			"k-receipt": money.New(40000),
+		},
+	},
+	2567: {
+		TaxYear:  2567,
+		Brackets: defaultTaxBrackets,
+		Rounding: defaultRounding,
+		Limits: map[string]money.Money{
+			"personal":  money.New(60000),
+			"donation":  money.New(100000),
+			"k-receipt": money.New(50000),
+		},
+	},
+	2568: {
+		TaxYear:  2568,
+		Brackets: defaultTaxBrackets,
+		Rounding: defaultRounding,
+		Limits: map[string]money.Money{
+			"personal":  money.New(60000),
+			"donation":  money.New(100000),
+			"k-receipt": money.New(50000),
+		},
+	},
+}
+
+// BuiltInTaxYears lists the years the calculator supports without a bracket
+// table in the database.
+func BuiltInTaxYears() []int {
+	years := make([]int, 0, len(defaultTaxRules))
+	for year := range defaultTaxRules {
+		years = append(years, year)
+	}
+	sort.Ints(years)
+	return years
+}
+
+func resolveTaxYear(taxYear int) int {
+	if taxYear == 0 {
+		return DefaultTaxYear
+	}
+	return taxYear
+}
+
+// Limit returns the limit for an allowance type, falling back to the
+// registry default when the year does not override it.
+func (r TaxRules) Limit(t AllowanceType) money.Money {
+	if limit, ok := r.Limits[t.Name]; ok {
+		return limit
+	}
+	return t.DefaultLimit
+}
+
+func (r TaxRules) Multiplier(t AllowanceType) money.Rate {
+	if multiplier, ok := r.Multipliers[t.Name]; ok {
+		return multiplier
+	}
+	return t.DefaultMultiplier
+}
+
+func (r TaxRules) IncomeRate(t AllowanceType) money.Rate {
+	if rate, ok := r.IncomeRates[t.Name]; ok {
+		return rate
+	}
+	return t.DefaultIncomeRate
+}
+
+// Override replaces the stored setting of one allowance type while rules
+// are loaded, exactly as if it had been saved, so a change can be previewed
+// without persisting it.
+type Override struct {
+	AllowanceType string
+	Limit         money.Money
+	Multiplier    *money.Rate
+	IncomeRate    *money.Rate
+}
+
+// getTaxRules starts from the built-in rules for the year and applies any
+// brackets and limits stored in the database. Years without built-in rules
+// are only accepted when the database has a bracket table for them.
+func getTaxRules(db querier, taxYear int, asOf time.Time, overrides ...Override) (TaxRules, error) {
+	taxYear = resolveTaxYear(taxYear)
+
+	base, configured := defaultTaxRules[taxYear]
+	if !configured {
+		base = defaultTaxRules[DefaultTaxYear]
+	}
+	rules := TaxRules{
+		TaxYear:     taxYear,
+		Brackets:    base.Brackets,
+		Limits:      make(map[string]money.Money),
+		Multipliers: make(map[string]money.Rate),
+		IncomeRates: make(map[string]money.Rate),
+		Rounding:    base.Rounding,
+	}
+
+	brackets, err := getTaxBrackets(db, taxYear)
+	if err != nil {
+		return TaxRules{}, err
+	}
+	if len(brackets) > 0 {
+		rules.Brackets = brackets
+	} else if !configured {
+		return TaxRules{}, ErrUnsupportedTaxYear
+	}
+
+	rules.Rounding, err = getTaxRounding(db, taxYear, rules.Rounding)
+	if err != nil {
+		return TaxRules{}, err
+	}
+
+	deductions, err := getDeductions(db, taxYear, asOf)
+	if err != nil {
+		return TaxRules{}, err
+	}
+	for _, o := range overrides {
+		if t, ok := LookupAllowanceType(o.AllowanceType); ok {
+			deductions[t.SettingName] = deduction{Amount: o.Limit, Multiplier: o.Multiplier, IncomeRate: o.IncomeRate}
+		}
+	}
+	for _, t := range allowanceTypes {
+		rules.Limits[t.Name] = base.Limit(t)
+		rules.Multipliers[t.Name] = base.Multiplier(t)
+		rules.IncomeRates[t.Name] = base.IncomeRate(t)
+
+		d, ok := deductions[t.SettingName]
+		if !ok {
+			continue
+		}
+		rules.Limits[t.Name] = d.Amount
+		if d.Multiplier != nil {
+			rules.Multipliers[t.Name] = *d.Multiplier
+		}
+		if d.IncomeRate != nil {
+			rules.IncomeRates[t.Name] = *d.IncomeRate
+		}
+	}
+
+	rules.Version, err = rulesVersion(rules)
+	if err != nil {
+		return TaxRules{}, err
+	}
+
+	return rules, nil
+}
+
+// getTaxRounding applies the steps stored for a year on top of base.
+func getTaxRounding(db querier, taxYear int, base RoundingPolicy) (RoundingPolicy, error) {
+	rows, err := db.Query("SELECT step, mode FROM taxrounding WHERE tax_year = $1", taxYear)
+	if err != nil {
+		return base, err
+	}
+	defer rows.Close()
+
+	policy := base
+	for rows.Next() {
+		var step, name string
+		if err := rows.Scan(&step, &name); err != nil {
+			return base, err
+		}
+		field, ok := policy.step(step)
+		if !ok {
+			return base, fmt.Errorf("invalid rounding step %q for %d", step, taxYear)
+		}
+		mode, err := money.ParseRoundingMode(name)
+		if err != nil {
+			return base, fmt.Errorf("invalid rounding for %s in %d: %w", step, taxYear, err)
+		}
+		*field = mode
+	}
+	return policy, rows.Err()
+}
+
+// getTaxRulesSnapshot loads the rules for several years inside one read-only
+// transaction so an admin update cannot land between two of the reads.
+func getTaxRulesSnapshot(ctx context.Context, db *sql.DB, taxYears []int) (map[int]TaxRules, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	asOf := time.Now()
+	rules := make(map[int]TaxRules)
+	for _, year := range taxYears {
+		year = resolveTaxYear(year)
+		if _, ok := rules[year]; ok {
+			continue
+		}
+		r, err := getTaxRules(tx, year, asOf)
+		if err != nil {
+			return nil, err
+		}
+		rules[year] = r
+	}
+	return rules, tx.Commit()
+}
+
+// LoadTaxRules returns the rules the calculator applies for a tax year at
+// asOf, with the database settings and then any overrides on top of the
+// built-in defaults.
+func LoadTaxRules(db *sql.DB, taxYear int, asOf time.Time, overrides ...Override) (TaxRules, error) {
+	return getTaxRules(db, taxYear, asOf, overrides...)
+}
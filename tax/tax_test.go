@@ -1,79 +1,120 @@
 package tax
 
 import (
+	"database/sql/driver"
 	"errors"
+	"strings"
 	"testing"
+
+	"github.com/Ter4798/post-test-kbtg/internal/fakedb"
+	"github.com/Ter4798/post-test-kbtg/money"
 )
 
 func TestCalculateDeductions(t *testing.T) {
 	testCases := []struct {
 		name           string
 		allowances     []Allowance
-		maxDonation    float64
-		maxKReceipt    float64
-		expectedResult float64
+		maxDonation    money.Money
+		maxKReceipt    money.Money
+		expectedResult money.Money
+		expectedTypes  []AllowanceResult
 	}{
 		{
 			name:           "No allowances",
 			allowances:     []Allowance{},
-			maxDonation:    100000,
-			maxKReceipt:    50000,
-			expectedResult: 0,
+			maxDonation:    money.New(100000),
+			maxKReceipt:    money.New(50000),
+			expectedResult: money.New(0),
 		},
 		{
 			name: "Single donation within limit",
 			allowances: []Allowance{
-				{AllowanceType: "donation", Amount: 50000},
+				{AllowanceType: "donation", Amount: money.New(50000)},
 			},
-			maxDonation:    100000,
-			maxKReceipt:    50000,
-			expectedResult: 50000,
+			maxDonation:    money.New(100000),
+			maxKReceipt:    money.New(50000),
+			expectedResult: money.New(50000),
 		},
 		{
 			name: "Single donation exceeding limit",
 			allowances: []Allowance{
-				{AllowanceType: "donation", Amount: 150000},
+				{AllowanceType: "donation", Amount: money.New(150000)},
 			},
-			maxDonation:    100000,
-			maxKReceipt:    50000,
-			expectedResult: 100000,
+			maxDonation:    money.New(100000),
+			maxKReceipt:    money.New(50000),
+			expectedResult: money.New(100000),
 		},
 		{
 			name: "Single k-receipt within limit",
 			allowances: []Allowance{
-				{AllowanceType: "k-receipt", Amount: 30000},
+				{AllowanceType: "k-receipt", Amount: money.New(30000)},
 			},
-			maxDonation:    100000,
-			maxKReceipt:    50000,
-			expectedResult: 30000,
+			maxDonation:    money.New(100000),
+			maxKReceipt:    money.New(50000),
+			expectedResult: money.New(30000),
 		},
 		{
 			name: "Single k-receipt exceeding limit",
 			allowances: []Allowance{
-				{AllowanceType: "k-receipt", Amount: 60000},
+				{AllowanceType: "k-receipt", Amount: money.New(60000)},
 			},
-			maxDonation:    100000,
-			maxKReceipt:    50000,
-			expectedResult: 50000,
+			maxDonation:    money.New(100000),
+			maxKReceipt:    money.New(50000),
+			expectedResult: money.New(50000),
 		},
 		{
 			name: "Multiple allowances",
 			allowances: []Allowance{
-				{AllowanceType: "donation", Amount: 80000},
-				{AllowanceType: "k-receipt", Amount: 40000},
-				{AllowanceType: "donation", Amount: 30000},
+				{AllowanceType: "donation", Amount: money.New(80000)},
+				{AllowanceType: "k-receipt", Amount: money.New(40000)},
+				{AllowanceType: "donation", Amount: money.New(30000)},
+			},
+			maxDonation:    money.New(100000),
+			maxKReceipt:    money.New(50000),
+			expectedResult: money.New(140000),
+			expectedTypes: []AllowanceResult{
+				{AllowanceType: "k-receipt", Claimed: money.New(40000), Allowed: money.New(40000)},
+				{AllowanceType: "donation", Claimed: money.New(110000), Allowed: money.New(100000)},
+			},
+		},
+		{
+			name: "Repeated k-receipt entries share one cap",
+			allowances: []Allowance{
+				{AllowanceType: "k-receipt", Amount: money.New(30000)},
+				{AllowanceType: "k-receipt", Amount: money.New(30000)},
+			},
+			maxDonation:    money.New(100000),
+			maxKReceipt:    money.New(50000),
+			expectedResult: money.New(50000),
+			expectedTypes: []AllowanceResult{
+				{AllowanceType: "k-receipt", Claimed: money.New(60000), Allowed: money.New(50000)},
 			},
-			maxDonation:    100000,
-			maxKReceipt:    50000,
-			expectedResult: 150000,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := calculateDeductions(tc.allowances, tc.maxDonation, tc.maxKReceipt)
+			rules := TaxRules{
+				Limits: map[string]money.Money{
+					"personal":  0,
+					"donation":  tc.maxDonation,
+					"k-receipt": tc.maxKReceipt,
+				},
+			}
+			steps, result := calculateDeductions(Request{Allowances: tc.allowances}, rules, money.New(2000000))
+			types := allowanceResults(steps)
 			if result != tc.expectedResult {
-				t.Errorf("Expected %f, got %f", tc.expectedResult, result)
+				t.Errorf("Expected %v, got %v", tc.expectedResult, result)
+			}
+			if tc.expectedTypes != nil {
+				if len(types) != len(tc.expectedTypes) {
+					t.Fatalf("Expected %d allowance types, got %d", len(tc.expectedTypes), len(types))
+				}
+				for i, got := range types {
+					if got != tc.expectedTypes[i] {
+						t.Errorf("Expected %+v, got %+v", tc.expectedTypes[i], got)
+					}
+				}
 			}
 		})
 	}
@@ -81,68 +122,69 @@ func TestCalculateDeductions(t *testing.T) {
 
 func TestCalculateTaxableIncome(t *testing.T) {
 	testCases := []struct {
-		totalIncome    float64
-		totalDeduction float64
-		want           float64
+		totalIncome    money.Money
+		totalDeduction money.Money
+		want           money.Money
 	}{
-		{100000.0, 60000.0, 40000.0},
-		{500000.0, 60000.0, 440000.0},
-		{1500000.0, 60000.0, 1440000.0},
+		{money.New(100000), money.New(60000), money.New(40000)},
+		{money.New(500000), money.New(60000), money.New(440000)},
+		{money.New(1500000), money.New(60000), money.New(1440000)},
 	}
 
 	for _, tc := range testCases {
 		got := calculateTaxableIncome(tc.totalIncome, tc.totalDeduction)
 		if got != tc.want {
-			t.Errorf("calculateTaxableIncome(%f, %f) returned %f, expected %f", tc.totalIncome, tc.totalDeduction, got, tc.want)
+			t.Errorf("calculateTaxableIncome(%v, %v) returned %v, expected %v", tc.totalIncome, tc.totalDeduction, got, tc.want)
 		}
 	}
 }
 
 func TestCalculateGraduatedTax(t *testing.T) {
 	testCases := []struct {
-		taxableIncome float64
-		want          float64
+		taxableIncome money.Money
+		want          money.Money
 	}{
-		{0, 0},
-		{149999.99, 0},
-		{150000, 0},
-		{325000, 17500},
-		{499999.99, 34999.999},
-		{500000, 35000},
-		{750000, 72500},
-		{999999.99, 109999.9985},
-		{1000000, 110000},
-		{1500000, 210000},
-		{1999999.99, 309999.998},
-		{2000000, 310000},
-		{3000000, 660000},
-		{4000000, 1010000},
-		{10000000, 3110000},
+		{money.New(0), money.New(0)},
+		{money.MustParse("149999.99"), money.New(0)},
+		{money.New(150000), money.New(0)},
+		{money.MustParse("150000.05"), money.MustParse("0.01")},
+		{money.New(325000), money.New(17500)},
+		{money.MustParse("499999.99"), money.New(35000)},
+		{money.New(500000), money.New(35000)},
+		{money.New(750000), money.New(72500)},
+		{money.MustParse("999999.99"), money.New(110000)},
+		{money.New(1000000), money.New(110000)},
+		{money.New(1500000), money.New(210000)},
+		{money.MustParse("1999999.99"), money.New(310000)},
+		{money.New(2000000), money.New(310000)},
+		{money.New(3000000), money.New(660000)},
+		{money.New(4000000), money.New(1010000)},
+		{money.New(10000000), money.New(3110000)},
 	}
 
 	for _, tc := range testCases {
-		got := calculateGraduatedTax(tc.taxableIncome)
+		got := calculateGraduatedTax(tc.taxableIncome, defaultTaxBrackets, money.HalfUp)
 		if got != tc.want {
-			t.Errorf("calculateGraduatedTax(%f) returned %f, expected %f", tc.taxableIncome, got, tc.want)
+			t.Errorf("calculateGraduatedTax(%v) returned %v, expected %v", tc.taxableIncome, got, tc.want)
 		}
 	}
 }
 
 func TestCalculateNetTaxAndRefund(t *testing.T) {
 	testCases := []struct {
-		tax      float64
-		wht      float64
-		expected []float64
+		tax      money.Money
+		wht      money.Money
+		expected []money.Money
 	}{
 		{
-			tax:      100.0,
-			wht:      20.0,
-			expected: []float64{80.0, 0.0},
+			tax:      money.New(100),
+			wht:      money.New(20),
+			expected: []money.Money{money.New(80), money.New(0)},
 		},
 		{
-			tax:      50.0,
-			wht:      50.0,
-			expected: []float64{0.0, 0.0},
+			tax:      money.New(50),
+			wht:      money.New(50),
+			expected: []money.Money{money.New(0), money.New(0)},
 		},
 	}
 
@@ -159,9 +201,9 @@ func TestValidateTotalIncome(t *testing.T) {
 		request       Request
 		expectedError error
 	}{
-		{Request{TotalIncome: 100000.0}, nil},
-		{Request{TotalIncome: 0.0}, errors.New("totalIncome must be greater than zero")},
-		{Request{TotalIncome: -50000.0}, errors.New("totalIncome must be greater than zero")},
+		{Request{TotalIncome: money.New(100000)}, nil},
+		{Request{TotalIncome: money.New(0)}, errors.New("totalIncome must be greater than zero")},
+		{Request{TotalIncome: money.New(-50000)}, errors.New("totalIncome must be greater than zero")},
 	}
 
 	for _, tc := range testCases {
@@ -178,16 +220,16 @@ func TestValidateWHT(t *testing.T) {
 		expectedError error
 	}{
 		{Request{
-			WHT:         100,
-			TotalIncome: 1000,
+			WHT:         money.New(100),
+			TotalIncome: money.New(1000),
 		}, nil},
 		{Request{
-			WHT:         -100,
-			TotalIncome: 1000,
+			WHT:         money.New(-100),
+			TotalIncome: money.New(1000),
 		}, errors.New("invalid WHT must be greater than zero and morn than TotalIncome")},
 		{Request{
-			WHT:         2000,
-			TotalIncome: 1000,
+			WHT:         money.New(2000),
+			TotalIncome: money.New(1000),
 		}, errors.New("invalid WHT must be greater than zero and morn than TotalIncome")},
 	}
 
@@ -210,18 +252,29 @@ func TestValidateAllowanceTypes(t *testing.T) {
 				{AllowanceType: "k-receipt"},
 			},
 		}, nil},
+		{Request{
+			Allowances: []Allowance{
+				{AllowanceType: "ssf"},
+				{AllowanceType: "home-loan-interest"},
+			},
+		}, nil},
+		{Request{
+			Allowances: []Allowance{
+				{AllowanceType: "personal"},
+			},
+		}, errors.New("invalid allowance type type should be donation-education, donation, k-receipt, life-insurance, health-insurance, ssf, rmf, provident-fund, social-security, home-loan-interest")},
 		{Request{
 			Allowances: []Allowance{
 				{AllowanceType: "invalid"},
 			},
-		}, errors.New("invalid allowance type type should be donation, k-receipt")},
+		}, errors.New("invalid allowance type type should be donation-education, donation, k-receipt, life-insurance, health-insurance, ssf, rmf, provident-fund, social-security, home-loan-interest")},
 		{Request{
 			Allowances: []Allowance{
 				{AllowanceType: "donation"},
 				{AllowanceType: "invalid"},
 				{AllowanceType: "k-receipt"},
 			},
-		}, errors.New("invalid allowance type type should be donation, k-receipt")},
+		}, errors.New("invalid allowance type type should be donation-education, donation, k-receipt, life-insurance, health-insurance, ssf, rmf, provident-fund, social-security, home-loan-interest")},
 	}
 
 	for _, tc := range testCases {
@@ -235,69 +288,72 @@ func TestValidateAllowanceTypes(t *testing.T) {
 func TestCalculateTaxLevels(t *testing.T) {
 	testCases := []struct {
 		name          string
-		taxableIncome float64
+		taxableIncome money.Money
 		expected      []TaxLevel
 	}{
 		{
 			name:          "No tax",
-			taxableIncome: 100000,
+			taxableIncome: money.New(100000),
 			expected: []TaxLevel{
-				{"0-150,000", 0.0},
-				{"150,001-500,000", 0.0},
-				{"500,001-1,000,000", 0.0},
-				{"1,000,001-2,000,000", 0.0},
-				{"2,000,001 ขึ้นไป", 0.0},
+				{"0-150,000", money.New(0)},
+				{"150,001-500,000", money.New(0)},
+				{"500,001-1,000,000", money.New(0)},
+				{"1,000,001-2,000,000", money.New(0)},
+				{"2,000,001 ขึ้นไป", money.New(0)},
 			},
 		},
 		{
 			name:          "First tax bracket",
-			taxableIncome: 300000,
+			taxableIncome: money.New(300000),
 			expected: []TaxLevel{
-				{"0-150,000", 0.0},
-				{"150,001-500,000", 15000.0},
-				{"500,001-1,000,000", 0.0},
-				{"1,000,001-2,000,000", 0.0},
-				{"2,000,001 ขึ้นไป", 0.0},
+				{"0-150,000", money.New(0)},
+				{"150,001-500,000", money.New(15000)},
+				{"500,001-1,000,000", money.New(0)},
+				{"1,000,001-2,000,000", money.New(0)},
+				{"2,000,001 ขึ้นไป", money.New(0)},
 			},
 		},
 		{
 			name:          "Second tax bracket",
-			taxableIncome: 750000,
+			taxableIncome: money.New(750000),
 			expected: []TaxLevel{
-				{"0-150,000", 0.0},
-				{"150,001-500,000", 35000.0},
-				{"500,001-1,000,000", 37500.0},
-				{"1,000,001-2,000,000", 0.0},
-				{"2,000,001 ขึ้นไป", 0.0},
+				{"0-150,000", money.New(0)},
+				{"150,001-500,000", money.New(35000)},
+				{"500,001-1,000,000", money.New(37500)},
+				{"1,000,001-2,000,000", money.New(0)},
+				{"2,000,001 ขึ้นไป", money.New(0)},
 			},
 		},
 		{
 			name:          "Third tax bracket",
-			taxableIncome: 1500000,
+			taxableIncome: money.New(1500000),
 			expected: []TaxLevel{
-				{"0-150,000", 0.0},
-				{"150,001-500,000", 35000.0},
-				{"500,001-1,000,000", 75000.0},
-				{"1,000,001-2,000,000", 100000.0},
-				{"2,000,001 ขึ้นไป", 0.0},
+				{"0-150,000", money.New(0)},
+				{"150,001-500,000", money.New(35000)},
+				{"500,001-1,000,000", money.New(75000)},
+				{"1,000,001-2,000,000", money.New(100000)},
+				{"2,000,001 ขึ้นไป", money.New(0)},
 			},
 		},
 		{
 			name:          "Fourth tax bracket",
-			taxableIncome: 3000000,
+			taxableIncome: money.New(3000000),
 			expected: []TaxLevel{
-				{"0-150,000", 0.0},
-				{"150,001-500,000", 35000.0},
-				{"500,001-1,000,000", 75000.0},
-				{"1,000,001-2,000,000", 200000.0},
-				{"2,000,001 ขึ้นไป", 350000.0},
+				{"0-150,000", money.New(0)},
+				{"150,001-500,000", money.New(35000)},
+				{"500,001-1,000,000", money.New(75000)},
+				{"1,000,001-2,000,000", money.New(200000)},
+				{"2,000,001 ขึ้นไป", money.New(350000)},
 			},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := calculateTaxLevels(tc.taxableIncome)
+			result := calculateTaxLevels(tc.taxableIncome, defaultTaxBrackets, money.HalfUp)
+			if len(result) != len(tc.expected) {
+				t.Fatalf("Expected %d tax levels, got %d", len(tc.expected), len(result))
+			}
 			for i, level := range result {
 				if level.Level != tc.expected[i].Level || level.Tax != tc.expected[i].Tax {
 					t.Errorf("Incorrect tax level calculation. Expected: %v, Got: %v", tc.expected[i], level)
@@ -306,3 +362,1155 @@ func TestCalculateTaxLevels(t *testing.T) {
 		})
 	}
 }
+
+func TestCalculateTaxWithCustomBrackets(t *testing.T) {
+	brackets := []TaxBracket{
+		{LowerBound: 0, UpperBound: money.New(100000), Rate: 0, Label: "0-100,000"},
+		{LowerBound: money.New(100000), UpperBound: 0, Rate: 25 * money.Percent, Label: "100,001 ขึ้นไป"},
+	}
+
+	levels := calculateTaxLevels(money.New(300000), brackets, money.HalfUp)
+	expected := []TaxLevel{
+		{"0-100,000", money.New(0)},
+		{"100,001 ขึ้นไป", money.New(50000)},
+	}
+	if len(levels) != len(expected) {
+		t.Fatalf("Expected %d tax levels, got %d", len(expected), len(levels))
+	}
+	for i, level := range levels {
+		if level != expected[i] {
+			t.Errorf("Incorrect tax level calculation. Expected: %v, Got: %v", expected[i], level)
+		}
+	}
+
+	if got := calculateGraduatedTax(money.New(300000), brackets, money.HalfUp); got != money.New(50000) {
+		t.Errorf("calculateGraduatedTax(300000) returned %v, expected 50000", got)
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	testCases := []struct {
+		name              string
+		request           Request
+		rules             TaxRules
+		expectedTax       money.Money
+		expectedTaxRefund money.Money
+	}{
+		{
+			name:        "Default year",
+			request:     Request{TotalIncome: money.New(500000)},
+			rules:       defaultTaxRules[2567],
+			expectedTax: money.New(29000),
+		},
+		{
+			name: "K-receipt capped by the year limit",
+			request: Request{
+				TaxYear:     2566,
+				TotalIncome: money.New(500000),
+				Allowances:  []Allowance{{AllowanceType: "k-receipt", Amount: money.New(50000)}},
+			},
+			rules:       defaultTaxRules[2566],
+			expectedTax: money.New(25000),
+		},
+		{
+			name:              "Refund when WHT exceeds tax",
+			request:           Request{TotalIncome: money.New(500000), WHT: money.New(30000)},
+			rules:             defaultTaxRules[2567],
+			expectedTaxRefund: money.New(1000),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := calculate(tc.request, tc.rules)
+			if resp.TaxYear != tc.rules.TaxYear {
+				t.Errorf("Expected tax year %d, got %d", tc.rules.TaxYear, resp.TaxYear)
+			}
+			if resp.Tax != tc.expectedTax || resp.TaxRefund != tc.expectedTaxRefund {
+				t.Errorf("Expected %v, %v but got %v, %v", tc.expectedTax, tc.expectedTaxRefund, resp.Tax, resp.TaxRefund)
+			}
+		})
+	}
+}
+
+func TestValidateTaxYear(t *testing.T) {
+	testCases := []struct {
+		request       Request
+		expectedError error
+	}{
+		{Request{}, nil},
+		{Request{TaxYear: 2566}, nil},
+		{Request{TaxYear: -1}, errors.New("taxYear must be greater than zero")},
+	}
+
+	for _, tc := range testCases {
+		err := validateTaxYear(&tc.request)
+		if (err == nil && tc.expectedError != nil) || (err != nil && err.Error() != tc.expectedError.Error()) {
+			t.Errorf("validateTaxYear(%+v) returned error %v, expected %v", tc.request, err, tc.expectedError)
+		}
+	}
+}
+
+func TestParseCsvTaxYear(t *testing.T) {
+	testCases := []struct {
+		name          string
+		content       string
+		expectedYears []int
+		expectedError error
+	}{
+		{
+			name:          "Without taxYear column",
+			content:       "totalIncome,wht,donation\n500000,0,0\n",
+			expectedYears: []int{0},
+		},
+		{
+			name:          "With taxYear column",
+			content:       "totalIncome,wht,donation,taxYear\n500000,0,0,2566\n600000,40000,20000,\n",
+			expectedYears: []int{2566, 0},
+		},
+		{
+			name:          "Invalid taxYear value",
+			content:       "totalIncome,wht,donation,taxYear\n500000,0,0,abc\n",
+			expectedError: errors.New("invalid taxYear value"),
+		},
+		{
+			name:          "Unknown extra column",
+			content:       "totalIncome,wht,donation,year\n500000,0,0,2566\n",
+			expectedError: errors.New("invalid header row"),
+		},
+		{
+			name:          "Allowance columns before taxYear",
+			content:       "totalIncome,wht,donation,k-receipt,taxYear\n500000,0,0,50000,2566\n",
+			expectedYears: []int{2566},
+		},
+		{
+			name:          "Duplicate allowance column",
+			content:       "totalIncome,wht,donation,k-receipt,k-receipt\n500000,0,0,1,1\n",
+			expectedError: errors.New("invalid header row"),
+		},
+		{
+			name:          "Invalid allowance value",
+			content:       "totalIncome,wht,donation,k-receipt\n500000,0,0,-1\n",
+			expectedError: errors.New("invalid k-receipt value"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			requests, err := ParseCsv(strings.NewReader(tc.content), "taxes.csv")
+			if tc.expectedError != nil {
+				if err == nil || err.Error() != tc.expectedError.Error() {
+					t.Fatalf("Expected error %v, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if len(requests) != len(tc.expectedYears) {
+				t.Fatalf("Expected %d requests, got %d", len(tc.expectedYears), len(requests))
+			}
+			for i, req := range requests {
+				if req.TaxYear != tc.expectedYears[i] {
+					t.Errorf("Expected tax year %d, got %d", tc.expectedYears[i], req.TaxYear)
+				}
+			}
+		})
+	}
+}
+
+func TestCalculateDeductionsWithRegistry(t *testing.T) {
+	req := Request{
+		TotalIncome: money.New(500000),
+		Allowances: []Allowance{
+			{AllowanceType: "ssf", Amount: money.New(200000)},
+			{AllowanceType: "health-insurance", Amount: money.New(30000)},
+		},
+	}
+
+	steps, result := calculateDeductions(req, defaultTaxRules[2567], req.TotalIncome)
+	types := allowanceResults(steps)
+
+	expected := []AllowanceResult{
+		{AllowanceType: "personal", Claimed: money.New(60000), Allowed: money.New(60000)},
+		{AllowanceType: "health-insurance", Claimed: money.New(30000), Allowed: money.New(25000)},
+		{AllowanceType: "ssf", Claimed: money.New(200000), Allowed: money.New(150000)},
+	}
+	if len(types) != len(expected) {
+		t.Fatalf("Expected %d allowance types, got %d", len(expected), len(types))
+	}
+	for i, got := range types {
+		if got != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], got)
+		}
+	}
+	if result != money.New(235000) {
+		t.Errorf("Expected total deduction 235000, got %v", result)
+	}
+}
+
+func TestCalculateDeductionsWithProfile(t *testing.T) {
+	req := Request{
+		TaxYear:     2567,
+		TotalIncome: money.New(1000000),
+		Profile: &TaxpayerProfile{
+			Spouse: &Spouse{HasIncome: false},
+			Children: []Child{
+				{BirthYear: 2563},
+				{BirthYear: 2540},
+				{BirthYear: 2555},
+				{BirthYear: 2562},
+			},
+			Parents: []Parent{
+				{Age: 65, Income: money.New(0)},
+				{Age: 55, Income: money.New(0)},
+				{Age: 70, Income: money.New(50000)},
+			},
+			DisabledDependents: 1,
+		},
+	}
+
+	steps, result := calculateDeductions(req, defaultTaxRules[2567], req.TotalIncome)
+	types := allowanceResults(steps)
+
+	expected := []AllowanceResult{
+		{AllowanceType: "personal", Claimed: money.New(60000), Allowed: money.New(60000)},
+		{AllowanceType: "spouse", Claimed: money.New(60000), Allowed: money.New(60000)},
+		{AllowanceType: "child", Claimed: money.New(30000), Allowed: money.New(30000)},
+		{AllowanceType: "child-2018", Claimed: money.New(120000), Allowed: money.New(120000)},
+		{AllowanceType: "parent", Claimed: money.New(30000), Allowed: money.New(30000)},
+		{AllowanceType: "disabled-dependent", Claimed: money.New(60000), Allowed: money.New(60000)},
+	}
+	if len(types) != len(expected) {
+		t.Fatalf("Expected %d allowance types, got %d: %+v", len(expected), len(types), types)
+	}
+	for i, got := range types {
+		if got != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], got)
+		}
+	}
+	if result != money.New(360000) {
+		t.Errorf("Expected total deduction 360000, got %v", result)
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	testCases := []struct {
+		request       Request
+		expectedError error
+	}{
+		{Request{}, nil},
+		{Request{Profile: &TaxpayerProfile{Spouse: &Spouse{}, Children: []Child{{BirthYear: 2560}}}}, nil},
+		{Request{Profile: &TaxpayerProfile{Parents: make([]Parent, 5)}}, errors.New("invalid profile at most 4 parents can be claimed")},
+		{Request{Profile: &TaxpayerProfile{Children: []Child{{}}}}, errors.New("invalid profile child birthYear must be greater than zero")},
+		{Request{Profile: &TaxpayerProfile{DisabledDependents: -1}}, errors.New("invalid profile disabledDependents must not be negative")},
+		{Request{Profile: &TaxpayerProfile{DisabledDependents: 6}}, nil},
+		{Request{Profile: &TaxpayerProfile{DisabledDependents: 7}}, errors.New("invalid profile at most 6 disabledDependents can be claimed")},
+		{Request{Profile: &TaxpayerProfile{Children: make([]Child, 1), DisabledDependents: 7}}, errors.New("invalid profile child birthYear must be greater than zero")},
+		{Request{Profile: &TaxpayerProfile{Children: []Child{{BirthYear: 2560}}, DisabledDependents: 7}}, nil},
+		{Request{TaxYear: 2566, Profile: &TaxpayerProfile{Children: []Child{{BirthYear: 2567}}}}, errors.New("invalid profile child birthYear must not be after taxYear")},
+	}
+
+	for _, tc := range testCases {
+		err := validateProfile(&tc.request)
+		if (err == nil && tc.expectedError != nil) || (err != nil && err.Error() != tc.expectedError.Error()) {
+			t.Errorf("validateProfile(%+v) returned error %v, expected %v", tc.request, err, tc.expectedError)
+		}
+	}
+}
+
+func TestCalculateExpenses(t *testing.T) {
+	actual := money.New(10000)
+	req := Request{
+		Incomes: []Income{
+			{Category: "40(8)", Amount: money.New(200000)},
+			{Category: "40(1)", Amount: money.New(100000)},
+			{Category: "40(2)", Amount: money.New(100000)},
+			{Category: "40(1)", Amount: money.New(50000)},
+			{Category: "40(5)", Amount: money.New(60000), Expense: &actual},
+			{Category: "40(4)", Amount: money.New(5000)},
+		},
+	}
+
+	incomes, netIncome := calculateExpenses(req, defaultTaxRules[2567])
+
+	expected := []IncomeResult{
+		{Category: "40(1)", Income: money.New(150000), Expense: money.New(75000), NetIncome: money.New(75000)},
+		{Category: "40(2)", Income: money.New(100000), Expense: money.New(25000), NetIncome: money.New(75000)},
+		{Category: "40(4)", Income: money.New(5000), Expense: money.New(0), NetIncome: money.New(5000)},
+		{Category: "40(5)", Income: money.New(60000), Expense: money.New(10000), NetIncome: money.New(50000)},
+		{Category: "40(8)", Income: money.New(200000), Expense: money.New(120000), NetIncome: money.New(80000)},
+	}
+	if len(incomes) != len(expected) {
+		t.Fatalf("Expected %d income categories, got %d", len(expected), len(incomes))
+	}
+	for i, got := range incomes {
+		if got != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], got)
+		}
+	}
+	if netIncome != money.New(285000) {
+		t.Errorf("Expected net income 285000, got %v", netIncome)
+	}
+
+	if _, netIncome := calculateExpenses(Request{TotalIncome: money.New(500000)}, defaultTaxRules[2567]); netIncome != money.New(500000) {
+		t.Errorf("Expected totalIncome to be used as is, got %v", netIncome)
+	}
+}
+
+func TestValidateIncomes(t *testing.T) {
+	actual := money.New(1000)
+	tooMuch := money.New(20000)
+	testCases := []struct {
+		request       Request
+		expectedError error
+	}{
+		{Request{Incomes: []Income{{Category: "40(1)", Amount: money.New(10000)}}}, nil},
+		{Request{Incomes: []Income{{Category: "40(9)", Amount: money.New(10000)}}}, errors.New("invalid income category should be 40(1) to 40(8)")},
+		{Request{Incomes: []Income{{Category: "40(1)", Amount: money.New(10000), Expense: &actual}}}, errors.New("invalid income expense actual expenses are only allowed for 40(5) to 40(8)")},
+		{Request{Incomes: []Income{{Category: "40(8)", Amount: money.New(10000), Expense: &tooMuch}}}, errors.New("invalid income expense must be between zero and the income amount")},
+	}
+
+	for _, tc := range testCases {
+		err := validateIncomes(&tc.request)
+		if (err == nil && tc.expectedError != nil) || (err != nil && err.Error() != tc.expectedError.Error()) {
+			t.Errorf("validateIncomes(%+v) returned error %v, expected %v", tc.request, err, tc.expectedError)
+		}
+	}
+
+	err := validateTotalIncome(&Request{TotalIncome: money.New(1), Incomes: []Income{{Category: "40(1)", Amount: money.New(2)}}})
+	if err == nil || err.Error() != "totalIncome must equal the sum of incomes" {
+		t.Errorf("validateTotalIncome returned error %v", err)
+	}
+}
+
+func TestMinimumTaxMethod(t *testing.T) {
+	highExpense := money.New(1900000)
+	testCases := []struct {
+		name     string
+		request  Request
+		expected TaxMethod
+	}{
+		{
+			name:     "Salary only",
+			request:  Request{TotalIncome: money.New(500000)},
+			expected: TaxMethod{Applied: TaxMethodProgressive, Progressive: money.New(29000)},
+		},
+		{
+			name: "Minimum tax is higher",
+			request: Request{Incomes: []Income{
+				{Category: "40(8)", Amount: money.New(2000000), Expense: &highExpense},
+			}},
+			expected: TaxMethod{Applied: TaxMethodMinimum, Progressive: money.New(0), Minimum: money.New(10000)},
+		},
+		{
+			name: "Minimum tax within the exemption",
+			request: Request{Incomes: []Income{
+				{Category: "40(8)", Amount: money.New(800000)},
+			}},
+			expected: TaxMethod{Applied: TaxMethodProgressive, Progressive: money.New(11000)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := calculate(tc.request, defaultTaxRules[2567])
+			if resp.TaxMethod != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, resp.TaxMethod)
+			}
+			if resp.Tax != tc.expected.tax() {
+				t.Errorf("Expected tax %v, got %v", tc.expected.tax(), resp.Tax)
+			}
+		})
+	}
+}
+
+func TestCalculateDonations(t *testing.T) {
+	testCases := []struct {
+		name       string
+		allowances []Allowance
+		rules      TaxRules
+		expected   []AllowanceResult
+	}{
+		{
+			name:       "General donation capped at 10% of income after allowances",
+			allowances: []Allowance{{AllowanceType: "donation", Amount: money.New(200000)}},
+			rules:      defaultTaxRules[2567],
+			expected: []AllowanceResult{
+				{AllowanceType: "personal", Claimed: money.New(60000), Allowed: money.New(60000)},
+				{AllowanceType: "donation", Claimed: money.New(200000), Allowed: money.New(44000)},
+			},
+		},
+		{
+			name: "Education donation doubled and applied first",
+			allowances: []Allowance{
+				{AllowanceType: "donation", Amount: money.New(50000)},
+				{AllowanceType: "donation-education", Amount: money.New(10000)},
+			},
+			rules: defaultTaxRules[2567],
+			expected: []AllowanceResult{
+				{AllowanceType: "personal", Claimed: money.New(60000), Allowed: money.New(60000)},
+				{AllowanceType: "donation-education", Claimed: money.New(10000), Allowed: money.New(20000)},
+				{AllowanceType: "donation", Claimed: money.New(50000), Allowed: money.New(42000)},
+			},
+		},
+		{
+			name:       "Configured multiplier and income rate",
+			allowances: []Allowance{{AllowanceType: "donation", Amount: money.New(100000)}},
+			rules: TaxRules{
+				Limits:      map[string]money.Money{"personal": money.New(60000)},
+				Multipliers: map[string]money.Rate{"donation": 150 * money.Percent},
+				IncomeRates: map[string]money.Rate{"donation": 20 * money.Percent},
+			},
+			expected: []AllowanceResult{
+				{AllowanceType: "personal", Claimed: money.New(60000), Allowed: money.New(60000)},
+				{AllowanceType: "donation", Claimed: money.New(100000), Allowed: money.New(88000)},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			steps, _ := calculateDeductions(Request{Allowances: tc.allowances}, tc.rules, money.New(500000))
+			types := allowanceResults(steps)
+			if len(types) != len(tc.expected) {
+				t.Fatalf("Expected %d allowance types, got %d: %+v", len(tc.expected), len(types), types)
+			}
+			for i, got := range types {
+				if got != tc.expected[i] {
+					t.Errorf("Expected %+v, got %+v", tc.expected[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestCalculateExplanation(t *testing.T) {
+	rules := defaultTaxRules[2567]
+	rules.Version = "test"
+	req := Request{
+		TotalIncome: money.New(500000),
+		WHT:         money.New(25000),
+		Allowances:  []Allowance{{AllowanceType: "k-receipt", Amount: money.New(60000)}},
+	}
+
+	if resp := calculate(req, rules); resp.Explanation != nil {
+		t.Fatalf("Expected no explanation unless requested")
+	}
+
+	req.Explain = true
+	resp := calculate(req, rules)
+	e := resp.Explanation
+	if e == nil {
+		t.Fatalf("Expected an explanation")
+	}
+
+	kReceiptCap := money.New(50000)
+	if len(e.Allowances) != 2 || e.Allowances[1].Cap == nil || *e.Allowances[1].Cap != kReceiptCap || e.Allowances[1].Applied != kReceiptCap {
+		t.Errorf("Unexpected allowance steps %+v", e.Allowances)
+	}
+	if e.ConfigVersion != "test" || e.GrossIncome != money.New(500000) || e.TaxableIncome != money.New(390000) {
+		t.Errorf("Unexpected explanation %+v", e)
+	}
+	if e.Brackets[1].Base != money.New(240000) || e.Brackets[1].Rate != 10*money.Percent || e.Brackets[1].Tax != money.New(24000) {
+		t.Errorf("Unexpected bracket step %+v", e.Brackets[1])
+	}
+	if e.GrossTax != money.New(24000) || e.NetTax != 0 || e.TaxRefund != money.New(1000) {
+		t.Errorf("Expected gross tax 24000 and refund 1000, got %+v", e)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	testCases := []struct {
+		name          string
+		request       PlanRequest
+		achieved      bool
+		contributions []Contribution
+		tax           money.Money
+	}{
+		{
+			name: "Zero tax reached",
+			request: PlanRequest{
+				Request:        Request{TotalIncome: money.New(300000)},
+				Goal:           PlanGoalZeroTax,
+				AllowanceTypes: []string{"rmf"},
+			},
+			achieved: true,
+			// 0.04 of taxable income above the bracket rounds to no tax.
+			contributions: []Contribution{
+				{AllowanceType: "rmf", Amount: money.MustParse("89999.96"), RemainingCap: money.MustParse("0.04")},
+			},
+			tax: money.New(0),
+		},
+		{
+			name: "Zero tax out of reach",
+			request: PlanRequest{
+				Request:        Request{TotalIncome: money.New(500000)},
+				Goal:           PlanGoalZeroTax,
+				AllowanceTypes: []string{"k-receipt", "rmf"},
+			},
+			achieved: false,
+			contributions: []Contribution{
+				{AllowanceType: "k-receipt", Amount: money.New(50000), RemainingCap: money.New(0)},
+				{AllowanceType: "rmf", Amount: money.New(150000), RemainingCap: money.New(0)},
+			},
+			tax: money.New(9000),
+		},
+		{
+			name: "Stay within a bracket",
+			request: PlanRequest{
+				Request:        Request{TotalIncome: money.New(800000)},
+				Goal:           PlanGoalBracket,
+				Bracket:        "150,001-500,000",
+				AllowanceTypes: []string{"life-insurance", "ssf"},
+			},
+			achieved: true,
+			contributions: []Contribution{
+				{AllowanceType: "life-insurance", Amount: money.New(100000), RemainingCap: money.New(0)},
+				{AllowanceType: "ssf", Amount: money.New(140000), RemainingCap: money.New(60000)},
+			},
+			tax: money.New(35000),
+		},
+		{
+			name: "Maximise refund uses the remaining cap",
+			request: PlanRequest{
+				Request: Request{
+					TotalIncome: money.New(500000),
+					WHT:         money.New(30000),
+					Allowances:  []Allowance{{AllowanceType: "k-receipt", Amount: money.New(20000)}},
+				},
+				Goal:           PlanGoalMaxRefund,
+				AllowanceTypes: []string{"k-receipt"},
+			},
+			achieved: true,
+			contributions: []Contribution{
+				{AllowanceType: "k-receipt", Amount: money.New(30000), RemainingCap: money.New(0)},
+			},
+			tax: money.New(0),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := plan(tc.request, defaultTaxRules[2567])
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if resp.Achieved != tc.achieved {
+				t.Errorf("Expected achieved %v, got %v", tc.achieved, resp.Achieved)
+			}
+			if len(resp.Contributions) != len(tc.contributions) {
+				t.Fatalf("Expected %d contributions, got %+v", len(tc.contributions), resp.Contributions)
+			}
+			for i, got := range resp.Contributions {
+				if got != tc.contributions[i] {
+					t.Errorf("Expected %+v, got %+v", tc.contributions[i], got)
+				}
+			}
+			if resp.Result.Tax != tc.tax {
+				t.Errorf("Expected tax %v, got %v", tc.tax, resp.Result.Tax)
+			}
+			if resp.Result.Explanation != nil {
+				t.Errorf("Expected no explanation in the result")
+			}
+		})
+	}
+}
+
+func TestPlanRemainingCap(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request PlanRequest
+	}{
+		{
+			name:    "Zero tax with every allowance type",
+			request: PlanRequest{Request: Request{TotalIncome: money.New(500000)}, Goal: PlanGoalZeroTax},
+		},
+		{
+			name:    "Maximise refund with every allowance type",
+			request: PlanRequest{Request: Request{TotalIncome: money.New(2000000), WHT: money.New(100000)}, Goal: PlanGoalMaxRefund},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rules := defaultTaxRules[2567]
+			resp, err := plan(tc.request, rules)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+
+			taxableIncome := func(extra ...Contribution) money.Money {
+				req := tc.request.Request
+				req.Explain = true
+				for _, c := range append(append([]Contribution(nil), resp.Contributions...), extra...) {
+					req.Allowances = append(req.Allowances, Allowance{AllowanceType: c.AllowanceType, Amount: c.Amount})
+				}
+				return calculate(req, rules).Explanation.TaxableIncome
+			}
+			planned := taxableIncome()
+
+			for _, c := range resp.Contributions {
+				extra := c.RemainingCap
+				if extra == 0 {
+					t, _ := LookupAllowanceType(c.AllowanceType)
+					extra = rules.Limit(t)
+				}
+				lowered := taxableIncome(Contribution{AllowanceType: c.AllowanceType, Amount: extra}) < planned
+				if lowered != (c.RemainingCap > 0) {
+					t.Errorf("Expected the remaining cap %v of %s to lower taxable income %v, lowered: %v",
+						c.RemainingCap, c.AllowanceType, planned, lowered)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareScenarios(t *testing.T) {
+	req := ScenarioRequest{
+		Base: Request{TotalIncome: money.New(500000)},
+		Scenarios: []Scenario{
+			{Name: "k-receipt", Changes: []byte(`{"allowances":[{"allowanceType":"k-receipt","amount":50000}]}`)},
+			{Name: "withheld", Changes: []byte(`{"wht":30000}`)},
+			{Name: "previous year", Changes: []byte(`{"taxYear":2566,"allowances":[{"allowanceType":"k-receipt","amount":50000}]}`)},
+		},
+	}
+	expected := []ScenarioDelta{
+		{Tax: money.New(-5000), TaxableIncome: money.New(-50000), TotalAllowance: money.New(50000)},
+		{Tax: money.New(-29000), TaxRefund: money.New(1000)},
+		{Tax: money.New(-4000), TaxableIncome: money.New(-40000), TotalAllowance: money.New(40000)},
+	}
+
+	scenarios, err := buildScenarios(req)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	rules := map[int]TaxRules{2566: defaultTaxRules[2566], 2567: defaultTaxRules[2567]}
+	resp := compareScenarios(req.Base, scenarios, rules)
+
+	if resp.Base.Tax != money.New(29000) {
+		t.Errorf("Expected base tax 29000, got %v", resp.Base.Tax)
+	}
+	if len(resp.Scenarios) != len(expected) {
+		t.Fatalf("Expected %d scenarios, got %d", len(expected), len(resp.Scenarios))
+	}
+	for i, got := range resp.Scenarios {
+		if got.Name != req.Scenarios[i].Name {
+			t.Errorf("Expected scenario %s, got %s", req.Scenarios[i].Name, got.Name)
+		}
+		if got.Delta != expected[i] {
+			t.Errorf("%s: expected delta %+v, got %+v", got.Name, expected[i], got.Delta)
+		}
+		if got.Result.Explanation != nil {
+			t.Errorf("%s: expected no explanation in the result", got.Name)
+		}
+	}
+}
+
+func TestBuildScenarios(t *testing.T) {
+	testCases := []struct {
+		name      string
+		scenarios []Scenario
+		expected  string
+	}{
+		{
+			name:     "No scenarios",
+			expected: "at least one scenario is required",
+		},
+		{
+			name:      "Missing name",
+			scenarios: []Scenario{{Changes: []byte(`{}`)}},
+			expected:  "scenario name is required",
+		},
+		{
+			name:      "Duplicate name",
+			scenarios: []Scenario{{Name: "a"}, {Name: "a"}},
+			expected:  "duplicate scenario name a",
+		},
+		{
+			name:      "Changes are not an object",
+			scenarios: []Scenario{{Name: "a", Changes: []byte(`[]`)}},
+			expected:  "scenario a: changes must be an object",
+		},
+		{
+			name:      "Invalid scenario request",
+			scenarios: []Scenario{{Name: "a", Changes: []byte(`{"wht":-1}`)}},
+			expected:  "scenario a: invalid WHT must be greater than zero and morn than TotalIncome",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := ScenarioRequest{Base: Request{TotalIncome: money.New(500000)}, Scenarios: tc.scenarios}
+			_, err := buildScenarios(req)
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("Expected error %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestCalculateTaxRates(t *testing.T) {
+	toNext := func(m money.Money) *money.Money { return &m }
+	testCases := []struct {
+		name     string
+		income   money.Money
+		expected TaxRates
+	}{
+		{
+			name:   "No taxable income",
+			income: money.New(0),
+			expected: TaxRates{
+				MarginalBracket: "0-150,000",
+				NextBracket:     "150,001-500,000",
+				ToNextBracket:   toNext(money.New(150000)),
+			},
+		},
+		{
+			name:   "Middle bracket",
+			income: money.New(500000),
+			expected: TaxRates{
+				MarginalBracket:      "150,001-500,000",
+				MarginalRate:         10 * money.Percent,
+				EffectiveRate:        money.MustParseRate("0.058"),
+				EffectiveTaxableRate: money.MustParseRate("0.0659"),
+				NextBracket:          "500,001-1,000,000",
+				ToNextBracket:        toNext(money.New(60000)),
+			},
+		},
+		{
+			name:   "Top bracket has no next bracket",
+			income: money.New(3060000),
+			expected: TaxRates{
+				MarginalBracket:      "2,000,001 ขึ้นไป",
+				MarginalRate:         35 * money.Percent,
+				EffectiveRate:        money.MustParseRate("0.2157"),
+				EffectiveTaxableRate: money.MustParseRate("0.22"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := calculate(Request{TotalIncome: tc.income}, defaultTaxRules[2567]).Rates
+			if (got.ToNextBracket == nil) != (tc.expected.ToNextBracket == nil) ||
+				got.ToNextBracket != nil && *got.ToNextBracket != *tc.expected.ToNextBracket {
+				t.Errorf("Expected toNextBracket %v, got %v", tc.expected.ToNextBracket, got.ToNextBracket)
+			}
+			got.ToNextBracket, tc.expected.ToNextBracket = nil, nil
+			if got != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCalculatePayroll(t *testing.T) {
+	testCases := []struct {
+		name     string
+		request  PayrollRequest
+		expected PayrollResponse
+	}{
+		{
+			name:    "First month spreads the year's tax",
+			request: PayrollRequest{Month: 1, MonthlySalary: money.New(50000)},
+			expected: PayrollResponse{
+				TaxYear: 2567, Month: 1,
+				ProjectedIncome:   money.New(600000),
+				AnnualTax:         money.New(29000),
+				SalaryWithholding: money.MustParse("2416.67"),
+				Withholding:       money.MustParse("2416.67"),
+			},
+		},
+		{
+			name: "Bonus tax is withheld in the month it is paid",
+			request: PayrollRequest{
+				Month:         7,
+				MonthlySalary: money.New(50000),
+				Bonus:         money.New(100000),
+				YTDIncome:     money.New(300000),
+				YTDWithheld:   money.New(14500),
+			},
+			expected: PayrollResponse{
+				TaxYear: 2567, Month: 7,
+				ProjectedIncome:   money.New(700000),
+				AnnualTax:         money.New(41000),
+				SalaryWithholding: money.MustParse("2416.67"),
+				BonusWithholding:  money.New(12000),
+				Withholding:       money.MustParse("14416.67"),
+			},
+		},
+		{
+			name:    "Mid-year joiner is not annualised over twelve months",
+			request: PayrollRequest{Month: 10, MonthlySalary: money.New(200000)},
+			expected: PayrollResponse{
+				TaxYear: 2567, Month: 10,
+				ProjectedIncome:   money.New(600000),
+				AnnualTax:         money.New(29000),
+				SalaryWithholding: money.MustParse("9666.67"),
+				Withholding:       money.MustParse("9666.67"),
+			},
+		},
+		{
+			name: "Over-withheld employee has nothing more withheld",
+			request: PayrollRequest{
+				Month:         12,
+				MonthlySalary: money.New(50000),
+				YTDIncome:     money.New(550000),
+				YTDWithheld:   money.New(30000),
+			},
+			expected: PayrollResponse{
+				TaxYear: 2567, Month: 12,
+				ProjectedIncome: money.New(600000),
+				AnnualTax:       money.New(29000),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := validatePayrollRequest(&tc.request); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			got := calculatePayroll(tc.request, defaultTaxRules[2567])
+			if got != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCalculateHalfYear(t *testing.T) {
+	testCases := []struct {
+		name      string
+		request   Request
+		tax       money.Money
+		taxRefund money.Money
+	}{
+		{
+			name: "Half-year return halves the personal allowance",
+			request: Request{
+				HalfYear: true,
+				Incomes:  []Income{{Category: "40(8)", Amount: money.New(600000)}},
+			},
+			tax: money.New(6000),
+		},
+		{
+			name: "Half-year return halves claimed allowance limits",
+			request: Request{
+				HalfYear:   true,
+				Incomes:    []Income{{Category: "40(8)", Amount: money.New(600000)}},
+				Allowances: []Allowance{{AllowanceType: "k-receipt", Amount: money.New(50000)}},
+			},
+			tax: money.New(3500),
+		},
+		{
+			name: "Annual return credits the half-year tax",
+			request: Request{
+				TotalIncome: money.New(500000),
+				WHT:         money.New(20000),
+				PrepaidTax:  money.New(6000),
+			},
+			tax: money.New(3000),
+		},
+		{
+			name: "Half-year tax above the annual tax is refunded",
+			request: Request{
+				TotalIncome: money.New(500000),
+				WHT:         money.New(20000),
+				PrepaidTax:  money.New(10000),
+			},
+			taxRefund: money.New(1000),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateRequest(&tc.request); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			resp := calculate(tc.request, defaultTaxRules[2567])
+			if resp.Tax != tc.tax {
+				t.Errorf("Expected tax %v, got %v", tc.tax, resp.Tax)
+			}
+			if resp.TaxRefund != tc.taxRefund {
+				t.Errorf("Expected refund %v, got %v", tc.taxRefund, resp.TaxRefund)
+			}
+		})
+	}
+}
+
+func TestValidateHalfYear(t *testing.T) {
+	testCases := []struct {
+		name     string
+		request  Request
+		expected string
+	}{
+		{
+			name:     "Negative prepaid tax",
+			request:  Request{TotalIncome: money.New(500000), PrepaidTax: money.New(-1)},
+			expected: "prepaidTax must be between 0 and totalIncome",
+		},
+		{
+			name:     "Half-year without incomes",
+			request:  Request{HalfYear: true, TotalIncome: money.New(500000)},
+			expected: "halfYear requires incomes",
+		},
+		{
+			name: "Half-year with salary",
+			request: Request{
+				HalfYear: true,
+				Incomes:  []Income{{Category: "40(1)", Amount: money.New(500000)}},
+			},
+			expected: "halfYear incomes should be 40(5) to 40(8)",
+		},
+		{
+			name: "Half-year with prepaid tax",
+			request: Request{
+				HalfYear:   true,
+				Incomes:    []Income{{Category: "40(8)", Amount: money.New(500000)}},
+				PrepaidTax: money.New(1000),
+			},
+			expected: "prepaidTax is only allowed on the annual calculation",
+		},
+		{
+			name: "Half-year with dividends",
+			request: Request{
+				HalfYear:  true,
+				Incomes:   []Income{{Category: "40(8)", Amount: money.New(500000)}},
+				Dividends: []Dividend{{Amount: money.New(1000)}},
+			},
+			expected: "dividends are only allowed on the annual calculation",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateRequest(&tc.request)
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("Expected error %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestCalculateDividends(t *testing.T) {
+	noCredit := money.Rate(0)
+	testCases := []struct {
+		name      string
+		request   Request
+		expected  DividendResult
+		tax       money.Money
+		taxRefund money.Money
+	}{
+		{
+			name: "Low income includes dividends to claim the credit",
+			request: Request{
+				TotalIncome: money.New(200000),
+				Dividends:   []Dividend{{Amount: money.New(100000)}},
+			},
+			expected: DividendResult{
+				Election:       DividendElectionInclude,
+				Amount:         money.New(100000),
+				WithholdingTax: money.New(10000),
+				TaxCredit:      money.New(25000),
+				FinalTax:       money.New(10000),
+				IncludedTax:    money.New(-13500),
+			},
+			taxRefund: money.New(23500),
+		},
+		{
+			name: "Top bracket keeps the final withholding",
+			request: Request{
+				TotalIncome: money.New(3060000),
+				Dividends:   []Dividend{{Amount: money.New(100000)}},
+			},
+			expected: DividendResult{
+				Election:       DividendElectionFinal,
+				Amount:         money.New(100000),
+				WithholdingTax: money.New(10000),
+				TaxCredit:      money.New(25000),
+				FinalTax:       money.New(670000),
+				IncludedTax:    money.New(678750),
+			},
+			tax: money.New(660000),
+		},
+		{
+			name: "Dividends from exempt profit carry no credit",
+			request: Request{
+				TotalIncome: money.New(100000),
+				Dividends:   []Dividend{{Amount: money.New(100000), CorporateRate: &noCredit}},
+			},
+			expected: DividendResult{
+				Election:       DividendElectionInclude,
+				Amount:         money.New(100000),
+				WithholdingTax: money.New(10000),
+				FinalTax:       money.New(10000),
+			},
+			taxRefund: money.New(10000),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateRequest(&tc.request); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			resp := calculate(tc.request, defaultTaxRules[2567])
+			if resp.Dividend == nil || *resp.Dividend != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, resp.Dividend)
+			}
+			if resp.Tax != tc.tax {
+				t.Errorf("Expected tax %v, got %v", tc.tax, resp.Tax)
+			}
+			if resp.TaxRefund != tc.taxRefund {
+				t.Errorf("Expected refund %v, got %v", tc.taxRefund, resp.TaxRefund)
+			}
+		})
+	}
+}
+
+func TestCompareImpact(t *testing.T) {
+	reqs := []Request{
+		{TotalIncome: money.New(500000), Allowances: []Allowance{{AllowanceType: "k-receipt", Amount: money.New(80000)}}},
+		{TotalIncome: money.New(500000)},
+		{TaxYear: 2566, TotalIncome: money.New(500000), Allowances: []Allowance{{AllowanceType: "k-receipt", Amount: money.New(80000)}}},
+	}
+	current := map[int]TaxRules{2566: defaultTaxRules[2566], 2567: defaultTaxRules[2567]}
+	proposed := defaultTaxRules[2567]
+	proposed.Limits = map[string]money.Money{"k-receipt": money.New(100000)}
+
+	impact := compareImpact(reqs, current, proposed)
+
+	if impact.Rows != 3 || impact.Affected != 1 {
+		t.Fatalf("Expected 3 rows with 1 affected, got %d with %d", impact.Rows, impact.Affected)
+	}
+	if d := impact.Details[0].Difference; d != money.New(-3000) {
+		t.Errorf("Expected difference -3000, got %v", d)
+	}
+	if d := impact.Details[2].Difference; d != 0 {
+		t.Errorf("Expected another tax year to be unaffected, got %v", d)
+	}
+	if impact.Difference != impact.ProposedTax-impact.CurrentTax {
+		t.Errorf("Expected total difference %v, got %v", impact.ProposedTax-impact.CurrentTax, impact.Difference)
+	}
+}
+
+func TestValidateBrackets(t *testing.T) {
+	open := TaxBracket{LowerBound: money.New(150000), Rate: 10 * money.Percent, Label: "150,001 ขึ้นไป"}
+	first := TaxBracket{UpperBound: money.New(150000), Label: "0-150,000"}
+
+	testCases := []struct {
+		name     string
+		brackets []TaxBracket
+		expected string
+	}{
+		{name: "Built-in table", brackets: defaultTaxBrackets},
+		{name: "Empty", brackets: nil, expected: "at least one bracket is required"},
+		{name: "Not starting at zero", brackets: []TaxBracket{open}, expected: "the first bracket must start at 0"},
+		{name: "Closed last bracket", brackets: []TaxBracket{first}, expected: "the last bracket must have no upper bound"},
+		{
+			name:     "Gap",
+			brackets: []TaxBracket{first, {LowerBound: money.New(200000), Label: "gap"}},
+			expected: "bracket 2: must start where bracket 1 ends",
+		},
+		{
+			name:     "Rate above 100%",
+			brackets: []TaxBracket{first, {LowerBound: money.New(150000), Rate: 101 * money.Percent, Label: "high"}},
+			expected: "bracket 2: rate must be between 0 and 1",
+		},
+		{
+			name:     "Missing label",
+			brackets: []TaxBracket{{UpperBound: money.New(150000)}, open},
+			expected: "bracket 1: label is required",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateBrackets(tc.brackets)
+			if tc.expected == "" {
+				if err != nil {
+					t.Errorf("Unexpected error %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tc.expected {
+				t.Errorf("Expected error %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestSeedTaxBrackets(t *testing.T) {
+	db, f := fakedb.Open(
+		fakedb.Rule{Match: "SELECT EXISTS", Func: func(args []driver.Value) ([][]driver.Value, error) {
+			return [][]driver.Value{{args[0] == int64(2567)}}, nil
+		}},
+	)
+
+	if err := SeedTaxBrackets(db); err != nil {
+		t.Fatal(err)
+	}
+
+	seeded := make(map[int64]int)
+	for _, call := range f.Calls("INSERT INTO taxbracket") {
+		seeded[call.Args[4].(int64)]++
+	}
+	for _, year := range BuiltInTaxYears() {
+		expected := len(defaultTaxBrackets)
+		if year == 2567 {
+			expected = 0
+		}
+		if seeded[int64(year)] != expected {
+			t.Errorf("Expected %d brackets seeded for %d, got %d", expected, year, seeded[int64(year)])
+		}
+	}
+	if calls := f.Calls("INSERT INTO taxbracket"); len(calls) > 0 && calls[len(calls)-1].Args[1] != nil {
+		t.Errorf("Expected the last bracket to have no upper bound, got %v", calls[len(calls)-1].Args[1])
+	}
+}
+
+func TestRoundingPolicy(t *testing.T) {
+	for year, rules := range defaultTaxRules {
+		if rules.Rounding != defaultRounding {
+			t.Errorf("Expected %d to use the default rounding policy, got %+v", year, rules.Rounding)
+		}
+	}
+
+	names := []string{"taxLevel", "expense", "minimumTax", "allowance", "incomeCap", "halfYear", "dividendWithholding", "dividendCredit", "withholding", "rate"}
+	var policy RoundingPolicy
+	for _, name := range names {
+		field, ok := policy.step(name)
+		if !ok {
+			t.Fatalf("Expected step %s", name)
+		}
+		*field = money.Up
+	}
+	all := RoundingPolicy{money.Up, money.Up, money.Up, money.Up, money.Up, money.Up, money.Up, money.Up, money.Up, money.Up}
+	if policy != all {
+		t.Errorf("Expected every step to be set, got %+v", policy)
+	}
+
+	if steps := policy.Steps(); len(steps) != len(names) || steps["rate"] != "up" {
+		t.Errorf("Expected every step by name, got %v", steps)
+	}
+	if err := ValidateRounding(policy.Steps()); err != nil {
+		t.Errorf("Expected the steps of a policy to be valid, got %v", err)
+	}
+	if err := ValidateRounding(map[string]string{"total": "up"}); err == nil {
+		t.Error("Expected an unknown step to be rejected")
+	}
+	if err := ValidateRounding(map[string]string{"rate": "nearest"}); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+
+	req := PayrollRequest{Month: 6, MonthlySalary: money.New(50000)}
+	down, up := defaultTaxRules[2567], defaultTaxRules[2567]
+	down.Rounding.Withholding = money.Down
+	up.Rounding.Withholding = money.Up
+	d, u := calculatePayroll(req, down).SalaryWithholding, calculatePayroll(req, up).SalaryWithholding
+	if u-d != money.Satang {
+		t.Errorf("Expected the withholding rounding to decide the last satang, got %v and %v", d, u)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/Ter4798/post-test-kbtg/money"
 	"github.com/labstack/echo/v4"
 )
 
@@ -27,7 +28,7 @@ func HandlePersonalCalculationsCSV(db *sql.DB) echo.HandlerFunc {
 		}
 		defer src.Close()
 
-		requests, err := parseCsv(src, file.Filename)
+		requests, err := ParseCsv(src, file.Filename)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, err)
 		}
@@ -42,7 +43,10 @@ func HandlePersonalCalculationsCSV(db *sql.DB) echo.HandlerFunc {
 
 }
 
-func parseCsv(file io.Reader, fileName string) ([]Request, error) {
+// ParseCsv reads taxes.csv. After totalIncome, wht and donation the header
+// may list taxYear and the names of other claimable allowance types, in any
+// order, each at most once.
+func ParseCsv(file io.Reader, fileName string) ([]Request, error) {
 	ext := strings.ToLower(filepath.Ext(fileName))
 	if ext != ".csv" {
 		return nil, errors.New("file extension must be .csv")
@@ -63,9 +67,17 @@ func parseCsv(file io.Reader, fileName string) ([]Request, error) {
 		return nil, errors.New("empty file")
 	}
 	header := records[0]
-	if len(header) != 3 || header[0] != "totalIncome" || header[1] != "wht" || header[2] != "donation" {
+	if len(header) < 3 || header[0] != "totalIncome" || header[1] != "wht" || header[2] != "donation" {
 		return nil, errors.New("invalid header row")
 	}
+	seen := map[string]bool{"donation": true}
+	for _, column := range header[3:] {
+		t, ok := LookupAllowanceType(column)
+		if seen[column] || column != "taxYear" && (!ok || !t.Claimable()) {
+			return nil, errors.New("invalid header row")
+		}
+		seen[column] = true
+	}
 
 	var requests []Request
 	for i, record := range records {
@@ -73,26 +85,26 @@ func parseCsv(file io.Reader, fileName string) ([]Request, error) {
 			continue
 		}
 
-		if len(record) != 3 {
+		if len(record) != len(header) {
 			return nil, errors.New("invalid row data")
 		}
 
-		totalIncome, err := strconv.ParseFloat(record[0], 64)
+		totalIncome, err := money.Parse(record[0])
 		if err != nil || totalIncome < 0 {
 			return nil, errors.New("invalid totalIncome value")
 		}
 
-		wht, err := strconv.ParseFloat(record[1], 64)
+		wht, err := money.Parse(record[1])
 		if err != nil || wht < 0 {
 			return nil, errors.New("invalid wht value")
 		}
 
-		donation, err := strconv.ParseFloat(record[2], 64)
+		donation, err := money.Parse(record[2])
 		if err != nil || donation < 0 {
 			return nil, errors.New("invalid donation value")
 		}
 
-		requests = append(requests, Request{
+		req := Request{
 			TotalIncome: totalIncome,
 			WHT:         wht,
 			Allowances: []Allowance{
@@ -101,7 +113,28 @@ func parseCsv(file io.Reader, fileName string) ([]Request, error) {
 					Amount:        donation,
 				},
 			},
-		})
+		}
+		for j, column := range header[3:] {
+			value := record[j+3]
+			if column == "taxYear" {
+				if value == "" {
+					continue
+				}
+				req.TaxYear, err = strconv.Atoi(value)
+				if err != nil || req.TaxYear <= 0 {
+					return nil, errors.New("invalid taxYear value")
+				}
+				continue
+			}
+
+			amount, err := money.Parse(value)
+			if err != nil || amount < 0 {
+				return nil, errors.New("invalid " + column + " value")
+			}
+			req.Allowances = append(req.Allowances, Allowance{AllowanceType: column, Amount: amount})
+		}
+
+		requests = append(requests, req)
 	}
 
 	return requests, nil
@@ -120,14 +153,16 @@ func calculateTaxes(requests []Request, db *sql.DB) ([]TaxResponse, error) {
 }
 
 func calculateTax(req Request, db *sql.DB) (TaxResponse, error) {
-	tax, _, _, err := CalculateTax(db, req.TotalIncome, req.WHT, req.Allowances)
+	resp, err := CalculateTax(db, req)
 	if err != nil {
 		return TaxResponse{}, err
 	}
 
 	return TaxResponse{
+		TaxYear:     resp.TaxYear,
 		TotalIncome: req.TotalIncome,
-		Tax:         tax,
+		Tax:         resp.Tax,
+		Rates:       resp.Rates,
 	}, nil
 }
 
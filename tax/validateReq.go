@@ -2,48 +2,70 @@ package tax
 
 import (
 	"errors"
+	"strings"
 )
 
 func ValidateRequest(req *Request) error {
+	if err := validateTaxYear(req); err != nil {
+		return err
+	}
 
+	if err := validateIncomes(req); err != nil {
+		return err
+	}
 	if err := validateTotalIncome(req); err != nil {
 		return err
 	}
 	if err := validateWHT(req); err != nil {
 		return err
 	}
+	if err := validateHalfYear(req); err != nil {
+		return err
+	}
+	if err := validateDividends(req); err != nil {
+		return err
+	}
 	if err := validateAllowanceTypes(req); err != nil {
 		return err
 	}
 	if err := validateAllowanceAmounts(req); err != nil {
 		return err
 	}
+	if err := validateProfile(req); err != nil {
+		return err
+	}
+	return nil
+}
+
+func validateTaxYear(req *Request) error {
+	if req.TaxYear < 0 {
+		return errors.New("taxYear must be greater than zero")
+	}
 	return nil
 }
 
 func validateTotalIncome(req *Request) error {
-	if req.TotalIncome <= 0 {
+	if len(req.Incomes) > 0 && req.TotalIncome != 0 && req.TotalIncome != req.grossIncome() {
+		return errors.New("totalIncome must equal the sum of incomes")
+	}
+	if req.grossIncome() <= 0 && len(req.Dividends) == 0 {
 		return errors.New("totalIncome must be greater than zero")
 	}
 	return nil
 }
 
 func validateWHT(req *Request) error {
-	if req.WHT < 0 || req.WHT > req.TotalIncome {
+	if req.WHT < 0 || req.WHT > req.grossIncome() {
 		return errors.New("invalid WHT must be greater than zero and morn than TotalIncome")
 	}
 	return nil
 }
 
 func validateAllowanceTypes(req *Request) error {
-	validAllowanceTypes := map[string]bool{
-		"donation":  true,
-		"k-receipt": true,
-	}
-
 	for _, allowance := range req.Allowances {
-		if _, ok := validAllowanceTypes[allowance.AllowanceType]; !ok {
-			return errors.New("invalid allowance type type should be donation, k-receipt")
+		t, ok := LookupAllowanceType(allowance.AllowanceType)
+		if !ok || !t.Claimable() {
+			return errors.New("invalid allowance type type should be " + strings.Join(claimableAllowanceTypeNames(), ", "))
 		}
 	}
 	return nil
@@ -51,8 +73,12 @@ func validateAllowanceTypes(req *Request) error {
 
 func validateAllowanceAmounts(req *Request) error {
 	for _, allowance := range req.Allowances {
-		if allowance.Amount < 0 {
-			return errors.New("invalid allowance amount must be greater than 0")
+		t, ok := LookupAllowanceType(allowance.AllowanceType)
+		if !ok {
+			continue
+		}
+		if err := t.Validate(allowance); err != nil {
+			return err
 		}
 	}
 	return nil